@@ -0,0 +1,458 @@
+package tcmu
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"libtcmu/scsi"
+)
+
+// ALUAState is the asymmetric access state of a target port group.
+type ALUAState uint8
+
+const (
+	ALUAActiveOptimized    ALUAState = 0x0
+	ALUAActiveNonOptimized ALUAState = 0x1
+	ALUAStandby            ALUAState = 0x2
+	ALUAUnavailable        ALUAState = 0x3
+	ALUATransitioning      ALUAState = 0xf
+)
+
+func (s ALUAState) valid() bool {
+	switch s {
+	case ALUAActiveOptimized, ALUAActiveNonOptimized, ALUAStandby, ALUAUnavailable, ALUATransitioning:
+		return true
+	}
+	return false
+}
+
+// aluaSupportedStates is the byte of REPORT TARGET PORT GROUPS saying which states a group may be in: T_SUP,
+// U_SUP, S_SUP, AN_SUP and AO_SUP.
+const aluaSupportedStates = 0x80 | 0x08 | 0x04 | 0x02 | 0x01
+
+// STATUS CODE of a target port group, saying why it's in the state it's in.
+const (
+	aluaStatusNone     = 0x00
+	aluaStatusExplicit = 0x01
+	aluaStatusImplicit = 0x02
+)
+
+// TargetPortGroup is a group of target ports that share an asymmetric access state.
+type TargetPortGroup struct {
+	ID    uint16
+	State ALUAState
+	// Preferred is reported as the PREF bit, asking initiators to use the group over others in the same state.
+	Preferred bool
+	// Ports are the relative target port identifiers of the ports in the group.
+	Ports []uint16
+}
+
+// ALUAOptions set up asymmetric logical unit access for a device that's one path of several to the same
+// backend, eg. one of two daemons each serving it on a target port of its own, so that dm-multipath can fail
+// over between them. Groups describes every path's group; the device's own port is in the one with ID Group.
+//
+// Each daemon keeps its own copy of the states, and it's up to them to agree: a change made with SET TARGET
+// PORT GROUPS is passed to OnStateChange for the daemon to send to its peer, which applies it with
+// VirBlkDev.SetTargetPortGroupState.
+type ALUAOptions struct {
+	// Groups are the target port groups reported by REPORT TARGET PORT GROUPS, and the states they start in
+	// unless the device has saved others in DeviceOptions.StateDir. No groups leaves ALUA out.
+	Groups []TargetPortGroup
+	// Group is the ID of the group the device's own port is in. It's added, active/optimized, if Groups
+	// doesn't have it.
+	Group uint16
+	// RelativePort is the relative target port identifier of the device's own port, reported in the Device
+	// Identification VPD page and added to its group's Ports. Defaults to 1.
+	RelativePort uint16
+	// Implicit is set if the states are changed by the device, through VirBlkDev.SetTargetPortGroupState,
+	// and Explicit if initiators may change them with SET TARGET PORT GROUPS. With neither set, it's
+	// implicit.
+	Implicit bool
+	Explicit bool
+	// OnStateChange, if set, is called with every group's state once SET TARGET PORT GROUPS has changed any,
+	// before the command completes. If it fails, eg. because the peer couldn't be told, the states go back to
+	// what they were and the command fails. It isn't called for SetTargetPortGroupState, whose caller already
+	// knows.
+	OnStateChange func(groups []TargetPortGroup) error
+}
+
+var errALUANotEnabled = errors.New("tcmu: device has no target port groups")
+
+// alua holds the target port groups of a device with ALUA, and their states.
+type alua struct {
+	sync.Mutex
+	groups []TargetPortGroup
+	status []byte
+	// local is the index in groups of the device's own group.
+	local    int
+	port     uint16
+	explicit bool
+	implicit bool
+	onChange func(groups []TargetPortGroup) error
+	// path is the file the states are saved in, or "" if they aren't.
+	path string
+}
+
+// newALUA returns the ALUA state for opts, or nil if there are no groups. States saved under stateDir
+// replace those in opts.
+func newALUA(opts ALUAOptions, stateDir string, volume string) *alua {
+	if len(opts.Groups) == 0 {
+		return nil
+	}
+	a := &alua{
+		port:     opts.RelativePort,
+		explicit: opts.Explicit,
+		implicit: opts.Implicit || !opts.Explicit,
+		local:    -1,
+		onChange: opts.OnStateChange,
+	}
+	if a.port == 0 {
+		a.port = 1
+	}
+	for _, g := range opts.Groups {
+		g.Ports = append([]uint16(nil), g.Ports...)
+		if !g.State.valid() {
+			log.Warnf("[newALUA] target port group %d has unknown state 0x%x, using active/optimized", g.ID, g.State)
+			g.State = ALUAActiveOptimized
+		}
+		if g.ID == opts.Group {
+			a.local = len(a.groups)
+		}
+		a.groups = append(a.groups, g)
+	}
+	if a.local < 0 {
+		a.local = len(a.groups)
+		a.groups = append(a.groups, TargetPortGroup{ID: opts.Group, State: ALUAActiveOptimized})
+	}
+	local := &a.groups[a.local]
+	found := false
+	for _, p := range local.Ports {
+		found = found || p == a.port
+	}
+	if !found {
+		local.Ports = append(local.Ports, a.port)
+	}
+	a.status = make([]byte, len(a.groups))
+	if stateDir != "" {
+		a.path = filepath.Join(stateDir, volume+".alua")
+		if err := a.load(); err != nil && !os.IsNotExist(err) {
+			log.Warnf("[newALUA] ignoring saved target port group states in %s: %v", a.path, err)
+		}
+	}
+	return a
+}
+
+// load reads the saved states, keyed by group ID. Groups that are no longer there, and states that aren't
+// valid, are ignored.
+func (a *alua) load() error {
+	buf, err := ioutil.ReadFile(a.path)
+	if err != nil {
+		return err
+	}
+	var saved map[uint16]ALUAState
+	if err := json.Unmarshal(buf, &saved); err != nil {
+		return err
+	}
+	for i := range a.groups {
+		if s, ok := saved[a.groups[i].ID]; ok && s.valid() {
+			a.groups[i].State = s
+		}
+	}
+	return nil
+}
+
+// save writes the states, if there's somewhere to. The caller holds the lock.
+func (a *alua) save() error {
+	if a.path == "" {
+		return nil
+	}
+	states := make(map[uint16]ALUAState, len(a.groups))
+	for _, g := range a.groups {
+		states[g.ID] = g.State
+	}
+	return writeJSONFile(a.path, states)
+}
+
+// snapshot returns a copy of the groups and their status codes, for restore to put back.
+func (a *alua) snapshot() ([]TargetPortGroup, []byte) {
+	a.Lock()
+	defer a.Unlock()
+	groups := make([]TargetPortGroup, len(a.groups))
+	for i, g := range a.groups {
+		g.Ports = append([]uint16(nil), g.Ports...)
+		groups[i] = g
+	}
+	return groups, append([]byte(nil), a.status...)
+}
+
+// restore puts back the states from a snapshot, and saves them again.
+func (a *alua) restore(groups []TargetPortGroup, status []byte) {
+	a.Lock()
+	defer a.Unlock()
+	for i := range a.groups {
+		a.groups[i].State = groups[i].State
+	}
+	copy(a.status, status)
+	if err := a.save(); err != nil {
+		log.Errorf("[alua] saving target port group states back in %s: %v", a.path, err)
+	}
+}
+
+// tpgs is the TPGS field of the standard INQUIRY data: bit 0 for implicit ALUA, bit 1 for explicit.
+func (a *alua) tpgs() byte {
+	if a == nil {
+		return 0
+	}
+	var t byte
+	if a.implicit {
+		t |= 0x01
+	}
+	if a.explicit {
+		t |= 0x02
+	}
+	return t
+}
+
+func (a *alua) localState() ALUAState {
+	a.Lock()
+	defer a.Unlock()
+	return a.groups[a.local].State
+}
+
+func (a *alua) find(id uint16) (int, bool) {
+	for i, g := range a.groups {
+		if g.ID == id {
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+// set changes the state of group id, with status the STATUS CODE saying why, and saves the states if it
+// changed. It reports whether the state changed; if saving fails, it's left changed for the caller to
+// restore.
+func (a *alua) set(id uint16, state ALUAState, status byte) (bool, error) {
+	a.Lock()
+	defer a.Unlock()
+	i, ok := a.find(id)
+	if !ok {
+		return false, fmt.Errorf("tcmu: no target port group %d", id)
+	}
+	a.status[i] = status
+	if a.groups[i].State == state {
+		return false, nil
+	}
+	a.groups[i].State = state
+	return true, a.save()
+}
+
+// report is the REPORT TARGET PORT GROUPS parameter data, with the extended header if extended is set.
+func (a *alua) report(extended bool) []byte {
+	a.Lock()
+	defer a.Unlock()
+	hdr := 4
+	if extended {
+		hdr = 8
+	}
+	buf := make([]byte, hdr)
+	if extended {
+		buf[4] = 0x10 // FORMAT TYPE: extended header; IMPLICIT TRANSITION TIME is left at 0
+	}
+	for i, g := range a.groups {
+		d := make([]byte, 8+4*len(g.Ports))
+		d[0] = byte(g.State)
+		if g.Preferred {
+			d[0] |= 0x80 // PREF
+		}
+		d[1] = aluaSupportedStates
+		binary.BigEndian.PutUint16(d[2:4], g.ID)
+		d[5] = a.status[i]
+		d[7] = byte(len(g.Ports))
+		for j, p := range g.Ports {
+			binary.BigEndian.PutUint16(d[8+4*j+2:], p)
+		}
+		buf = append(buf, d...)
+	}
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(buf)-4))
+	return buf
+}
+
+// relativePort is the relative target port identifier of the device's port.
+func (vbd *VirBlkDev) relativePort() uint16 {
+	if vbd.alua == nil {
+		return 1
+	}
+	return vbd.alua.port
+}
+
+// SetTargetPortGroupState changes the asymmetric access state of the target port group id as an implicit
+// transition, eg. to make this path active when the daemon serving another has failed, or to apply a change
+// the peer daemon passed on from its ALUAOptions.OnStateChange. The new state is saved in StateDir, and the
+// initiator gets an ASYMMETRIC ACCESS STATE CHANGED unit attention. Telling the peer about a change made
+// here is up to the caller.
+func (vbd *VirBlkDev) SetTargetPortGroupState(id uint16, state ALUAState) error {
+	if vbd.alua == nil {
+		return errALUANotEnabled
+	}
+	if !state.valid() {
+		return fmt.Errorf("tcmu: unknown asymmetric access state 0x%x", state)
+	}
+	groups, status := vbd.alua.snapshot()
+	changed, err := vbd.alua.set(id, state, aluaStatusImplicit)
+	if err != nil {
+		if changed {
+			vbd.alua.restore(groups, status)
+		}
+		return err
+	}
+	if changed {
+		log.Infof("[SetTargetPortGroupState] vbd:%s target port group %d is now in state 0x%x", vbd.devPath, id, state)
+		vbd.EstablishUnitAttention(scsi.AscAsymmetricAccessStateChanged)
+	}
+	return nil
+}
+
+// TargetPortGroupState returns the asymmetric access state of the target port group id.
+func (vbd *VirBlkDev) TargetPortGroupState(id uint16) (ALUAState, error) {
+	if vbd.alua == nil {
+		return 0, errALUANotEnabled
+	}
+	vbd.alua.Lock()
+	defer vbd.alua.Unlock()
+	i, ok := vbd.alua.find(id)
+	if !ok {
+		return 0, fmt.Errorf("tcmu: no target port group %d", id)
+	}
+	return vbd.alua.groups[i].State, nil
+}
+
+// aluaAllowed reports whether cmd may run while the device's own group is in state. The commands allowed in
+// each state are those target_core allows its own devices.
+func aluaAllowed(cmd *ScsiCmd, state ALUAState) bool {
+	sa := cmd.GetCDB(1) & 0x1f
+	switch cmd.Command() {
+	case scsi.Inquiry, scsi.ReportLuns, scsi.RequestSense, scsi.ReadBuffer, scsi.WriteBuffer:
+		return true
+	case scsi.MaintenanceIn:
+		return sa == scsi.MiReportTargetPgs
+	case scsi.MaintenanceOut:
+		return sa == scsi.MoSetTargetPgs && state != ALUATransitioning
+	}
+	if state != ALUAStandby {
+		return false
+	}
+	switch cmd.Command() {
+	case scsi.LogSelect, scsi.LogSense, scsi.ModeSelect, scsi.ModeSelect10, scsi.ModeSense, scsi.ModeSense10,
+		scsi.ReceiveDiagnostic, scsi.SendDiagnostic, scsi.PersistentReserveIn, scsi.PersistentReserveOut:
+		return true
+	case scsi.ServiceActionIn16:
+		return sa == scsi.SaiReadCapacity16
+	}
+	return false
+}
+
+// aluaNotReady returns NOT READY, LOGICAL UNIT NOT ACCESSIBLE for a command that can't run while the device's
+// own target port group is in a standby, unavailable or transitioning state.
+func (vbd *VirBlkDev) aluaNotReady(cmd *ScsiCmd) (ScsiResponse, bool) {
+	if vbd.alua == nil {
+		return ScsiResponse{}, false
+	}
+	state := vbd.alua.localState()
+	var asc uint16
+	switch state {
+	case ALUAStandby:
+		asc = scsi.AscLunNotAccessibleTargetPortInStandby
+	case ALUAUnavailable:
+		asc = scsi.AscLunNotAccessibleTargetPortUnavailable
+	case ALUATransitioning:
+		asc = scsi.AscLunNotAccessibleAsymmetricAccessTransition
+	default:
+		return ScsiResponse{}, false
+	}
+	if aluaAllowed(cmd, state) {
+		return ScsiResponse{}, false
+	}
+	return cmd.CheckCondition(scsi.SenseNotReady, asc), true
+}
+
+// EmulateReportTargetPortGroups reports the device's target port groups and their states, with the extended
+// header if the PARAMETER DATA FORMAT asks for it.
+func EmulateReportTargetPortGroups(cmd *ScsiCmd) (ScsiResponse, error) {
+	a := cmd.VirBlkDev().alua
+	if a == nil {
+		return cmd.PassToKernel(), nil
+	}
+	return cmd.WriteData(a.report(cmd.GetCDB(1)>>5 == 0x01)), nil
+}
+
+// EmulateSetTargetPortGroups changes the states of the target port groups in its parameter list, if the
+// device allows explicit ALUA, saves them, and passes them to ALUAOptions.OnStateChange. If either fails,
+// the states go back to what they were and the command fails.
+func EmulateSetTargetPortGroups(cmd *ScsiCmd) (ScsiResponse, error) {
+	vbd := cmd.VirBlkDev()
+	a := vbd.alua
+	if a == nil {
+		return cmd.PassToKernel(), nil
+	}
+	if !a.explicit {
+		return cmd.NotHandled(), nil
+	}
+
+	paramLen := int(binary.BigEndian.Uint32([]byte{cmd.GetCDB(6), cmd.GetCDB(7), cmd.GetCDB(8), cmd.GetCDB(9)}))
+	if paramLen == 0 {
+		return cmd.Ok(), nil
+	}
+	if paramLen < 4 || (paramLen-4)%4 != 0 || paramLen > cmd.BufferLen() {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscParameterListLengthError), nil
+	}
+	params := make([]byte, paramLen)
+	n, err := cmd.Read(params)
+	if err != nil && err != io.EOF {
+		return ScsiResponse{}, err
+	}
+	if n < paramLen {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscParameterListLengthError), nil
+	}
+
+	// Check every descriptor before changing anything.
+	for off := 4; off < paramLen; off += 4 {
+		switch ALUAState(params[off] & 0x0f) {
+		case ALUAActiveOptimized, ALUAActiveNonOptimized, ALUAStandby, ALUAUnavailable:
+		default:
+			return cmd.InvalidFieldInParameterList(off, 3), nil
+		}
+		a.Lock()
+		_, ok := a.find(binary.BigEndian.Uint16(params[off+2 : off+4]))
+		a.Unlock()
+		if !ok {
+			return cmd.InvalidFieldInParameterList(off+2, -1), nil
+		}
+	}
+	groups, status := a.snapshot()
+	changed := false
+	for off := 4; off < paramLen; off += 4 {
+		c, err := a.set(binary.BigEndian.Uint16(params[off+2:off+4]), ALUAState(params[off]&0x0f), aluaStatusExplicit)
+		changed = changed || c
+		if err != nil {
+			log.Errorf("[EmulateSetTargetPortGroups] vbd:%s saving target port group states: %v", vbd.devPath, err)
+			a.restore(groups, status)
+			return cmd.CheckCondition(scsi.SenseHardwareError, scsi.AscSetTargetPortGroupsCommandFailed), nil
+		}
+	}
+	if changed && a.onChange != nil {
+		now, _ := a.snapshot()
+		if err := a.onChange(now); err != nil {
+			log.Errorf("[EmulateSetTargetPortGroups] vbd:%s passing on target port group states: %v", vbd.devPath, err)
+			a.restore(groups, status)
+			return cmd.CheckCondition(scsi.SenseHardwareError, scsi.AscSetTargetPortGroupsCommandFailed), nil
+		}
+	}
+	return cmd.Ok(), nil
+}
@@ -0,0 +1,182 @@
+package tcmu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"libtcmu/scsi"
+)
+
+// twoGroups is a device on port 1 in group 1, active/optimized, with its peer on port 2 in group 2, on standby.
+func twoGroups() ALUAOptions {
+	return ALUAOptions{
+		Groups:       []TargetPortGroup{{ID: 1, State: ALUAActiveOptimized, Preferred: true}, {ID: 2, State: ALUAStandby, Ports: []uint16{2}}},
+		Group:        1,
+		RelativePort: 1,
+		Implicit:     true,
+		Explicit:     true,
+	}
+}
+
+var (
+	rtpgCDB = []byte{scsi.MaintenanceIn, scsi.MiReportTargetPgs, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0}
+	stpgCDB = []byte{scsi.MaintenanceOut, scsi.MoSetTargetPgs, 0, 0, 0, 0, 0, 0, 0, 8, 0, 0}
+)
+
+// stpgParams sets group id to state.
+func stpgParams(state ALUAState, id uint16) []byte {
+	p := make([]byte, 8)
+	p[4] = byte(state)
+	binary.BigEndian.PutUint16(p[6:], id)
+	return p
+}
+
+func TestALUA(t *testing.T) {
+	r := newTestRing(t, "t", memHandler(1<<20), 1<<20, DeviceOptions{ALUA: twoGroups()}, FakeRingConfig{})
+	defer r.Close()
+	vbd := r.Device()
+
+	if fc, _ := r.Do([]byte{scsi.Inquiry, 0, 0, 0, 36, 0}, nil, 36); fc.Data[5]&0x30 != 0x30 {
+		t.Fatalf("TPGS 0x%x, want implicit and explicit", fc.Data[5]>>4&0x03)
+	}
+	if fc, _ := r.Do([]byte{scsi.Inquiry, 1, 0x83, 0, 255, 0}, nil, 255); !bytes.Contains(fc.Data, []byte{0x61, 0x95, 0, 4, 0, 0, 0, 1}) {
+		t.Fatalf("no relative target port designator for port 1 in % x", fc.Data)
+	}
+	fc, err := r.Do(rtpgCDB, nil, 256)
+	want := []byte{0, 0, 0, 24, 0x80, 0x8f, 0, 1, 0, 0, 0, 1, 0, 0, 0, 1, 0x02, 0x8f, 0, 2, 0, 0, 0, 1, 0, 0, 0, 2}
+	if err != nil || fc.Status != scsi.SamStatGood || !bytes.Equal(fc.Data[:len(want)], want) {
+		t.Fatalf("REPORT TARGET PORT GROUPS: % x, want % x", fc.Data[:len(want)], want)
+	}
+	extended := append([]byte(nil), rtpgCDB...)
+	extended[1] |= 0x20
+	if fc, _ := r.Do(extended, nil, 256); fc.Data[4] != 0x10 || binary.BigEndian.Uint32(fc.Data) != 28 {
+		t.Fatalf("extended header: % x", fc.Data[:8])
+	}
+
+	// SET TARGET PORT GROUPS puts this path on standby, where only some commands run.
+	if fc, err := r.Do(stpgCDB, stpgParams(ALUAStandby, 1), 0); err != nil || fc.Status != scsi.SamStatGood {
+		t.Fatalf("SET TARGET PORT GROUPS: %v, status 0x%02x", err, fc.Status)
+	}
+	fc, err = r.Do(rw10(scsi.Read10, 0, 1), nil, 512)
+	expectSense(t, "read on standby", fc, err, scsi.SenseNotReady, scsi.AscLunNotAccessibleTargetPortInStandby)
+	if fc, err := r.Do([]byte{scsi.ServiceActionIn16, scsi.SaiReadCapacity16, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 32, 0, 0}, nil, 32); err != nil ||
+		fc.Status != scsi.SamStatGood {
+		t.Fatalf("READ CAPACITY(16) on standby: %v, status 0x%02x", err, fc.Status)
+	}
+	if fc, _ := r.Do(rtpgCDB, nil, 256); fc.Data[4] != 0x82 || fc.Data[9] != aluaStatusExplicit {
+		t.Fatalf("after SET TARGET PORT GROUPS: % x", fc.Data[4:12])
+	}
+	fc, err = r.Do(stpgCDB, stpgParams(ALUATransitioning, 1), 0)
+	expectSense(t, "transitioning by STPG", fc, err, scsi.SenseIllegalRequest, scsi.AscInvalidFieldInParameterList)
+	fc, err = r.Do(stpgCDB, stpgParams(ALUAActiveOptimized, 9), 0)
+	expectSense(t, "unknown group", fc, err, scsi.SenseIllegalRequest, scsi.AscInvalidFieldInParameterList)
+
+	// An implicit transition tells the initiator with a unit attention.
+	if err := vbd.SetTargetPortGroupState(1, ALUAUnavailable); err != nil {
+		t.Fatal(err)
+	}
+	fc, err = r.Do(testUnitReady, nil, 0)
+	expectSense(t, "implicit transition", fc, err, scsi.SenseUnitAttention, scsi.AscAsymmetricAccessStateChanged)
+	fc, err = r.Do(testUnitReady, nil, 0)
+	expectSense(t, "unavailable", fc, err, scsi.SenseNotReady, scsi.AscLunNotAccessibleTargetPortUnavailable)
+	vbd.SetTargetPortGroupState(1, ALUATransitioning)
+	r.Do([]byte{scsi.RequestSense, 0, 0, 0, 18, 0}, nil, 18)
+	fc, err = r.Do(stpgCDB, stpgParams(ALUAActiveOptimized, 1), 0)
+	expectSense(t, "STPG while transitioning", fc, err, scsi.SenseNotReady, scsi.AscLunNotAccessibleAsymmetricAccessTransition)
+	vbd.SetTargetPortGroupState(1, ALUAActiveNonOptimized)
+	r.Do([]byte{scsi.RequestSense, 0, 0, 0, 18, 0}, nil, 18)
+	if fc, err := r.Do(rw10(scsi.Read10, 0, 1), nil, 512); err != nil || fc.Status != scsi.SamStatGood {
+		t.Fatalf("read when active/non-optimized: %v, status 0x%02x", err, fc.Status)
+	}
+	if s, _ := vbd.TargetPortGroupState(2); s != ALUAStandby {
+		t.Fatalf("peer's group is in state 0x%x, want it left on standby", s)
+	}
+}
+
+func TestNoALUA(t *testing.T) {
+	r := newTestRing(t, "u", memHandler(1<<20), 1<<20, DeviceOptions{ALUA: ALUAOptions{}}, FakeRingConfig{})
+	defer r.Close()
+	if fc, _ := r.Do([]byte{scsi.Inquiry, 0, 0, 0, 36, 0}, nil, 36); fc.Data[5] != 0 {
+		t.Fatalf("TPGS set without ALUA: 0x%02x", fc.Data[5])
+	}
+	if fc, _ := r.Do(rtpgCDB, nil, 256); !fc.UnknownOp {
+		t.Fatal("REPORT TARGET PORT GROUPS wasn't passed back to the kernel without ALUA")
+	}
+	if err := r.Device().SetTargetPortGroupState(1, ALUAStandby); err != errALUANotEnabled {
+		t.Fatalf("SetTargetPortGroupState without ALUA: %v", err)
+	}
+}
+
+func TestALUAStatesSaved(t *testing.T) {
+	dir := t.TempDir()
+	r := newTestRing(t, "t", memHandler(1<<20), 1<<20, DeviceOptions{StateDir: dir, ALUA: twoGroups()}, FakeRingConfig{})
+	two := append([]byte(nil), stpgCDB...)
+	two[9] = 12
+	if fc, err := r.Do(two, append(stpgParams(ALUAStandby, 1), stpgParams(ALUAActiveOptimized, 2)[4:]...), 0); err != nil ||
+		fc.Status != scsi.SamStatGood {
+		t.Fatalf("SET TARGET PORT GROUPS: %v, status 0x%02x", err, fc.Status)
+	}
+	r.Close()
+
+	// The next time the device is created, the saved states win over those it's created with.
+	r = newTestRing(t, "t", memHandler(1<<20), 1<<20, DeviceOptions{StateDir: dir, ALUA: twoGroups()}, FakeRingConfig{})
+	defer r.Close()
+	for id, want := range map[uint16]ALUAState{1: ALUAStandby, 2: ALUAActiveOptimized} {
+		if s, _ := r.Device().TargetPortGroupState(id); s != want {
+			t.Fatalf("group %d is in state 0x%x after restart, want 0x%x", id, s, want)
+		}
+	}
+	if err := r.Device().SetTargetPortGroupState(1, ALUAActiveNonOptimized); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	r = newTestRing(t, "t", memHandler(1<<20), 1<<20, DeviceOptions{StateDir: dir, ALUA: twoGroups()}, FakeRingConfig{})
+	defer r.Close()
+	if s, _ := r.Device().TargetPortGroupState(1); s != ALUAActiveNonOptimized {
+		t.Fatalf("implicit transition wasn't saved: state 0x%x", s)
+	}
+}
+
+func TestALUAOnStateChange(t *testing.T) {
+	var told [][]TargetPortGroup
+	var fail error
+	opts := twoGroups()
+	opts.OnStateChange = func(groups []TargetPortGroup) error {
+		told = append(told, groups)
+		return fail
+	}
+	r := newTestRing(t, "t", memHandler(1<<20), 1<<20, DeviceOptions{StateDir: t.TempDir(), ALUA: opts}, FakeRingConfig{})
+	defer r.Close()
+	vbd := r.Device()
+
+	// A peer that can't be told fails the command, and nothing changes.
+	fail = errors.New("peer unreachable")
+	fc, err := r.Do(stpgCDB, stpgParams(ALUAActiveNonOptimized, 1), 0)
+	expectSense(t, "STPG with the peer unreachable", fc, err, scsi.SenseHardwareError, scsi.AscSetTargetPortGroupsCommandFailed)
+	if s, _ := vbd.TargetPortGroupState(1); s != ALUAActiveOptimized {
+		t.Fatalf("group 1 is in state 0x%x after a failed STPG, want it unchanged", s)
+	}
+
+	fail = nil
+	told = nil
+	if fc, err := r.Do(stpgCDB, stpgParams(ALUAActiveNonOptimized, 1), 0); err != nil || fc.Status != scsi.SamStatGood {
+		t.Fatalf("SET TARGET PORT GROUPS: %v, status 0x%02x", err, fc.Status)
+	}
+	if len(told) != 1 || len(told[0]) != 2 || told[0][0].ID != 1 || told[0][0].State != ALUAActiveNonOptimized ||
+		told[0][1].State != ALUAStandby {
+		t.Fatalf("OnStateChange was told %+v", told)
+	}
+
+	// Setting a state that's already current, or one the peer passed on, isn't passed on again.
+	if fc, err := r.Do(stpgCDB, stpgParams(ALUAActiveNonOptimized, 1), 0); err != nil || fc.Status != scsi.SamStatGood {
+		t.Fatalf("SET TARGET PORT GROUPS: %v, status 0x%02x", err, fc.Status)
+	}
+	if err := vbd.SetTargetPortGroupState(2, ALUAActiveOptimized); err != nil {
+		t.Fatal(err)
+	}
+	if len(told) != 1 {
+		t.Fatalf("OnStateChange called %d times, want once", len(told))
+	}
+}
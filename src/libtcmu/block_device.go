@@ -2,7 +2,6 @@ package tcmu
 
 import (
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
@@ -12,11 +11,13 @@ import (
 	"time"
 
 	"golang.org/x/sys/unix"
-	"github.com/docker/docker/pkg/mount"
+	"libtcmu/scsi"
 	"sync"
+	"sync/atomic"
 )
 
 const (
+	// Where CONFIG_DIR_FORMAT and SCSI_DIR are under DefaultRoots. Devices use their Roots instead.
 	CONFIG_DIR_FORMAT = "/sys/kernel/config/target/core/user_%d"
 	SCSI_DIR = "/sys/kernel/config/target/loopback"
 
@@ -27,6 +28,7 @@ type VirBlkDev struct {
 	sync.Mutex
 
 	scsi       *ScsiHandler
+	roots      Roots
 	devPath    string
 	hbaDir     string
 	deviceName string
@@ -45,7 +47,30 @@ type VirBlkDev struct {
 	wait       chan struct{}
 
 	cmdRing    *ScsiResponseRing
-	cmdDone    chan int
+	cmdDone    chan indexedResponse
+	// Serializes completions at the mailbox tail, which workers write directly with out-of-order completion.
+	ringLock   sync.Mutex
+	// ringErr is set by getNextCommand if the ring is found corrupt.
+	ringErr       error
+	ringErrLogged bool
+	// stopped is set by START STOP UNIT, and fails media access with NOT READY until the unit is started.
+	stopped int32
+	// unmaps is set if the handler supports UNMAP.
+	unmaps bool
+	// limits and provisioning are worked out from the options when the device is created.
+	limits       BlockLimits
+	provisioning ProvisioningType
+	modePages      *modePages
+	unitAttentions unitAttentions
+	// lbaLock is held over the blocks being written, and over COMPARE AND WRITE's compare and write.
+	lbaLock lbaRangeLock
+	// sizeLock guards scsi.DataSizes, which Resize changes while commands are being handled.
+	sizeLock sync.RWMutex
+	// enabled is set once the device is enabled in configfs, where Resize then updates its size.
+	enabled bool
+	reservations *reservations
+	// alua is nil unless the device has target port groups.
+	alua *alua
 }
 
 // WWN provides two WWNs, one for the device itself and one for the loopback device created by the kernel.
@@ -59,11 +84,95 @@ func (vbd *VirBlkDev) GetDevConfig() string {
 }
 
 func (vbd *VirBlkDev) Sizes() DataSizes {
+	vbd.sizeLock.RLock()
+	defer vbd.sizeLock.RUnlock()
 	return vbd.scsi.DataSizes
 }
 
 func (vbd *VirBlkDev) Capacity() int64 {
-	return vbd.scsi.DataSizes.VolumeSize
+	return vbd.Sizes().VolumeSize
+}
+
+// Resize changes the size of the device to size bytes while it stays online. The backend must have a Resizer,
+// to grow or shrink whatever is behind it first; without one the size stays as it is, as shrinking a backend
+// that isn't told would silently drop what's past the new end. The size is then updated in configfs, and if
+// that fails the backend is resized back to the old size. READ CAPACITY reports the new size from then on, and
+// the initiator gets a CAPACITY DATA HAS CHANGED unit attention so that it rescans.
+func (vbd *VirBlkDev) Resize(size int64) error {
+	vbd.sizeLock.Lock()
+	defer vbd.sizeLock.Unlock()
+	sizes := vbd.scsi.DataSizes
+	if size <= 0 || size%sizes.SectorSize != 0 {
+		return fmt.Errorf("tcmu: size %d isn't a multiple of the %d byte sector size", size, sizes.SectorSize)
+	}
+	if size == sizes.VolumeSize {
+		return nil
+	}
+
+	r, ok := handlerResizer(vbd.scsi.Handler)
+	if !ok {
+		return errResizeNotSupported
+	}
+	if err := r.Resize(size); err != nil {
+		return err
+	}
+	if vbd.enabled {
+		err := writeLines(vbd.roots.FS, path.Join(vbd.hbaDir, vbd.scsi.VolumeName, "control"), []string{
+			fmt.Sprintf("dev_size=%d", size),
+		})
+		if err != nil {
+			if rerr := r.Resize(sizes.VolumeSize); rerr != nil {
+				log.Errorf("[Resize] vbd:%s resizing the backend back to %d bytes: %v", vbd.devPath, sizes.VolumeSize, rerr)
+			}
+			return err
+		}
+	}
+
+	log.Infof("[Resize] vbd:%s resized from %d to %d bytes", vbd.devPath, sizes.VolumeSize, size)
+	vbd.scsi.DataSizes.VolumeSize = size
+	vbd.EstablishUnitAttention(scsi.AscCapacityDataHasChanged)
+	return nil
+}
+
+// ThinProvisioned reports whether the device says it's thin provisioned to initiators.
+func (vbd *VirBlkDev) ThinProvisioned() bool {
+	return vbd.provisioning == ProvisioningThin
+}
+
+// Unmaps reports whether the device supports UNMAP, and says so to initiators.
+func (vbd *VirBlkDev) Unmaps() bool {
+	return vbd.unmaps
+}
+
+// BlockLimits returns the limits the device reports and enforces, with the defaults filled in.
+func (vbd *VirBlkDev) BlockLimits() BlockLimits {
+	return vbd.limits
+}
+
+// Serial returns the unit serial number reported in the Unit Serial Number VPD page: the hex digits of the
+// device's WWN, so that it stays the same for as long as the WWN does.
+func (vbd *VirBlkDev) Serial() string {
+	return strings.TrimPrefix(vbd.deviceID(), "naa.")
+}
+
+func (vbd *VirBlkDev) deviceID() string {
+	if vbd.scsi.WWN == nil {
+		return ""
+	}
+	return vbd.scsi.WWN.DeviceID()
+}
+
+// Stopped reports whether the device has been stopped by START STOP UNIT.
+func (vbd *VirBlkDev) Stopped() bool {
+	return atomic.LoadInt32(&vbd.stopped) != 0
+}
+
+func (vbd *VirBlkDev) setStopped(stopped bool) {
+	var v int32
+	if stopped {
+		v = 1
+	}
+	atomic.StoreInt32(&vbd.stopped, v)
 }
 
 func (vbd *VirBlkDev) GetDevice() string {
@@ -74,40 +183,46 @@ func (vbd *VirBlkDev) Name() string {
 	return vbd.scsi.VolumeName
 }
 
+// IsBusy reports whether the device's disk is mounted, or might be because the mount table can't be read.
 func (vbd *VirBlkDev) IsBusy() bool {
-	minfo, err := mount.GetMounts()
+	mounted, err := vbd.roots.isMounted(vbd.major, vbd.minor)
 	if err != nil {
+		log.Errorf("[IsBusy] vbd:%s read mount info error:%s", vbd.devPath, err)
 		return true
 	}
-	for _, info := range minfo {
-		if info.Major == vbd.major && info.Minor == vbd.minor {
-			return true
-		}
-	}
-
-	return false
+	return mounted
 }
 
-// newVirtBlockDevice creates the virtual device based on the details in the ScsiHandler, eventually creating
-// a device under devPath (eg, "/dev") with the file name scsi.VolumeName;
-// The returned vbd represents the open device connection to the kernel, and must be closed.
-func newVirtBlockDevice(devPath string, scsi *ScsiHandler) (*VirBlkDev, error) {
+// allocVirtBlockDevice sets up the in-memory state for a device, without touching the kernel.
+func allocVirtBlockDevice(devPath string, scsi *ScsiHandler, roots Roots) *VirBlkDev {
+	roots = roots.withDefaults()
+	unmaps := handlerUnmaps(scsi.Handler)
 	vbd := &VirBlkDev{
 		scsi:       scsi,
+		roots:      roots,
 		devPath:    filepath.Join(devPath, scsi.VolumeName),
 		uioFd:      -1,
-		hbaDir:     fmt.Sprintf(CONFIG_DIR_FORMAT, scsi.HBA),
+		hbaDir:     roots.userHbaDir(scsi.HBA),
 		initialize: false,
 		shut:       make(chan struct{}),
 		wait:       make(chan struct{}),
-		cmdRing:    &ScsiResponseRing{
-			capacity: CMD_RING_SIZE,
-			head:     0,
-			tail:     0,
-			data:     make([]*ScsiResponse, CMD_RING_SIZE),
-		},
-		cmdDone:    make(chan int, CMD_RING_SIZE),
+		unmaps:       unmaps,
+		limits:       scsi.Options.blockLimits(scsi.DataSizes.SectorSize),
+		provisioning: scsi.Options.provisioning(unmaps),
+		modePages:    newModePages(handlerBuffersWrites(scsi.Handler), scsi.Options.StateDir, scsi.VolumeName),
+		reservations: scsi.Options.reservations(scsi.VolumeName),
+		alua:         newALUA(scsi.Options.ALUA, scsi.Options.StateDir, scsi.VolumeName),
 	}
+	vbd.powerOn()
+	return vbd
+}
+
+// newVirtBlockDevice creates the virtual device based on the details in the ScsiHandler, eventually creating
+// a device under devPath (eg, "/dev") with the file name scsi.VolumeName; configfs, sysfs and devfs are
+// reached through roots.
+// The returned vbd represents the open device connection to the kernel, and must be closed.
+func newVirtBlockDevice(devPath string, scsi *ScsiHandler, roots Roots) (*VirBlkDev, error) {
+	vbd := allocVirtBlockDevice(devPath, scsi, roots)
 	err := vbd.Close()
 	if err != nil {
 		return nil, err
@@ -140,13 +255,14 @@ func (vbd *VirBlkDev) Close() error {
 
 	if vbd.initialize {
 		vbd.stopPoll()
-		vbd.closeDevice()
 
+		// Let the poll loop finish with the ring before it's unmapped.
 		select {
 		case <-vbd.wait:
 			break
 		case <-time.After(30 * time.Second):
 		}
+		vbd.closeDevice()
 
 		if err := unix.Close(vbd.pipeFds[0]); err != nil {
 			log.Errorf("[Close] vbd:%s Fail to close pipeFds[0]: %s", vbd.devPath, err)
@@ -160,23 +276,53 @@ func (vbd *VirBlkDev) Close() error {
 }
 
 func (vbd *VirBlkDev) preEnableTcmu() error {
-	err := writeLines(path.Join(vbd.hbaDir, vbd.scsi.VolumeName, "control"), []string{
+	err := writeLines(vbd.roots.FS, path.Join(vbd.hbaDir, vbd.scsi.VolumeName, "control"), []string{
 		fmt.Sprintf("dev_size=%d", vbd.scsi.DataSizes.VolumeSize),
 		fmt.Sprintf("dev_config=%s", vbd.GetDevConfig()),
 		fmt.Sprintf("hw_block_size=%d", vbd.scsi.DataSizes.SectorSize),
+		fmt.Sprintf("hw_max_sectors=%d", vbd.hwMaxSectors()),
 		"async=1",
 	})
 	if err != nil {
 		return err
 	}
 
-	return writeLines(path.Join(vbd.hbaDir, vbd.scsi.VolumeName, "enable"), []string{
+	if vbd.scsi.Options.EmulateReservations {
+		if err := vbd.disableKernelPR(); err != nil {
+			return err
+		}
+	}
+
+	err = writeLines(vbd.roots.FS, path.Join(vbd.hbaDir, vbd.scsi.VolumeName, "enable"), []string{
 		"1",
 	})
+	if err != nil {
+		return err
+	}
+	vbd.enabled = true
+	return nil
+}
+
+// disableKernelPR clears the emulate_pr attribute, so that target_core passes the reservation commands on to
+// be emulated here instead of handling them itself. A kernel without the attribute can't be asked to.
+func (vbd *VirBlkDev) disableKernelPR() error {
+	attr := path.Join(vbd.hbaDir, vbd.scsi.VolumeName, "attrib", "emulate_pr")
+	if _, err := vbd.roots.FS.Stat(attr); err != nil {
+		return fmt.Errorf("unable to emulate reservations: %v", err)
+	}
+	return writeLines(vbd.roots.FS, attr, []string{
+		"0",
+	})
+}
+
+// hwMaxSectors is the MaxTransferLength in the 512 byte sectors the kernel's hw_max_sectors is counted in,
+// so that the kernel doesn't send commands bigger than the device says it takes.
+func (vbd *VirBlkDev) hwMaxSectors() uint64 {
+	return uint64(vbd.limits.MaxTransferLength) * uint64(vbd.scsi.DataSizes.SectorSize) / 512
 }
 
 func (vbd *VirBlkDev) getSCSIPrefixAndWnn() (string, string) {
-	return path.Join(SCSI_DIR, vbd.scsi.WWN.DeviceID(), "tpgt_1"), vbd.scsi.WWN.NexusID()
+	return vbd.roots.config(configLoopbackDir, vbd.scsi.WWN.DeviceID(), "tpgt_1"), vbd.scsi.WWN.NexusID()
 }
 
 func (vbd *VirBlkDev) getLunPath(prefix string) string {
@@ -186,7 +332,7 @@ func (vbd *VirBlkDev) getLunPath(prefix string) string {
 func (vbd *VirBlkDev) postEnableTcmu() error {
 	prefix, nexusWnn := vbd.getSCSIPrefixAndWnn()
 
-	err := writeLines(path.Join(prefix, "nexus"), []string{
+	err := writeLines(vbd.roots.FS, path.Join(prefix, "nexus"), []string{
 		nexusWnn,
 	})
 	if err != nil {
@@ -194,11 +340,11 @@ func (vbd *VirBlkDev) postEnableTcmu() error {
 	}
 
 	lunPath := vbd.getLunPath(prefix)
-	if err := os.MkdirAll(lunPath, 0755); err != nil && !os.IsExist(err) {
+	if err := vbd.roots.FS.MkdirAll(lunPath, 0755); err != nil && !os.IsExist(err) {
 		return err
 	}
 
-	if err := os.Symlink(path.Join(vbd.hbaDir, vbd.scsi.VolumeName), path.Join(lunPath, vbd.scsi.VolumeName)); err != nil {
+	if err := vbd.roots.FS.Symlink(path.Join(vbd.hbaDir, vbd.scsi.VolumeName), path.Join(lunPath, vbd.scsi.VolumeName)); err != nil {
 		return err
 	}
 
@@ -213,7 +359,7 @@ func (vbd *VirBlkDev) SetDeviceNumber(major, minor int) {
 func (vbd *VirBlkDev) GenerateDevice() error {
 	//dev := filepath.Join(vbd.devPath, vbd.scsi.VolumeName)
 	//log.Infof("[GenerateDevEntry] dev:%s  major:%d, minor:%d", vbd.devPath, vbd.major, vbd.minor)
-	err := mknod(vbd.devPath, vbd.major, vbd.minor)
+	err := mknod(vbd.roots.FS, vbd.devPath, vbd.major, vbd.minor)
 	if err != nil {
 		log.Infof("[GenerateDevEntry] vbd:%s error:%s", vbd.devPath, err.Error())
 		return err
@@ -222,12 +368,12 @@ func (vbd *VirBlkDev) GenerateDevice() error {
 }
 
 func (vbd *VirBlkDev) GetDeviceAttr(attr string) (int, error) {
-	att, err := ioutil.ReadFile(fmt.Sprintf("/sys/kernel/config/target/core/user_%d/%s/attrib/%s", vbd.scsi.HBA, vbd.scsi.VolumeName, attr))
+	att, err := vbd.roots.FS.ReadFile(path.Join(vbd.hbaDir, vbd.scsi.VolumeName, "attrib", attr))
 	if err != nil {
 		return 0, err
 	}
 
-	i, err := strconv.Atoi(string(att))
+	i, err := strconv.Atoi(strings.TrimSpace(string(att)))
 	if err != nil {
 		return 0, err
 	}
@@ -235,19 +381,19 @@ func (vbd *VirBlkDev) GetDeviceAttr(attr string) (int, error) {
 	return i, nil
 }
 
-func mknod(device string, major, minor int) error {
+func mknod(fs FileSystem, device string, major, minor int) error {
 	var fileMode os.FileMode = 0600
 	fileMode |= syscall.S_IFBLK
 	dev := int((major << 8) | (minor & 0xff) | ((minor & 0xfff00) << 12))
 
-	return syscall.Mknod(device, uint32(fileMode), dev)
+	return fs.Mknod(device, uint32(fileMode), dev)
 }
 
-func writeLines(target string, lines []string) error {
+func writeLines(fs FileSystem, target string, lines []string) error {
 	dir := path.Dir(target)
-	if stat, err := os.Stat(dir); os.IsNotExist(err) {
+	if stat, err := fs.Stat(dir); os.IsNotExist(err) {
 		//log.Debugf("Creating directory: %s", dir)
-		if err := os.MkdirAll(dir, 0755); err != nil {
+		if err := fs.MkdirAll(dir, 0755); err != nil {
 			return err
 		}
 	} else if !stat.IsDir() {
@@ -257,7 +403,7 @@ func writeLines(target string, lines []string) error {
 	for _, line := range lines {
 		content := []byte(line + "\n")
 		//log.Debugf("Setting %s: %s", target, line)
-		if err := ioutil.WriteFile(target, content, 0755); err != nil {
+		if err := fs.WriteFile(target, content, 0755); err != nil {
 			//log.Debugf("Failed to write %s to %s: %v", line, target, err)
 			return err
 		}
@@ -271,73 +417,106 @@ func (vbd *VirBlkDev) start() (err error) {
 	if err != nil {
 		return
 	}
+	if vbd.mmap == nil {
+		return fmt.Errorf("no uio device found for %s", vbd.GetDevConfig())
+	}
+	if err = vbd.checkMailbox(); err != nil {
+		return
+	}
+	vbd.enableTmrNotification()
 
 	//vbd.cmdChan = make(chan *ScsiCmd, 128)
 	//vbd.respChan = make(chan ScsiResponse, 128)
-	//go vbd.startPollx()
-	go vbd.startPoll()
+	vbd.beginPoll()
 	//vbd.scsi.DevReady(vbd.cmdChan, vbd.respChan)
 	return
 }
 
-func (vbd *VirBlkDev) findDevice() error {
-	err := filepath.Walk("/dev", func(path string, i os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
+// enableTmrNotification asks the kernel for TMR entries on the ring, if the handler wants them and the
+// kernel can send them.
+func (vbd *VirBlkDev) enableTmrNotification() {
+	if _, ok := vbd.scsi.Handler.(TmrHandler); !ok || vbd.mbFlags()&mbFlagCapTmr == 0 {
+		return
+	}
+	err := writeLines(vbd.roots.FS, path.Join(vbd.hbaDir, vbd.scsi.VolumeName, "attrib", "tmr_notification"), []string{
+		"1",
+	})
+	if err != nil {
+		log.Warnf("[enableTmrNotification] vbd:%s unable to enable TMR notifications: %s", vbd.devPath, err)
+	}
+}
 
-		if i.IsDir() && path != "/dev" {
-			return filepath.SkipDir
-		}
+// beginPoll starts servicing the command ring, once uioFd and mmap are set up, serially or through a
+// worker pool according to the device's DeviceOptions.
+func (vbd *VirBlkDev) beginPoll() {
+	if vbd.scsi.Options.Workers > 1 {
+		vbd.allocCmdRing()
+		go vbd.startPollx()
+		return
+	}
+	go vbd.startPoll()
+}
+
+// allocCmdRing sizes the pool's queue from the mailbox: the kernel can't have more commands outstanding than
+// fit in its command ring, each in an entry of at least cmdEntrySize bytes.
+func (vbd *VirBlkDev) allocCmdRing() {
+	depth := vbd.scsi.Options.queueDepth(int(vbd.mbCmdrSize() / cmdEntrySize))
+	vbd.cmdRing = &ScsiResponseRing{
+		capacity: depth,
+		head:     0,
+		tail:     0,
+		data:     make([]*ScsiResponse, depth),
+	}
+	vbd.cmdDone = make(chan indexedResponse, depth)
+}
 
-		if !strings.HasPrefix(i.Name(), "uio") {
-			return nil
+func (vbd *VirBlkDev) findDevice() error {
+	infos, err := vbd.roots.FS.ReadDir(vbd.roots.DevFS)
+	if err != nil {
+		return err
+	}
+	for _, i := range infos {
+		if i.IsDir() || !strings.HasPrefix(i.Name(), "uio") {
+			continue
 		}
-		sysfile := fmt.Sprintf("/sys/class/uio/%s/name", i.Name())
-		content, err := ioutil.ReadFile(sysfile)
+		sysfile := vbd.roots.sys("class", "uio", i.Name(), "name")
+		content, err := vbd.roots.FS.ReadFile(sysfile)
 		if err != nil {
 			return err
 		}
 		split := strings.SplitN(strings.TrimRight(string(content), "\n"), "/", 4)
-		if split[0] != "tcm-user" {
+		if len(split) != 4 || split[0] != "tcm-user" {
 			// Not a TCM device
-			return nil
+			continue
 		}
 		if split[3] != vbd.GetDevConfig() {
 			// Not a TCM device
-			return nil
-		}
-		err = vbd.openDevice(split[1], split[2], i.Name())
-		if err != nil {
-			return err
+			continue
 		}
-		return filepath.SkipDir
-	})
-	if err == filepath.SkipDir {
-		return nil
+		return vbd.openDevice(split[1], split[2], i.Name())
 	}
-	return err
+	return nil
 }
 
 func (vbd *VirBlkDev) openDevice(user string, vol string, uio string) error {
 	var err error
 	vbd.deviceName = vol
 
-	vbd.uioFd, err = syscall.Open(fmt.Sprintf("/dev/%s", uio), syscall.O_RDWR | syscall.O_NONBLOCK | syscall.O_CLOEXEC, 0600)
+	size, err := vbd.roots.FS.ReadFile(vbd.roots.sys("class", "uio", uio, "maps", "map0", "size"))
 	if err != nil {
 		return err
 	}
-	size, err := ioutil.ReadFile(fmt.Sprintf("/sys/class/uio/%s/maps/map0/size", uio))
+
+	vbd.mapsize, err = strconv.ParseUint(strings.TrimRight(string(size), "\n"), 0, 64)
 	if err != nil {
 		return err
 	}
 
-	vbd.mapsize, err = strconv.ParseUint(strings.TrimRight(string(size), "\n"), 0, 64)
+	vbd.uioFd, vbd.mmap, err = vbd.roots.FS.OpenUio(vbd.roots.dev(uio), int(vbd.mapsize))
 	if err != nil {
+		vbd.uioFd = -1
 		return err
 	}
-
-	vbd.mmap, err = syscall.Mmap(vbd.uioFd, 0, int(vbd.mapsize), syscall.PROT_READ | syscall.PROT_WRITE, syscall.MAP_SHARED)
 	vbd.cmdTail = vbd.mbCmdTail()
 	//vbd.debugPrintMb()
 
@@ -345,10 +524,10 @@ func (vbd *VirBlkDev) openDevice(user string, vol string, uio string) error {
 }
 
 func (vbd *VirBlkDev) closeDevice() {
-	syscall.Munmap(vbd.mmap)
-
 	if vbd.uioFd != -1 {
-		unix.Close(vbd.uioFd)
+		vbd.roots.FS.CloseUio(vbd.uioFd, vbd.mmap)
+		vbd.uioFd = -1
+		vbd.mmap = nil
 	}
 
 	//if vbd.cmdChan != nil {
@@ -392,15 +571,15 @@ func (vbd *VirBlkDev) teardown() error {
 	}
 
 	for _, p := range pathsToRemove {
-		err := remove(p)
+		err := remove(vbd.roots.FS, p)
 		if err != nil {
 			return err
 		}
 	}
 
 	// Should be cleaned up automatically, but if it isn't remove it
-	if _, err := os.Stat(vbd.devPath); err == nil {
-		err := remove(vbd.devPath)
+	if _, err := vbd.roots.FS.Stat(vbd.devPath); err == nil {
+		err := remove(vbd.roots.FS, vbd.devPath)
 		if err != nil {
 			return err
 		}
@@ -409,19 +588,20 @@ func (vbd *VirBlkDev) teardown() error {
 	return nil
 }
 
-func removeAsync(path string, done chan <- error) {
+func removeAsync(fs FileSystem, path string, done chan <- error) {
 	//log.Debugf("Removing: %s", path)
-	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+	if err := fs.Remove(path); err != nil && !os.IsNotExist(err) {
 		log.Debugf("Unable to remove: %v", path)
 		done <- err
+		return
 	}
 	//log.Debugf("Removed: %s", path)
 	done <- nil
 }
 
-func remove(path string) error {
-	done := make(chan error)
-	go removeAsync(path, done)
+func remove(fs FileSystem, path string) error {
+	done := make(chan error, 1)
+	go removeAsync(fs, path, done)
 	select {
 	case err := <-done:
 		return err
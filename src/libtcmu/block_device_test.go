@@ -0,0 +1,128 @@
+package tcmu
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"libtcmu/scsi"
+)
+
+// resizeRW is a memRW that's a Resizer, recording every size it's asked for.
+type resizeRW struct {
+	memRW
+	sizes []int64
+}
+
+func (r *resizeRW) Resize(size int64) error {
+	r.Lock()
+	defer r.Unlock()
+	r.sizes = append(r.sizes, size)
+	b := make([]byte, size)
+	copy(b, r.b)
+	r.b = b
+	return nil
+}
+
+func readCapacity(t *testing.T, r *FakeRing) uint32 {
+	t.Helper()
+	rc := []byte{scsi.ReadCapacity, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	fc, err := r.Do(rc, nil, 8)
+	if err == nil && fc.Status == scsi.SamStatCheckCondition && fc.Sense[12] == 0x2a && fc.Sense[13] == 0x09 {
+		// CAPACITY DATA HAS CHANGED, once.
+		fc, err = r.Do(rc, nil, 8)
+	}
+	if err != nil || fc.Status != scsi.SamStatGood {
+		t.Fatalf("READ CAPACITY: %v, status 0x%02x", err, fc.Status)
+	}
+	return binary.BigEndian.Uint32(fc.Data)
+}
+
+func TestResizeFile(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "vol"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(1 << 20); err != nil {
+		t.Fatal(err)
+	}
+	r := newTestRing(t, "t", ReadWriteAtCmdHandler{RW: f}, 1<<20, DeviceOptions{}, FakeRingConfig{})
+	defer r.Close()
+	vbd := r.Device()
+
+	if err := vbd.Resize(1000); err == nil {
+		t.Fatal("resized to part of a sector")
+	}
+	if err := vbd.Resize(2 << 20); err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := f.Stat(); fi.Size() != 2<<20 {
+		t.Fatalf("file is %d bytes after growing, want %d", fi.Size(), 2<<20)
+	}
+	if last := readCapacity(t, r); last != 4095 {
+		t.Fatalf("last LBA %d after growing, want 4095", last)
+	}
+	if fc, err := r.Do(rw10(scsi.Read10, 4000, 1), nil, 512); err != nil || fc.Status != scsi.SamStatGood {
+		t.Fatalf("read past the old end: %v, status 0x%02x", err, fc.Status)
+	}
+
+	// Shrinking leaves the file alone, but what's past the new end can't be reached.
+	if err := vbd.Resize(512 << 10); err != nil {
+		t.Fatal(err)
+	}
+	if last := readCapacity(t, r); last != 1023 {
+		t.Fatalf("last LBA %d after shrinking, want 1023", last)
+	}
+	if fc, err := r.Do(rw10(scsi.Read10, 4000, 1), nil, 512); err != nil || fc.Status != scsi.SamStatCheckCondition ||
+		fc.Sense[12] != 0x21 {
+		t.Fatalf("read past the new end: %v, status 0x%02x", err, fc.Status)
+	}
+	if fi, _ := f.Stat(); fi.Size() != 2<<20 {
+		t.Fatalf("file is %d bytes after shrinking, want %d", fi.Size(), 2<<20)
+	}
+}
+
+func TestResizeNeedsResizer(t *testing.T) {
+	r := newTestRing(t, "t", memHandler(1<<20), 1<<20, DeviceOptions{}, FakeRingConfig{})
+	defer r.Close()
+	for _, size := range []int64{2 << 20, 512 << 10} {
+		if err := r.Device().Resize(size); err != errResizeNotSupported {
+			t.Fatalf("resizing to %d without a Resizer: %v", size, err)
+		}
+	}
+	if got := r.Device().Capacity(); got != 1<<20 {
+		t.Fatalf("capacity %d, want it unchanged", got)
+	}
+}
+
+func TestResizeRollsBack(t *testing.T) {
+	m := &resizeRW{memRW: memRW{b: make([]byte, 1<<20)}}
+	r := newTestRing(t, "t", ReadWriteAtCmdHandler{RW: m}, 1<<20, DeviceOptions{}, FakeRingConfig{})
+	defer r.Close()
+
+	// As if the device were enabled, with configfs refusing the new size.
+	vbd := r.Device()
+	vbd.enabled = true
+	vbd.hbaDir = t.TempDir()
+	vbd.roots.FS = FaultFileSystem{FileSystem: OSFileSystem{}, Fault: func(op string, name string) error {
+		if op == "WriteFile" && filepath.Base(name) == "control" {
+			return syscall.EINVAL
+		}
+		return nil
+	}}
+	if err := vbd.Resize(2 << 20); err == nil {
+		t.Fatal("resized with configfs refusing the size")
+	}
+	if len(m.sizes) != 2 || m.sizes[0] != 2<<20 || m.sizes[1] != 1<<20 {
+		t.Fatalf("backend resized to %v, want grown and then back to %d", m.sizes, 1<<20)
+	}
+	if got := vbd.Capacity(); got != 1<<20 {
+		t.Fatalf("capacity %d, want it unchanged", got)
+	}
+	if last := readCapacity(t, r); last != 2047 {
+		t.Fatalf("last LBA %d, want it unchanged", last)
+	}
+}
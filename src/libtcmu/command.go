@@ -3,7 +3,9 @@ package tcmu
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/hex"
 	"io"
+	"strings"
 
 	"libtcmu/scsi"
 	//"crypto/md5"
@@ -48,14 +50,80 @@ func (h ReadWriteAtCmdHandler) HandleCommand(cmd *ScsiCmd) (ScsiResponse, error)
 		return EmulateInquiry(cmd, h.Inq)
 	case scsi.TestUnitReady:
 		return EmulateTestUnitReady(cmd)
+	case scsi.ReadCapacity:
+		return EmulateReadCapacity10(cmd)
+	case scsi.RequestSense:
+		return EmulateRequestSense(cmd)
+	case scsi.ReportLuns:
+		return EmulateReportLuns(cmd)
+	case scsi.StartStop:
+		return EmulateStartStopUnit(cmd)
 	case scsi.ServiceActionIn16:
 		return EmulateServiceActionIn(cmd)
 	case scsi.ModeSense, scsi.ModeSense10:
-		return EmulateModeSense(cmd, false)
+		return EmulateDeviceModeSense(cmd)
 	case scsi.ModeSelect, scsi.ModeSelect10:
-		return EmulateModeSelect(cmd, false)
+		return EmulateDeviceModeSelect(cmd)
+	case scsi.SynchronizeCache, scsi.SynchronizeCache16:
+		return EmulateSyncCache(cmd, h.RW)
+	case scsi.Unmap:
+		if u, ok := unmapperFor(h.RW); ok && cmd.VirBlkDev().Unmaps() {
+			return EmulateUnmap(cmd, u)
+		}
+		return cmd.PassToKernel(), nil
+	case scsi.WriteSame, scsi.WriteSame16:
+		return EmulateWriteSame(cmd, h.RW)
+	case scsi.CompareAndWrite:
+		return EmulateCompareAndWrite(cmd, h.RW)
+	case scsi.Verify, scsi.Verify12, scsi.Verify16:
+		return EmulateVerify(cmd, h.RW)
+	case scsi.WriteVerify, scsi.WriteVerify12, scsi.WriteVerify16:
+		return EmulateWriteVerify(cmd, h.RW)
+	case scsi.VariableLengthCmd:
+		return h.handleVariableLength(cmd)
+	case scsi.PersistentReserveIn:
+		return EmulatePersistentReserveIn(cmd)
+	case scsi.PersistentReserveOut:
+		return EmulatePersistentReserveOut(cmd)
+	case scsi.Reserve, scsi.Reserve10:
+		return EmulateReserve(cmd)
+	case scsi.Release, scsi.Release10:
+		return EmulateRelease(cmd)
+	case scsi.MaintenanceIn:
+		if cmd.GetCDB(1)&0x1f == scsi.MiReportTargetPgs {
+			return EmulateReportTargetPortGroups(cmd)
+		}
+		return cmd.PassToKernel(), nil
+	case scsi.MaintenanceOut:
+		if cmd.GetCDB(1)&0x1f == scsi.MoSetTargetPgs {
+			return EmulateSetTargetPortGroups(cmd)
+		}
+		return cmd.PassToKernel(), nil
 	default:
-		return cmd.NotHandled(), nil
+		return cmd.PassToKernel(), nil
+	}
+}
+
+// handleVariableLength routes the 32 byte forms of the block commands to the same emulation as the shorter
+// ones, by service action.
+func (h ReadWriteAtCmdHandler) handleVariableLength(cmd *ScsiCmd) (ScsiResponse, error) {
+	c, err := cmd.CDB()
+	if err != nil {
+		return cmd.IllegalRequest(), nil
+	}
+	switch c.ServiceAction {
+	case scsi.Read32:
+		return EmulateRead(cmd, h.RW)
+	case scsi.Write32:
+		return EmulateWrite(cmd, h.RW)
+	case scsi.Verify32:
+		return EmulateVerify(cmd, h.RW)
+	case scsi.WriteVerify32:
+		return EmulateWriteVerify(cmd, h.RW)
+	case scsi.WriteSame32:
+		return EmulateWriteSame(cmd, h.RW)
+	default:
+		return cmd.PassToKernel(), nil
 	}
 }
 
@@ -83,6 +151,7 @@ func EmulateStdInquiry(cmd *ScsiCmd, inq *InquiryInfo) (ScsiResponse, error) {
 	buf := make([]byte, 36)
 	buf[2] = 0x05 // SPC-3
 	buf[3] = 0x02 // response data format
+	buf[5] = cmd.VirBlkDev().alua.tpgs() << 4
 	buf[7] = 0x02 // CmdQue
 
 	vendorID := FixedString(inq.VendorID, 8)
@@ -93,12 +162,7 @@ func EmulateStdInquiry(cmd *ScsiCmd, inq *InquiryInfo) (ScsiResponse, error) {
 	copy(buf[32:36], productRev)
 
 	buf[4] = 31 // Set additional length to 31
-	_, err := cmd.Write(buf)
-	if err != nil {
-		return ScsiResponse{}, err
-	}
-
-	return cmd.Ok(), nil
+	return cmd.WriteData(buf), nil
 }
 
 func EmulateEvpdInquiry(cmd *ScsiCmd, inq *InquiryInfo) (ScsiResponse, error) {
@@ -106,66 +170,68 @@ func EmulateEvpdInquiry(cmd *ScsiCmd, inq *InquiryInfo) (ScsiResponse, error) {
 
 	switch vpdType {
 	case 0x0: // Supported VPD pages
-		// The absolute minimum.
-		data := make([]byte, 6)
+		pages := []byte{0x00, 0x80, 0x83, 0xb0, 0xb1, 0xb2}
+		data := make([]byte, 4+len(pages))
+		data[3] = byte(len(pages))
+		copy(data[4:], pages)
 
-		// support 0x00 and 0x83 only
-		data[3] = 2
-		data[4] = 0x00
-		data[5] = 0x83
+		return cmd.WriteData(data), nil
+	case 0x80: // Unit serial number
+		serial := cmd.VirBlkDev().Serial()
+		data := make([]byte, 4+len(serial))
+		data[1] = 0x80
+		data[3] = byte(len(serial))
+		copy(data[4:], serial)
 
-		cmd.Write(data)
-		return cmd.Ok(), nil
+		return cmd.WriteData(data), nil
 	case 0x83: // Device identification
 		used := 4
 		data := make([]byte, 512)
 		data[1] = 0x83
-		wwn := []byte("") // TODO(barakmich): Report WWN. See tcmu_get_wwwn;
+		naa := naaDesignator(cmd.VirBlkDev().deviceID())
 
-		// 1/3: T10 Vendor id
+		// 1/5: T10 Vendor id
 		ptr := data[used:]
 		ptr[0] = 2 // code set: ASCII
 		ptr[1] = 1 // identifier: T10 vendor id
 		copy(ptr[4:], FixedString(inq.VendorID, 8))
-		n := copy(ptr[12:], wwn)
+		n := copy(ptr[12:], cmd.VirBlkDev().Serial())
 		ptr[3] = byte(8 + n + 1)
 		used += int(ptr[3]) + 4
 
-		// 2/3: NAA binary  // TODO(barakmich): Emulate given a real WWN
+		// 2/5: NAA binary
 		ptr = data[used:]
-		ptr[0] = 1  // code set: binary
-		ptr[1] = 3  // identifier: NAA
-		ptr[3] = 16 // body length for naa registered extended format
-
-		// Set type 6 and use OpenFabrics IEEE Company ID: 00 14 05
-		ptr[4] = 0x60
-		ptr[5] = 0x01
-		ptr[6] = 0x40
-		ptr[7] = 0x50
-		next := true
-		i := 7
-
-		for _, x := range wwn {
-			if i >= 20 {
-				break
-			}
-			v, ok := charToHex(x)
-			if !ok {
-				continue
-			}
+		ptr[0] = 1 // code set: binary
+		ptr[1] = 3 // identifier: NAA
+		ptr[3] = byte(copy(ptr[4:], naa))
+		used += int(ptr[3]) + 4
 
-			if next {
-				next = false
-				ptr[i] |= v
-				i++
-			} else {
-				next = true
-				ptr[i] = (v << 4)
-			}
+		// 3/5: Target port name. The loopback target is named for the device's WWN too.
+		ptr = data[used:]
+		ptr[0] = 0x61 // protocol: SAS, as tcm_loop reports; code set: binary
+		ptr[1] = 0x93 // PIV, association: target port, identifier: NAA
+		ptr[3] = byte(copy(ptr[4:], naa))
+		used += int(ptr[3]) + 4
+
+		// 4/5: Relative target port identifier. The loopback target has the one port, 1 unless ALUA numbers it.
+		ptr = data[used:]
+		ptr[0] = 0x61 // protocol: SAS; code set: binary
+		ptr[1] = 0x94 // PIV, association: target port, identifier: relative target port
+		ptr[3] = 4
+		binary.BigEndian.PutUint16(ptr[6:8], cmd.VirBlkDev().relativePort())
+		used += 8
+
+		// Target port group, for a device with ALUA.
+		if a := cmd.VirBlkDev().alua; a != nil {
+			ptr = data[used:]
+			ptr[0] = 0x61 // protocol: SAS; code set: binary
+			ptr[1] = 0x95 // PIV, association: target port, identifier: target port group
+			ptr[3] = 4
+			binary.BigEndian.PutUint16(ptr[6:8], a.groups[a.local].ID)
+			used += 8
 		}
-		used += 20
 
-		// 3/3: Vendor specific
+		// 5/5: Vendor specific
 		ptr = data[used:]
 		ptr[0] = 2 // code set: ASCII
 		ptr[1] = 0 // identifier: vendor-specific
@@ -179,37 +245,139 @@ func EmulateEvpdInquiry(cmd *ScsiCmd, inq *InquiryInfo) (ScsiResponse, error) {
 		order := binary.BigEndian
 		order.PutUint16(data[2:4], uint16(used-4))
 
-		cmd.Write(data[:used])
-		return cmd.Ok(), nil
-	case 0xb0:  // Block Limits
+		return cmd.WriteData(data[:used]), nil
+	case 0xb0: // Block Limits
 		data := make([]byte, 64)
 		data[1] = 0xb0
 
 		order := binary.BigEndian
 		order.PutUint16(data[2:4], uint16(0x3c))
 
-		blockSize, err := cmd.VirBlkDev().GetDeviceAttr("hw_block_size")
-		if err != nil {
-			return cmd.IllegalRequest(), nil
+		limits := cmd.VirBlkDev().BlockLimits()
+		data[4] = 0x01 // WSNZ: WRITE SAME needs a number of blocks
+		data[5] = limits.MaxCompareAndWriteLength
+		order.PutUint16(data[6:8], limits.OptimalTransferLengthGranularity)
+		order.PutUint32(data[8:12], limits.MaxTransferLength)
+		order.PutUint32(data[12:16], limits.OptimalTransferLength)
+		if cmd.VirBlkDev().Unmaps() {
+			order.PutUint32(data[20:24], limits.MaxUnmapLBACount)
+			order.PutUint32(data[24:28], limits.MaxUnmapDescriptors)
+			if limits.OptimalUnmapGranularity != 0 {
+				order.PutUint32(data[28:32], limits.OptimalUnmapGranularity)
+				order.PutUint32(data[32:36], limits.UnmapGranularityAlignment&0x7fffffff)
+				data[32] |= 0x80 // UGAVALID
+			}
 		}
+		order.PutUint64(data[36:44], limits.MaxWriteSameLength)
+		return cmd.WriteData(data), nil
+	case 0xb1: // Block Device Characteristics
+		data := make([]byte, 64)
+		data[1] = 0xb1
 
-		maxSectors, err := cmd.VirBlkDev().GetDeviceAttr("hw_max_sectors")
-		if err != nil {
-			return cmd.IllegalRequest(), nil
+		order := binary.BigEndian
+		order.PutUint16(data[2:4], uint16(0x3c))
+		order.PutUint16(data[4:6], cmd.VirBlkDev().scsi.Options.RotationRate)
+		return cmd.WriteData(data), nil
+	case 0xb2: // Logical Block Provisioning
+		data := make([]byte, 8)
+		data[1] = 0xb2
+		data[3] = 0x04
+		if cmd.VirBlkDev().Unmaps() {
+			data[5] = 0x80 | 0x40 | 0x20 // LBPU, LBPWS, LBPWS10: UNMAP, and WRITE SAME with the UNMAP bit
 		}
-
-		masXferLength := maxSectors / (blockSize / 512)
-		order = binary.BigEndian
-		order.PutUint32(data[8:12], uint32(masXferLength))
-		order.PutUint32(data[12:16], uint32(masXferLength))
-		cmd.Write(data[:64])
-		return cmd.Ok(), nil
+		switch cmd.VirBlkDev().provisioning {
+		case ProvisioningResource:
+			data[6] = 0x01
+		case ProvisioningThin:
+			data[6] = 0x02
+		}
+		return cmd.WriteData(data), nil
 	default:
 		return cmd.IllegalRequest(), nil
 	}
 }
 
 func EmulateTestUnitReady(cmd *ScsiCmd) (ScsiResponse, error) {
+	if resp, ok := checkReady(cmd); !ok {
+		return resp, nil
+	}
+	return cmd.Ok(), nil
+}
+
+// checkReady fails a command with NOT READY if the device has been stopped by START STOP UNIT.
+func checkReady(cmd *ScsiCmd) (ScsiResponse, bool) {
+	if cmd.VirBlkDev().Stopped() {
+		return cmd.CheckCondition(scsi.SenseNotReady, scsi.AscLunNotReadyInitCmdRequired), false
+	}
+	return ScsiResponse{}, true
+}
+
+func EmulateReadCapacity10(cmd *ScsiCmd) (ScsiResponse, error) {
+	buf := make([]byte, 8)
+	order := binary.BigEndian
+	lastLBA := uint64(cmd.VirBlkDev().Sizes().VolumeSize/cmd.VirBlkDev().Sizes().SectorSize) - 1
+	if lastLBA > 0xffffffff {
+		// Too big to say here: the initiator has to use READ CAPACITY(16).
+		lastLBA = 0xffffffff
+	}
+	order.PutUint32(buf[0:4], uint32(lastLBA))
+	order.PutUint32(buf[4:8], uint32(cmd.VirBlkDev().Sizes().SectorSize))
+	return cmd.WriteData(buf), nil
+}
+
+// EmulateRequestSense reports the sense for the device's current state: the oldest unit attention pending for
+// the nexus, which is then cleared, or NOT READY if it's stopped, otherwise NO SENSE. Sense from failed
+// commands was already returned with them, as autosense.
+func EmulateRequestSense(cmd *ScsiCmd) (ScsiResponse, error) {
+	sense := scsi.Sense{Key: scsi.SenseNoSense, Asc: scsi.AscNoAdditionalSenseInformation}
+	if asc, ok := cmd.VirBlkDev().unitAttentions.next(); ok {
+		// Reporting a unit attention here clears it.
+		sense = scsi.Sense{Key: scsi.SenseUnitAttention, Asc: asc}
+	} else if cmd.VirBlkDev().Stopped() {
+		sense = scsi.Sense{Key: scsi.SenseNotReady, Asc: scsi.AscLunNotReadyInitCmdRequired}
+	}
+
+	// DESC asks for descriptor format, whatever D_SENSE says.
+	buf := sense.Bytes(cmd.GetCDB(1)&0x01 != 0)
+	if n := int(cmd.GetCDB(4)); n < len(buf) {
+		buf = buf[:n]
+	}
+	return cmd.WriteData(buf), nil
+}
+
+// EmulateReportLuns reports the one LUN, 0, that a TCMU device has.
+func EmulateReportLuns(cmd *ScsiCmd) (ScsiResponse, error) {
+	switch cmd.GetCDB(2) {
+	case 0x00, 0x02: // all LUNs, or all of them that are accessible
+	case 0x01: // well known LUNs only, and we have none
+		buf := make([]byte, 8)
+		return cmd.WriteData(buf), nil
+	default:
+		return cmd.IllegalRequest(), nil
+	}
+	if cmd.XferLen() < 16 {
+		return cmd.IllegalRequest(), nil
+	}
+	// LUN list length, then LUN 0.
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint32(buf[0:4], 8)
+	return cmd.WriteData(buf), nil
+}
+
+// EmulateStartStopUnit starts or stops the device. While it's stopped, media access and TEST UNIT READY
+// return NOT READY. There's no medium to eject, so LOEJ is accepted and ignored.
+func EmulateStartStopUnit(cmd *ScsiCmd) (ScsiResponse, error) {
+	b := cmd.GetCDB(4)
+	start := b&0x01 != 0
+	switch b >> 4 { // POWER CONDITION
+	case 0x0: // START_VALID: START decides
+		cmd.VirBlkDev().setStopped(!start)
+	case 0x1: // ACTIVE
+		cmd.VirBlkDev().setStopped(false)
+	case 0x2, 0x3, 0x5, 0x7, 0xa, 0xb: // IDLE, STANDBY and the rest of them have nothing to do here
+	default:
+		return cmd.IllegalRequest(), nil
+	}
 	return cmd.Ok(), nil
 }
 
@@ -217,7 +385,7 @@ func EmulateServiceActionIn(cmd *ScsiCmd) (ScsiResponse, error) {
 	if cmd.GetCDB(1) == scsi.ReadCapacity16 {
 		return EmulateReadCapacity16(cmd)
 	}
-	return cmd.NotHandled(), nil
+	return cmd.PassToKernel(), nil
 }
 
 func EmulateReadCapacity16(cmd *ScsiCmd) (ScsiResponse, error) {
@@ -227,9 +395,51 @@ func EmulateReadCapacity16(cmd *ScsiCmd) (ScsiResponse, error) {
 	order.PutUint64(buf[0:8], uint64(cmd.VirBlkDev().Sizes().VolumeSize/cmd.VirBlkDev().Sizes().SectorSize)-1)
 	// This is in BlockSize
 	order.PutUint32(buf[8:12], uint32(cmd.VirBlkDev().Sizes().SectorSize))
+	if cmd.VirBlkDev().provisioning != ProvisioningFull {
+		buf[14] = 0x80 // LBPME
+	}
 	// All the rest is 0
-	cmd.Write(buf)
-	return cmd.Ok(), nil
+	return cmd.WriteData(buf), nil
+}
+
+// naaDesignator packs the hex digits of a WWN such as "naa.5001405abcdef012" into its binary NAA designator,
+// 8 bytes for NAA 5 or 16 for NAA 6. A WWN that isn't in that form, perhaps from some other WWN
+// implementation, is fitted into an NAA 6 designator under the OpenFabrics IEEE Company ID instead.
+func naaDesignator(wwn string) []byte {
+	digits := strings.TrimPrefix(strings.ToLower(wwn), "naa.")
+	if len(digits) == 16 || len(digits) == 32 {
+		if b, err := hex.DecodeString(digits); err == nil && (b[0]>>4 == 5 || b[0]>>4 == 6) {
+			return b
+		}
+	}
+
+	// Set type 6 and use OpenFabrics IEEE Company ID: 00 14 05
+	ptr := make([]byte, 16)
+	ptr[0] = 0x60
+	ptr[1] = 0x01
+	ptr[2] = 0x40
+	ptr[3] = 0x50
+	next := true
+	i := 3
+	for _, x := range []byte(digits) {
+		if i >= 16 {
+			break
+		}
+		v, ok := charToHex(x)
+		if !ok {
+			continue
+		}
+
+		if next {
+			next = false
+			ptr[i] |= v
+			i++
+		} else {
+			next = true
+			ptr[i] = (v << 4)
+		}
+	}
+	return ptr
 }
 
 func charToHex(c byte) (byte, bool) {
@@ -245,111 +455,201 @@ func charToHex(c byte) (byte, bool) {
 	return 0x00, false
 }
 
+// CachingModePage writes the default Caching mode page, with WCE set if wce is.
 func CachingModePage(w io.Writer, wce bool) {
-	buf := make([]byte, 20)
-	buf[0] = 0x08 // caching mode page
-	buf[1] = 0x12 // page length (20, forced)
-	//buf[2] = buf[2] | 0x01  //set RCD
-	if wce {
-		buf[2] = buf[2] | 0x04  //set WCE
-	}
-	w.Write(buf)
+	w.Write(cachingModePage(wce).def)
 }
 
-// EmulateModeSense responds to a static Mode Sense command. `wce` enables or diables
-// the SCSI "Write Cache Enabled" flag.
+// EmulateModeSense is EmulateDeviceModeSense, for handlers written before devices kept their own mode pages.
+// The Caching mode page reports WCE as wce, and MODE SELECT can't change it: the handler owns its write cache.
 func EmulateModeSense(cmd *ScsiCmd, wce bool) (ScsiResponse, error) {
-	pgs := &bytes.Buffer{}
+	cmd.VirBlkDev().modePages.seedWCE(wce)
+	return EmulateDeviceModeSense(cmd)
+}
+
+// EmulateModeSelect is EmulateDeviceModeSelect, for handlers written before devices kept their own mode pages.
+// wce should match the one given EmulateModeSense; a Caching mode page with any other WCE is refused.
+func EmulateModeSelect(cmd *ScsiCmd, wce bool) (ScsiResponse, error) {
+	cmd.VirBlkDev().modePages.seedWCE(wce)
+	return EmulateDeviceModeSelect(cmd)
+}
+
+// EmulateDeviceModeSense reports the device's mode pages, with the page control field choosing between the
+// current, changeable, default and saved values. A block descriptor comes first unless DBD is set; MODE
+// SENSE(10) with LLBAA set gets the long form.
+func EmulateDeviceModeSense(cmd *ScsiCmd) (ScsiResponse, error) {
 	outlen := int(cmd.XferLen())
+	dbd := cmd.GetCDB(1)&0x08 != 0
+	llbaa := cmd.GetCDB(1)&0x10 != 0
+	pc := cmd.GetCDB(2) >> 6
+	page := cmd.GetCDB(2) & 0x3f
+	subpage := cmd.GetCDB(3)
+	scsiCmd := cmd.Command()
 
-	page := cmd.GetCDB(2)
-	if page == 0x3f || page == 0x08 {
-		CachingModePage(pgs, wce)
+	pgdata, err := cmd.VirBlkDev().modePages.sense(pc, page, subpage)
+	if err == errModeSaveNotSupported {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscSavingParametersNotSupported), nil
+	}
+	if err != nil {
+		return cmd.InvalidFieldInCDB(2, 5), nil
+	}
+
+	var bd []byte
+	if !dbd {
+		bd = modeBlockDescriptor(cmd.VirBlkDev().Sizes(), llbaa && scsiCmd == scsi.ModeSense10)
 	}
-	scsiCmd := cmd.Command()
 
 	dsp := byte(0x10) // Support DPO/FUA
 
-	pgdata := pgs.Bytes()
 	var hdr []byte
 	if scsiCmd == scsi.ModeSense {
 		// MODE_SENSE_6
 		hdr = make([]byte, 4)
-		hdr[0] = byte(len(pgdata) + 3)
+		hdr[0] = byte(len(bd) + len(pgdata) + 3)
 		hdr[1] = 0x00 // Device type
 		hdr[2] = dsp
+		hdr[3] = byte(len(bd))
 	} else {
 		// MODE_SENSE_10
 		hdr = make([]byte, 8)
 		order := binary.BigEndian
-		order.PutUint16(hdr, uint16(len(pgdata)+6))
+		order.PutUint16(hdr, uint16(len(bd)+len(pgdata)+6))
 		hdr[2] = 0x00 // Device type
 		hdr[3] = dsp
+		if len(bd) == 16 {
+			hdr[4] = 0x01 // LONGLBA
+		}
+		order.PutUint16(hdr[6:8], uint16(len(bd)))
 	}
-	data := append(hdr, pgdata...)
+	data := append(append(hdr, bd...), pgdata...)
 	if outlen < len(data) {
 		data = data[:outlen]
 	}
-	cmd.Write(data)
-	return cmd.Ok(), nil
+	return cmd.WriteData(data), nil
 }
 
-// EmulateModeSelect checks that the only mode selected is the static one returned from
-// EmulateModeSense. `wce` should match the Write Cache Enabled of the EmulateModeSense call.
-func EmulateModeSelect(cmd *ScsiCmd, wce bool) (ScsiResponse, error) {
+// modeBlockDescriptor is the block descriptor for the whole device, in the long LBA form if long is set.
+func modeBlockDescriptor(sizes DataSizes, long bool) []byte {
+	order := binary.BigEndian
+	blocks := uint64(sizes.VolumeSize / sizes.SectorSize)
+	if long {
+		bd := make([]byte, 16)
+		order.PutUint64(bd[0:8], blocks)
+		order.PutUint32(bd[12:16], uint32(sizes.SectorSize))
+		return bd
+	}
+	bd := make([]byte, 8)
+	if blocks > 0xffffffff {
+		blocks = 0xffffffff
+	}
+	order.PutUint32(bd[0:4], uint32(blocks))
+	order.PutUint32(bd[4:8], uint32(sizes.SectorSize)&0xffffff)
+	return bd
+}
+
+// EmulateDeviceModeSelect sets the changeable fields of the mode pages sent, and saves them too if SP is set. A
+// page that changes anything else, or that the device doesn't have, is refused, and then none of them are set.
+// If any current value changed, MODE PARAMETERS CHANGED is established as a unit attention.
+func EmulateDeviceModeSelect(cmd *ScsiCmd) (ScsiResponse, error) {
 	selectTen := (cmd.GetCDB(0) == scsi.ModeSelect10)
-	page := cmd.GetCDB(2) & 0x3f
-	subpage := cmd.GetCDB(3)
-	allocLen := cmd.XferLen()
+	allocLen := int(cmd.XferLen())
 	hdrLen := 4
 	if selectTen {
 		hdrLen = 8
 	}
-	inBuf := make([]byte, 512)
-	gotSense := false
 
 	if allocLen == 0 {
 		return cmd.Ok(), nil
 	}
+	cdbone := cmd.GetCDB(1)
+	if cdbone&0x10 == 0 {
+		// Only the page format is supported.
+		return cmd.InvalidFieldInCDB(1, 4), nil
+	}
+	save := cdbone&0x01 != 0
+
+	if allocLen > cmd.BufferLen() {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscParameterListLengthError), nil
+	}
+	inBuf := make([]byte, allocLen)
 	n, err := cmd.Read(inBuf)
-	if err != nil {
+	if err != nil && err != io.EOF {
 		return ScsiResponse{}, err
 	}
-	if n >= len(inBuf) {
+	if n < allocLen || allocLen < hdrLen {
 		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscParameterListLengthError), nil
 	}
 
-	cdbone := cmd.GetCDB(1)
-	if cdbone&0x10 == 0 || cdbone&0x01 != 0 {
-		return cmd.IllegalRequest(), nil
+	order := binary.BigEndian
+	bdLen := int(inBuf[3])
+	if selectTen {
+		bdLen = int(order.Uint16(inBuf[6:8]))
 	}
-
-	pgs := &bytes.Buffer{}
-	// TODO(barakmich): select over handlers. Today we have one.
-	if page == 0x08 && subpage == 0 {
-		CachingModePage(pgs, wce)
-		gotSense = true
+	if hdrLen+bdLen > allocLen {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscParameterListLengthError), nil
 	}
-	if !gotSense {
-		return cmd.IllegalRequest(), nil
+	// The block size can't be changed, but a descriptor repeating it is fine.
+	sectorSize := uint64(cmd.VirBlkDev().Sizes().SectorSize)
+	bds := inBuf[hdrLen : hdrLen+bdLen]
+	descLen := 8
+	if selectTen && inBuf[4]&0x01 != 0 {
+		descLen = 16
 	}
-	b := pgs.Bytes()
-	if int(allocLen) < (hdrLen + len(b)) {
-		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscParameterListLengthError), nil
+	if len(bds)%descLen != 0 {
+		return cmd.InvalidFieldInParameterList(hdrLen-1, -1), nil
 	}
-	/* Verify what was selected is identical to what sense returns, since we
-	don't support actually setting anything. */
-	if !bytes.Equal(inBuf[hdrLen:len(b)], b) {
-		//log.Errorf("not equal for some reason: %#v %#v", inBuf[hdrLen:len(b)], b)
-		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInParameterList), nil
+	for off := hdrLen; len(bds) > 0; bds, off = bds[descLen:], off+descLen {
+		var bs uint64
+		if descLen == 16 {
+			bs = uint64(order.Uint32(bds[12:16]))
+		} else {
+			bs = uint64(order.Uint32(bds[4:8]) & 0xffffff)
+		}
+		if bs != sectorSize {
+			return cmd.InvalidFieldInParameterList(off+descLen-3, -1), nil
+		}
+	}
+
+	changed, field, err := cmd.VirBlkDev().modePages.sel(inBuf[hdrLen+bdLen:], save)
+	if changed {
+		cmd.VirBlkDev().EstablishUnitAttention(scsi.AscModeParametersChanged)
+	}
+	switch err {
+	case nil:
+	case errModeSaveNotSupported:
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscSavingParametersNotSupported), nil
+	case errModePageLength:
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscParameterListLengthError), nil
+	case errModePageUnknown, errModePageInvalid:
+		return cmd.InvalidFieldInParameterList(hdrLen+bdLen+field, -1), nil
+	default:
+		log.Errorf("[EmulateDeviceModeSelect] saving mode pages: %v", err)
+		return cmd.TargetFailure(), nil
 	}
 	return cmd.Ok(), nil
 }
 
 func EmulateRead(cmd *ScsiCmd, r io.ReaderAt) (ScsiResponse, error) {
 	offset := cmd.LBA() * uint64(cmd.VirBlkDev().Sizes().SectorSize)
-	length := int(cmd.XferLen() * uint32(cmd.VirBlkDev().Sizes().SectorSize))
+	length := int(uint64(cmd.XferLen()) * uint64(cmd.VirBlkDev().Sizes().SectorSize))
     //log.Debugf("EmulateRead offset:%d length:%d", offset, length)
+	if resp, ok := checkReady(cmd); !ok {
+		return resp, nil
+	}
+	if c, _ := cmd.CDB(); c.Protect != 0 {
+		// There's no protection information to check or return.
+		return cmd.InvalidFieldInCDB(c.FlagsField(), 7), nil
+	}
+	if cmd.XferLen() > cmd.VirBlkDev().BlockLimits().MaxTransferLength {
+		return cmd.IllegalRequest(), nil
+	}
+	if resp, ok := checkLBARange(cmd); !ok {
+		return resp, nil
+	}
+	if length > cmd.BufferLen() {
+		log.Errorf("[EmulateRead] transfer of %d bytes doesn't fit the %d byte data buffer", length, cmd.BufferLen())
+		return cmd.IllegalRequest(), nil
+	}
 	cmd.Buffer = make([]byte, length)
 	/*
 		if cmd.Buffer == nil {
@@ -361,13 +661,18 @@ func EmulateRead(cmd *ScsiCmd, r io.ReaderAt) (ScsiResponse, error) {
 		}
 	*/
 	n, err := r.ReadAt(cmd.Buffer, int64(offset))
-	if n < length {
-		log.Errorf("[EmulateRead] ReadAt failed: unable to copy enough")
-		return cmd.MediumError(), nil
-	}
-	if err != nil {
+	if err != nil && err != io.EOF {
 		log.Errorf("[EmulateRead] Read error: %v", err)
-		return cmd.MediumError(), nil
+		return backendErrorResponse(cmd, r, err), nil
+	}
+	if n < length {
+		if !cmd.VirBlkDev().mbCapReadLen() {
+			log.Errorf("[EmulateRead] ReadAt failed: unable to copy enough")
+			return cmd.MediumError(), nil
+		}
+		// Report the short read as an underflow.
+		cmd.Write(cmd.Buffer[:n])
+		return cmd.OkLen(n), nil
 	}
 	//log.Debugf("[EmulateRead] recv type:%d seq:%d offset:%d size:%d md5:%x", 0, 0, offset, len(cmd.Buffer), md5.Sum(cmd.Buffer))
 	n, err = cmd.Write(cmd.Buffer)
@@ -384,10 +689,424 @@ func EmulateRead(cmd *ScsiCmd, r io.ReaderAt) (ScsiResponse, error) {
 	return cmd.Ok(), nil
 }
 
+// EmulateSyncCache makes the blocks SYNCHRONIZE CACHE names durable, if the backend is a Syncer or a
+// RangeSyncer. With IMMED set it returns GOOD straight away and syncs in the background; an error then can
+// only be logged.
+func EmulateSyncCache(cmd *ScsiCmd, backend interface{}) (ScsiResponse, error) {
+	if resp, ok := checkReady(cmd); !ok {
+		return resp, nil
+	}
+	if resp, ok := checkLBARange(cmd); !ok {
+		return resp, nil
+	}
+	c, _ := cmd.CDB()
+	sectorSize := uint64(cmd.VirBlkDev().Sizes().SectorSize)
+	offset := int64(c.LBA * sectorSize)
+	// NUMBER OF LOGICAL BLOCKS 0 means through to the last block.
+	length := int64(uint64(c.TransferLength) * sectorSize)
+	if c.TransferLength == 0 {
+		length = cmd.VirBlkDev().Sizes().VolumeSize - offset
+	}
+
+	if c.Immed {
+		go func() {
+			if err := syncRange(backend, offset, length); err != nil {
+				log.Errorf("[EmulateSyncCache] vbd:%s immediate sync failed: %s", cmd.VirBlkDev().GetDevice(), err)
+			}
+		}()
+		return cmd.Ok(), nil
+	}
+	if err := syncRange(backend, offset, length); err != nil {
+		log.Errorf("[EmulateSyncCache] Sync error: %v", err)
+		return backendErrorResponse(cmd, backend, err), nil
+	}
+	return cmd.Ok(), nil
+}
+
+// EmulateUnmap deallocates the blocks in UNMAP's block descriptors. The whole list is checked against the
+// device and its BlockLimits before anything is unmapped, and each descriptor's blocks are locked against
+// other writes, such as COMPARE AND WRITE, while they are.
+func EmulateUnmap(cmd *ScsiCmd, u Unmapper) (ScsiResponse, error) {
+	if resp, ok := checkReady(cmd); !ok {
+		return resp, nil
+	}
+	c, err := cmd.CDB()
+	if err != nil {
+		return cmd.IllegalRequest(), nil
+	}
+	if c.Anchor {
+		// There's no anchored state to put the blocks in.
+		return cmd.InvalidFieldInCDB(1, 0), nil
+	}
+	if c.TransferLength == 0 {
+		return cmd.Ok(), nil
+	}
+	if c.TransferLength < 8 {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscParameterListLengthError), nil
+	}
+	param := make([]byte, c.TransferLength)
+	n, _ := cmd.Read(param)
+	if n < 8 {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscParameterListLengthError), nil
+	}
+	param = param[:n]
+
+	order := binary.BigEndian
+	descLen := int(order.Uint16(param[2:4]))
+	if descLen > len(param)-8 {
+		descLen = len(param) - 8
+	}
+	descs := param[8 : 8+descLen-descLen%16]
+
+	sizes := cmd.VirBlkDev().Sizes()
+	numBlocks := uint64(sizes.VolumeSize / sizes.SectorSize)
+	limits := cmd.VirBlkDev().BlockLimits()
+	if uint64(len(descs)/16) > uint64(limits.MaxUnmapDescriptors) {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInParameterList), nil
+	}
+	for i := 0; i < len(descs); i += 16 {
+		lba := order.Uint64(descs[i : i+8])
+		count := order.Uint32(descs[i+8 : i+12])
+		if count > limits.MaxUnmapLBACount {
+			return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInParameterList), nil
+		}
+		if lba > numBlocks || uint64(count) > numBlocks-lba {
+			return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscLbaOutOfRange), nil
+		}
+	}
+
+	for i := 0; i < len(descs); i += 16 {
+		lba := order.Uint64(descs[i : i+8])
+		count := order.Uint32(descs[i+8 : i+12])
+		if count == 0 {
+			continue
+		}
+		unlock := cmd.VirBlkDev().lbaLock.lock(lba, uint64(count))
+		err := u.Unmap(int64(lba)*sizes.SectorSize, int64(count)*sizes.SectorSize)
+		unlock()
+		if err != nil {
+			log.Errorf("[EmulateUnmap] Unmap error: %v", err)
+			return backendErrorResponse(cmd, u, err), nil
+		}
+	}
+	return cmd.Ok(), nil
+}
+
+// EmulateWriteSame writes the one block of data-out, or zeroes with NDOB, over the range WRITE SAME names.
+// With the UNMAP bit set and a block of zeroes, the range is deallocated instead, if the backend can; if
+// deallocating fails, the zeroes are written after all.
+func EmulateWriteSame(cmd *ScsiCmd, rw io.WriterAt) (ScsiResponse, error) {
+	if resp, ok := checkReady(cmd); !ok {
+		return resp, nil
+	}
+	c, err := cmd.CDB()
+	if err != nil || c.TransferLength == 0 {
+		// WSNZ is set.
+		return cmd.IllegalRequest(), nil
+	}
+	if c.Protect != 0 {
+		return cmd.InvalidFieldInCDB(c.FlagsField(), 7), nil
+	}
+	if c.Anchor {
+		return cmd.InvalidFieldInCDB(c.FlagsField(), 4), nil
+	}
+	if uint64(c.TransferLength) > cmd.VirBlkDev().BlockLimits().MaxWriteSameLength {
+		return cmd.IllegalRequest(), nil
+	}
+	if resp, ok := checkLBARange(cmd); !ok {
+		return resp, nil
+	}
+
+	sectorSize := cmd.VirBlkDev().Sizes().SectorSize
+	block := make([]byte, sectorSize)
+	if !c.NDOB {
+		n, _ := cmd.Read(block)
+		if int64(n) < sectorSize {
+			return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscParameterListLengthError), nil
+		}
+	}
+	offset := int64(c.LBA) * sectorSize
+	count := int64(c.TransferLength)
+	defer cmd.VirBlkDev().lbaLock.lock(c.LBA, uint64(count))()
+
+	if c.Unmap && isZero(block) && cmd.VirBlkDev().Unmaps() {
+		if u, ok := unmapperFor(rw); ok {
+			err := u.Unmap(offset, count*sectorSize)
+			if err == nil {
+				return cmd.Ok(), nil
+			}
+			log.Warnf("[EmulateWriteSame] Unmap error, writing zeroes instead: %v", err)
+		}
+	}
+	if err := writeSame(rw, block, offset, count); err != nil {
+		log.Errorf("[EmulateWriteSame] Write error: %v", err)
+		return backendErrorResponse(cmd, rw, err), nil
+	}
+	if writeThrough(cmd, c) {
+		if err := syncRange(rw, offset, count*sectorSize); err != nil {
+			log.Errorf("[EmulateWriteSame] Sync error: %v", err)
+			return backendErrorResponse(cmd, rw, err), nil
+		}
+	}
+	return cmd.Ok(), nil
+}
+
+// writeThrough reports whether a write must be durable before it completes: if it has FUA set, or the write
+// cache is disabled.
+func writeThrough(cmd *ScsiCmd, c scsi.CDB) bool {
+	return c.FUA || !cmd.VirBlkDev().WriteCacheEnabled()
+}
+
+// EmulateCompareAndWrite compares the first half of the data-out buffer with the blocks COMPARE AND WRITE
+// names and, only if they all match, writes the second half over them. No write to those blocks can come
+// between the compare and the write.
+func EmulateCompareAndWrite(cmd *ScsiCmd, rw ReadWriteAt) (ScsiResponse, error) {
+	if resp, ok := checkReady(cmd); !ok {
+		return resp, nil
+	}
+	c, err := cmd.CDB()
+	if err != nil {
+		return cmd.IllegalRequest(), nil
+	}
+	if c.Protect != 0 {
+		return cmd.InvalidFieldInCDB(c.FlagsField(), 7), nil
+	}
+	if c.TransferLength == 0 {
+		// Nothing to compare, and that isn't an error.
+		return cmd.Ok(), nil
+	}
+	if c.TransferLength > uint32(cmd.VirBlkDev().BlockLimits().MaxCompareAndWriteLength) {
+		return cmd.IllegalRequest(), nil
+	}
+	if resp, ok := checkLBARange(cmd); !ok {
+		return resp, nil
+	}
+
+	sectorSize := cmd.VirBlkDev().Sizes().SectorSize
+	offset := int64(c.LBA) * sectorSize
+	length := int(int64(c.TransferLength) * sectorSize)
+	if 2*length > cmd.BufferLen() {
+		log.Errorf("[EmulateCompareAndWrite] %d bytes to compare and write don't fit the %d byte data buffer", 2*length, cmd.BufferLen())
+		return cmd.IllegalRequest(), nil
+	}
+	buf := make([]byte, 2*length)
+	if n, _ := cmd.Read(buf); n < len(buf) {
+		return cmd.MediumError(), nil
+	}
+	verify, write := buf[:length], buf[length:]
+
+	defer cmd.VirBlkDev().lbaLock.lock(c.LBA, uint64(c.TransferLength))()
+
+	current := make([]byte, length)
+	n, err := rw.ReadAt(current, offset)
+	if err != nil && !(err == io.EOF && n == length) {
+		log.Errorf("[EmulateCompareAndWrite] Read error: %v", err)
+		return backendErrorResponse(cmd, rw, err), nil
+	}
+	for i := range verify {
+		if verify[i] != current[i] {
+			return cmd.Miscompare(i), nil
+		}
+	}
+
+	if _, err := rw.WriteAt(write, offset); err != nil {
+		log.Errorf("[EmulateCompareAndWrite] Write error: %v", err)
+		return backendErrorResponse(cmd, rw, err), nil
+	}
+	if writeThrough(cmd, c) {
+		if err := syncRange(rw, offset, int64(length)); err != nil {
+			log.Errorf("[EmulateCompareAndWrite] FUA sync error: %v", err)
+			return backendErrorResponse(cmd, rw, err), nil
+		}
+	}
+	return cmd.Ok(), nil
+}
+
+// EmulateVerify reads back the blocks VERIFY names. With BYTCHK 0 it only checks they can be read; with 1 it
+// compares them with the data-out buffer, and with 3 it compares each of them with the one block sent.
+func EmulateVerify(cmd *ScsiCmd, r io.ReaderAt) (ScsiResponse, error) {
+	if resp, ok := checkReady(cmd); !ok {
+		return resp, nil
+	}
+	c, err := cmd.CDB()
+	if err != nil {
+		return cmd.IllegalRequest(), nil
+	}
+	if c.Protect != 0 {
+		return cmd.InvalidFieldInCDB(c.FlagsField(), 7), nil
+	}
+	if c.BytChk == 2 {
+		return cmd.InvalidFieldInCDB(c.FlagsField(), 2), nil
+	}
+	if resp, ok := checkLBARange(cmd); !ok {
+		return resp, nil
+	}
+
+	sectorSize := cmd.VirBlkDev().Sizes().SectorSize
+	offset := int64(c.LBA) * sectorSize
+	length := int(uint64(c.TransferLength) * uint64(sectorSize))
+	if length > cmd.BufferLen() && c.BytChk == 1 {
+		log.Errorf("[EmulateVerify] %d bytes to compare don't fit the %d byte data buffer", length, cmd.BufferLen())
+		return cmd.IllegalRequest(), nil
+	}
+
+	var expect []byte
+	switch c.BytChk {
+	case 1:
+		expect = make([]byte, length)
+	case 3:
+		expect = make([]byte, sectorSize)
+	}
+	if expect != nil {
+		if n, _ := cmd.Read(expect); n < len(expect) {
+			return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscParameterListLengthError), nil
+		}
+	}
+
+	// The range may be far bigger than the data buffer, so it's read back a piece at a time.
+	chunk := verifyChunk - verifyChunk%int(sectorSize)
+	if chunk < int(sectorSize) {
+		chunk = int(sectorSize)
+	}
+	got := make([]byte, chunk)
+	for done := 0; done < length; done += chunk {
+		if length-done < chunk {
+			got = got[:length-done]
+		}
+		n, err := r.ReadAt(got, offset+int64(done))
+		if n < len(got) {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			log.Errorf("[EmulateVerify] Read error: %v", err)
+			return backendErrorResponse(cmd, r, err), nil
+		}
+		if expect == nil {
+			continue
+		}
+		for i := range got {
+			if got[i] != expect[(done+i)%len(expect)] {
+				return cmd.Miscompare(done + i), nil
+			}
+		}
+	}
+	return cmd.Ok(), nil
+}
+
+// verifyChunk is how much of the range EmulateVerify reads back at once.
+const verifyChunk = 1024 * 1024
+
+// EmulateWriteVerify writes the data-out buffer as WRITE does, then reads it back from the backend and checks
+// it came back the same. With BYTCHK 1 a difference is reported as a MISCOMPARE; with BYTCHK 0, where the
+// initiator only asked for the medium to be verified, as a MEDIUM ERROR.
+func EmulateWriteVerify(cmd *ScsiCmd, rw ReadWriteAt) (ScsiResponse, error) {
+	if resp, ok := checkReady(cmd); !ok {
+		return resp, nil
+	}
+	c, err := cmd.CDB()
+	if err != nil {
+		return cmd.IllegalRequest(), nil
+	}
+	if c.Protect != 0 {
+		return cmd.InvalidFieldInCDB(c.FlagsField(), 7), nil
+	}
+	if c.BytChk > 1 {
+		return cmd.InvalidFieldInCDB(c.FlagsField(), 2), nil
+	}
+	if resp, ok := checkLBARange(cmd); !ok {
+		return resp, nil
+	}
+
+	sectorSize := cmd.VirBlkDev().Sizes().SectorSize
+	offset := int64(c.LBA) * sectorSize
+	length := int(uint64(c.TransferLength) * uint64(sectorSize))
+	if length > cmd.BufferLen() {
+		log.Errorf("[EmulateWriteVerify] transfer of %d bytes doesn't fit the %d byte data buffer", length, cmd.BufferLen())
+		return cmd.IllegalRequest(), nil
+	}
+	data := make([]byte, length)
+	if n, _ := cmd.Read(data); n < length {
+		return cmd.MediumError(), nil
+	}
+
+	// Nothing else may write these blocks before they're read back.
+	defer cmd.VirBlkDev().lbaLock.lock(c.LBA, uint64(c.TransferLength))()
+
+	if _, err := rw.WriteAt(data, offset); err != nil {
+		log.Errorf("[EmulateWriteVerify] Write error: %v", err)
+		return backendErrorResponse(cmd, rw, err), nil
+	}
+	// The verify is of the medium, not of whatever the backend has buffered.
+	if err := syncRange(rw, offset, int64(length)); err != nil {
+		log.Errorf("[EmulateWriteVerify] Sync error: %v", err)
+		return backendErrorResponse(cmd, rw, err), nil
+	}
+
+	got := make([]byte, length)
+	n, err := rw.ReadAt(got, offset)
+	if n < length {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		log.Errorf("[EmulateWriteVerify] Read back error: %v", err)
+		return cmd.MediumError(), nil
+	}
+	for i := range got {
+		if got[i] != data[i] {
+			log.Errorf("[EmulateWriteVerify] LBA %d read back different from what was written, at byte %d", c.LBA, i)
+			if c.BytChk == 0 {
+				return cmd.CheckCondition(scsi.SenseMediumError, scsi.AscMiscompareDuringVerifyOperation), nil
+			}
+			return cmd.Miscompare(i), nil
+		}
+	}
+	return cmd.Ok(), nil
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// checkLBARange makes sure the blocks cmd addresses all lie on the device, returning the response to fail it
+// with if they don't.
+func checkLBARange(cmd *ScsiCmd) (ScsiResponse, bool) {
+	c, err := cmd.CDB()
+	if err != nil {
+		return cmd.IllegalRequest(), false
+	}
+	sizes := cmd.VirBlkDev().Sizes()
+	if err := c.CheckRange(uint64(sizes.VolumeSize / sizes.SectorSize)); err != nil {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscLbaOutOfRange), false
+	}
+	return ScsiResponse{}, true
+}
+
 func EmulateWrite(cmd *ScsiCmd, r io.WriterAt) (ScsiResponse, error) {
 	offset := cmd.LBA() * uint64(cmd.VirBlkDev().Sizes().SectorSize)
-	length := int(cmd.XferLen() * uint32(cmd.VirBlkDev().Sizes().SectorSize))
+	length := int(uint64(cmd.XferLen()) * uint64(cmd.VirBlkDev().Sizes().SectorSize))
 	//log.Debugf("EmulateWrite offset:%d length:%d", offset, length)
+	if resp, ok := checkReady(cmd); !ok {
+		return resp, nil
+	}
+	if c, _ := cmd.CDB(); c.Protect != 0 {
+		// There's no protection information to check or return.
+		return cmd.InvalidFieldInCDB(c.FlagsField(), 7), nil
+	}
+	if cmd.XferLen() > cmd.VirBlkDev().BlockLimits().MaxTransferLength {
+		return cmd.IllegalRequest(), nil
+	}
+	if resp, ok := checkLBARange(cmd); !ok {
+		return resp, nil
+	}
+	if length > cmd.BufferLen() {
+		log.Errorf("[EmulateWrite] transfer of %d bytes doesn't fit the %d byte data buffer", length, cmd.BufferLen())
+		return cmd.IllegalRequest(), nil
+	}
 	cmd.Buffer = make([]byte, length)
 	/*
 		if cmd.Buffer == nil {
@@ -409,14 +1128,23 @@ func EmulateWrite(cmd *ScsiCmd, r io.WriterAt) (ScsiResponse, error) {
 		return cmd.MediumError(), nil
 	}
 
+	unlock := cmd.VirBlkDev().lbaLock.lock(cmd.LBA(), uint64(cmd.XferLen()))
 	n, err = r.WriteAt(cmd.Buffer, int64(offset))
+	unlock()
+	if err != nil {
+		log.Debugf("read/write failed: error:", err.Error())
+		return backendErrorResponse(cmd, r, err), nil
+	}
 	if n < length {
 		log.Debugf("write/write failed: unable to copy enough")
-		return cmd.MediumError(), nil
+		return cmd.CheckCondition(scsi.SenseMediumError, scsi.AscWriteError), nil
 	}
-	if err != nil {
-		log.Debugf("read/write failed: error:", err.Error())
-		return cmd.MediumError(), nil
+
+	if c, _ := cmd.CDB(); writeThrough(cmd, c) {
+		if err := syncRange(r, int64(offset), int64(length)); err != nil {
+			log.Errorf("[EmulateWrite] FUA sync error: %v", err)
+			return backendErrorResponse(cmd, r, err), nil
+		}
 	}
 
 	return cmd.Ok(), nil
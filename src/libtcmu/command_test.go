@@ -0,0 +1,783 @@
+package tcmu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"libtcmu/scsi"
+)
+
+// unmapCDB builds an UNMAP CDB and its parameter list, one descriptor per LBA and block count.
+func unmapCDB(descs ...[2]uint64) ([]byte, []byte) {
+	p := make([]byte, 8+16*len(descs))
+	binary.BigEndian.PutUint16(p[0:], uint16(len(p)-2))
+	binary.BigEndian.PutUint16(p[2:], uint16(16*len(descs)))
+	for i, d := range descs {
+		binary.BigEndian.PutUint64(p[8+16*i:], d[0])
+		binary.BigEndian.PutUint32(p[8+16*i+8:], uint32(d[1]))
+	}
+	c := []byte{scsi.Unmap, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(c[7:], uint16(len(p)))
+	return c, p
+}
+
+// unmapFailRW is a memRW whose Unmap always fails, as punching a hole can on a filesystem that runs out of
+// space splitting an extent.
+type unmapFailRW struct {
+	memRW
+}
+
+func (*unmapFailRW) Unmap(off, length int64) error {
+	return syscall.EOPNOTSUPP
+}
+
+func lbpme(t *testing.T, r *FakeRing) bool {
+	fc, err := r.Do([]byte{scsi.ServiceActionIn16, 0x10, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 32, 0, 0}, nil, 32)
+	if err != nil || fc.Status != scsi.SamStatGood {
+		t.Fatalf("READ CAPACITY(16): %v, status 0x%02x", err, fc.Status)
+	}
+	return fc.Data[14]&0x80 != 0
+}
+
+func TestUnmapFile(t *testing.T) {
+	const size = 4 << 20
+	f, err := os.Create(filepath.Join(t.TempDir(), "vol"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt(bytes.Repeat([]byte{0xaa}, size), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if !canPunchHoles(f) {
+		t.Skip("the temporary directory's filesystem can't punch holes")
+	}
+	var before, after syscall.Stat_t
+	syscall.Fstat(int(f.Fd()), &before)
+
+	r := newTestRing(t, "t", ReadWriteAtCmdHandler{RW: f}, size, DeviceOptions{}, FakeRingConfig{})
+	defer r.Close()
+	if !r.Device().Unmaps() || !lbpme(t, r) {
+		t.Fatal("a file that can punch holes isn't thin provisioned")
+	}
+	c, p := unmapCDB([2]uint64{0, 4096}, [2]uint64{4096, 2048})
+	if fc, err := r.Do(c, p, 0); err != nil || fc.Status != scsi.SamStatGood {
+		t.Fatalf("UNMAP: %v, status 0x%02x", err, fc.Status)
+	}
+	syscall.Fstat(int(f.Fd()), &after)
+	if after.Blocks >= before.Blocks || after.Size != size {
+		t.Fatalf("after UNMAP: %d blocks of %d bytes, before %d blocks", after.Blocks, after.Size, before.Blocks)
+	}
+}
+
+func TestUnmapUnsupportedFile(t *testing.T) {
+	// A character device is an *os.File, but there are no holes to punch in one.
+	f, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r := newTestRing(t, "t", ReadWriteAtCmdHandler{RW: f}, 1<<20, DeviceOptions{}, FakeRingConfig{})
+	defer r.Close()
+	if r.Device().Unmaps() || lbpme(t, r) {
+		t.Fatal("a file that can't punch holes is thin provisioned")
+	}
+	c, p := unmapCDB([2]uint64{0, 8})
+	if fc, err := r.Do(c, p, 0); err != nil || fc.Status == scsi.SamStatGood && !fc.UnknownOp {
+		t.Fatalf("UNMAP: %v, status 0x%02x, emulated", err, fc.Status)
+	}
+}
+
+func TestWriteSameUnmapFallsBack(t *testing.T) {
+	m := &unmapFailRW{memRW{b: bytes.Repeat([]byte{0xaa}, 1<<20)}}
+	r := newTestRing(t, "t", ReadWriteAtCmdHandler{RW: m}, 1<<20, DeviceOptions{}, FakeRingConfig{})
+	defer r.Close()
+
+	// WRITE SAME(10) of zeroes with UNMAP over LBAs 8-23: the unmap fails, so the zeroes are written.
+	c := []byte{scsi.WriteSame, 0x08, 0, 0, 0, 8, 0, 0, 16, 0}
+	if fc, err := r.Do(c, make([]byte, 512), 0); err != nil || fc.Status != scsi.SamStatGood {
+		t.Fatalf("WRITE SAME: %v, status 0x%02x", err, fc.Status)
+	}
+	if !isZero(m.b[8*512:24*512]) || m.b[8*512-1] != 0xaa || m.b[24*512] != 0xaa {
+		t.Fatal("WRITE SAME didn't write zeroes over exactly the range")
+	}
+}
+
+// zeroUnmapRW is a memRW that reads back zeroes from the blocks it unmaps.
+type zeroUnmapRW struct {
+	memRW
+}
+
+func (z *zeroUnmapRW) Unmap(off, length int64) error {
+	_, err := z.WriteAt(make([]byte, length), off)
+	return err
+}
+
+func (z *zeroUnmapRW) zeroed(lba int64) bool {
+	z.Lock()
+	defer z.Unlock()
+	return isZero(z.b[lba*512 : (lba+1)*512])
+}
+
+func TestUnmapLocksRange(t *testing.T) {
+	m := &zeroUnmapRW{memRW{b: bytes.Repeat([]byte{0xaa}, 1<<20)}}
+	r := newTestRing(t, "t", ReadWriteAtCmdHandler{RW: m}, 1<<20, DeviceOptions{Workers: 2}, FakeRingConfig{})
+	defer r.Close()
+
+	// As if a COMPARE AND WRITE were busy with LBAs 8-15.
+	unlock := r.Device().lbaLock.lock(8, 8)
+	c, p := unmapCDB([2]uint64{0, 2}, [2]uint64{10, 2})
+	done, err := r.Submit(c, p, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+		t.Fatal("UNMAP completed while LBAs 10-11 were locked")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if !m.zeroed(0) || m.zeroed(10) {
+		t.Fatal("UNMAP didn't stop at the locked descriptor")
+	}
+	unlock()
+	if fc := <-done; fc.Status != scsi.SamStatGood || !m.zeroed(10) {
+		t.Fatalf("UNMAP: status 0x%02x, LBA 10 unmapped %v", fc.Status, m.zeroed(10))
+	}
+}
+
+// cdb32 builds a 32 byte variable length CDB for service action sa, with flags in byte 10.
+func cdb32(sa uint16, flags byte, lba uint64, n uint32) []byte {
+	c := make([]byte, 32)
+	c[0] = scsi.VariableLengthCmd
+	c[7] = 0x18
+	binary.BigEndian.PutUint16(c[8:], sa)
+	c[10] = flags
+	binary.BigEndian.PutUint64(c[12:], lba)
+	binary.BigEndian.PutUint32(c[28:], n)
+	return c
+}
+
+func TestVariableLengthCommands(t *testing.T) {
+	m := &memRW{b: make([]byte, 1<<20)}
+	r := newTestRing(t, "t", ReadWriteAtCmdHandler{RW: m}, 1<<20, DeviceOptions{}, FakeRingConfig{})
+	defer r.Close()
+	data := bytes.Repeat([]byte{5}, 1024)
+
+	if fc, err := r.Do(cdb32(scsi.Write32, 0, 4, 2), data, 0); err != nil || fc.Status != scsi.SamStatGood {
+		t.Fatalf("WRITE(32): %v, status 0x%02x", err, fc.Status)
+	}
+	if !bytes.Equal(m.b[4*512:6*512], data) {
+		t.Fatal("WRITE(32) didn't write LBAs 4-5")
+	}
+	if fc, err := r.Do(cdb32(scsi.Read32, 0, 4, 2), nil, 1024); err != nil || fc.Status != scsi.SamStatGood || !bytes.Equal(fc.Data, data) {
+		t.Fatalf("READ(32): %v, status 0x%02x", err, fc.Status)
+	}
+	if fc, err := r.Do(cdb32(scsi.Verify32, 0x02, 4, 2), data, 0); err != nil || fc.Status != scsi.SamStatGood {
+		t.Fatalf("VERIFY(32): %v, status 0x%02x", err, fc.Status)
+	}
+	if fc, err := r.Do(cdb32(scsi.WriteSame32, 0x01, 4, 1), nil, 0); err != nil || fc.Status != scsi.SamStatGood {
+		t.Fatalf("WRITE SAME(32): %v, status 0x%02x", err, fc.Status)
+	}
+	if !isZero(m.b[4*512 : 5*512]) {
+		t.Fatal("WRITE SAME(32) with NDOB didn't zero LBA 4")
+	}
+	if fc, err := r.Do(cdb32(scsi.Write32, 0, 2047, 2), data, 0); err != nil || fc.Status != scsi.SamStatCheckCondition ||
+		fc.Sense[12] != 0x21 {
+		t.Fatalf("WRITE(32) past the end: %v, status 0x%02x", err, fc.Status)
+	}
+}
+
+func TestProtectRefused(t *testing.T) {
+	m := &memRW{b: bytes.Repeat([]byte{0xaa}, 1<<20)}
+	r := newTestRing(t, "t", ReadWriteAtCmdHandler{RW: m}, 1<<20, DeviceOptions{}, FakeRingConfig{})
+	defer r.Close()
+
+	// There's no protection information, so any RDPROTECT, WRPROTECT or VRPROTECT is an invalid field, and
+	// none of these may touch the backend.
+	tests := []struct {
+		name  string
+		cdb   []byte
+		data  []byte
+		field int
+	}{
+		{"READ(10)", []byte{scsi.Read10, 0x20, 0, 0, 0, 4, 0, 0, 1, 0}, nil, 1},
+		{"WRITE(16)", []byte{scsi.Write16, 0x60, 0, 0, 0, 0, 0, 0, 0, 4, 0, 0, 0, 1, 0, 0}, make([]byte, 512), 1},
+		{"WRITE SAME(16)", []byte{scsi.WriteSame16, 0x20, 0, 0, 0, 0, 0, 0, 0, 4, 0, 0, 0, 1, 0, 0}, make([]byte, 512), 1},
+		{"READ(32)", cdb32(scsi.Read32, 0x20, 4, 1), nil, 10},
+		{"WRITE(32)", cdb32(scsi.Write32, 0xe0, 4, 1), make([]byte, 512), 10},
+		{"VERIFY(32)", cdb32(scsi.Verify32, 0x22, 4, 1), make([]byte, 512), 10},
+		{"WRITE AND VERIFY(32)", cdb32(scsi.WriteVerify32, 0x20, 4, 1), make([]byte, 512), 10},
+		{"WRITE SAME(32)", cdb32(scsi.WriteSame32, 0x20, 4, 1), make([]byte, 512), 10},
+	}
+	for _, tt := range tests {
+		alloc := 0
+		if tt.data == nil {
+			alloc = 512
+		}
+		fc, err := r.Do(tt.cdb, tt.data, alloc)
+		if err != nil || fc.Status != scsi.SamStatCheckCondition || fc.Sense[12] != 0x24 {
+			t.Errorf("%s: %v, status 0x%02x, want INVALID FIELD IN CDB", tt.name, err, fc.Status)
+			continue
+		}
+		if fc.Sense[15] != 0xcf || int(binary.BigEndian.Uint16(fc.Sense[16:])) != tt.field {
+			t.Errorf("%s: field pointer % x, want byte %d bit 7", tt.name, fc.Sense[15:18], tt.field)
+		}
+	}
+	if m.b[4*512] != 0xaa {
+		t.Fatal("a command with protection information reached the backend")
+	}
+}
+
+func TestReadCapacity10(t *testing.T) {
+	for _, tt := range []struct {
+		size    int64
+		lastLBA uint32
+	}{
+		{8192, 15},
+		{2<<40 - 512, 0xfffffffe},
+		{2 << 40, 0xffffffff},
+		{3 << 40, 0xffffffff},
+	} {
+		r := newTestRing(t, "t", memHandler(8192), tt.size, DeviceOptions{}, FakeRingConfig{})
+		fc, err := r.Do([]byte{scsi.ReadCapacity, 0, 0, 0, 0, 0, 0, 0, 0, 0}, nil, 8)
+		r.Close()
+		if err != nil || fc.Status != scsi.SamStatGood {
+			t.Fatalf("%d bytes: %v, status 0x%02x", tt.size, err, fc.Status)
+		}
+		if lba, bs := binary.BigEndian.Uint32(fc.Data), binary.BigEndian.Uint32(fc.Data[4:]); lba != tt.lastLBA || bs != 512 {
+			t.Errorf("%d bytes: last LBA 0x%x, block size %d, want 0x%x, 512", tt.size, lba, bs, tt.lastLBA)
+		}
+	}
+}
+
+func TestStartStopUnit(t *testing.T) {
+	r := newTestRing(t, "t", memHandler(8192), 8192, DeviceOptions{}, FakeRingConfig{})
+	defer r.Close()
+	startStop := func(b4 byte) {
+		t.Helper()
+		if fc, err := r.Do([]byte{scsi.StartStop, 0, 0, 0, b4, 0}, nil, 0); err != nil || fc.Status != scsi.SamStatGood {
+			t.Fatalf("START STOP UNIT 0x%02x: %v, status 0x%02x", b4, err, fc.Status)
+		}
+	}
+
+	startStop(0x00)
+	fc, err := r.Do(rw10(scsi.Read10, 0, 1), nil, 512)
+	expectSense(t, "READ while stopped", fc, err, scsi.SenseNotReady, scsi.AscLunNotReadyInitCmdRequired)
+	fc, err = r.Do(testUnitReady, nil, 0)
+	expectSense(t, "TEST UNIT READY while stopped", fc, err, scsi.SenseNotReady, scsi.AscLunNotReadyInitCmdRequired)
+	fc, err = r.Do([]byte{scsi.RequestSense, 0, 0, 0, 18, 0}, nil, 18)
+	if err != nil || fc.Status != scsi.SamStatGood || fc.Data[2] != scsi.SenseNotReady || fc.Data[12] != 0x04 || fc.Data[13] != 0x02 {
+		t.Fatalf("REQUEST SENSE while stopped: %v, status 0x%02x, sense % x", err, fc.Status, fc.Data)
+	}
+	// Nothing else needs a stopped device.
+	if fc, err := r.Do([]byte{scsi.Inquiry, 0, 0, 0, 36, 0}, nil, 36); err != nil || fc.Status != scsi.SamStatGood {
+		t.Fatalf("INQUIRY while stopped: %v, status 0x%02x", err, fc.Status)
+	}
+
+	// POWER CONDITION ACTIVE starts it whatever START says, and an invalid one is refused.
+	startStop(0x10)
+	if fc, err := r.Do(rw10(scsi.Read10, 0, 1), nil, 512); err != nil || fc.Status != scsi.SamStatGood {
+		t.Fatalf("READ once started: %v, status 0x%02x", err, fc.Status)
+	}
+	fc, err = r.Do([]byte{scsi.StartStop, 0, 0, 0, 0x40, 0}, nil, 0)
+	expectSense(t, "POWER CONDITION 4", fc, err, scsi.SenseIllegalRequest, scsi.AscInvalidFieldInCdb)
+	startStop(0x00)
+	startStop(0x01)
+	if fc, err := r.Do(testUnitReady, nil, 0); err != nil || fc.Status != scsi.SamStatGood {
+		t.Fatalf("TEST UNIT READY once started: %v, status 0x%02x", err, fc.Status)
+	}
+}
+
+func TestReportLuns(t *testing.T) {
+	r := newTestRing(t, "t", memHandler(8192), 8192, DeviceOptions{}, FakeRingConfig{})
+	defer r.Close()
+	reportLuns := func(sel byte, alloc int) []byte {
+		c := make([]byte, 12)
+		c[0] = scsi.ReportLuns
+		c[2] = sel
+		binary.BigEndian.PutUint32(c[6:], uint32(alloc))
+		return c
+	}
+	for _, sel := range []byte{0x00, 0x02} {
+		fc, err := r.Do(reportLuns(sel, 64), nil, 64)
+		if err != nil || fc.Status != scsi.SamStatGood || !bytes.Equal(fc.Data[:16], []byte{0, 0, 0, 8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}) {
+			t.Fatalf("SELECT REPORT 0x%02x: %v, status 0x%02x, % x, want just LUN 0", sel, err, fc.Status, fc.Data[:16])
+		}
+	}
+	if fc, err := r.Do(reportLuns(0x01, 64), nil, 64); err != nil || fc.Status != scsi.SamStatGood || binary.BigEndian.Uint32(fc.Data) != 0 {
+		t.Fatalf("well known LUNs: %v, status 0x%02x, % x, want none", err, fc.Status, fc.Data[:8])
+	}
+	fc, err := r.Do(reportLuns(0x10, 64), nil, 64)
+	expectSense(t, "SELECT REPORT 0x10", fc, err, scsi.SenseIllegalRequest, scsi.AscInvalidFieldInCdb)
+	fc, err = r.Do(reportLuns(0x00, 8), nil, 8)
+	expectSense(t, "ALLOCATION LENGTH 8", fc, err, scsi.SenseIllegalRequest, scsi.AscInvalidFieldInCdb)
+}
+
+// rangeSyncRW is a memRW that records the ranges it's asked to make durable, and passes each one on.
+type rangeSyncRW struct {
+	memRW
+	synced chan [2]int64
+}
+
+func (s *rangeSyncRW) SyncRange(off, length int64) error {
+	s.synced <- [2]int64{off, length}
+	return nil
+}
+
+// expectSynced fails the test unless the next range synced is want, and nothing else was.
+func (s *rangeSyncRW) expectSynced(t *testing.T, what string, want ...[2]int64) {
+	t.Helper()
+	for _, w := range want {
+		select {
+		case got := <-s.synced:
+			if got != w {
+				t.Fatalf("%s: synced %v, want %v", what, got, w)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s: %v wasn't synced", what, w)
+		}
+	}
+	select {
+	case got := <-s.synced:
+		t.Fatalf("%s: synced %v as well", what, got)
+	default:
+	}
+}
+
+func TestSyncCache(t *testing.T) {
+	m := &rangeSyncRW{memRW: memRW{b: make([]byte, 8192)}, synced: make(chan [2]int64, 4)}
+	r := newTestRing(t, "t", ReadWriteAtCmdHandler{RW: m}, 8192, DeviceOptions{}, FakeRingConfig{})
+	defer r.Close()
+	syncCache := func(immed bool, lba uint32, n uint16) []byte {
+		c := []byte{scsi.SynchronizeCache, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+		if immed {
+			c[1] = 0x02
+		}
+		binary.BigEndian.PutUint32(c[2:], lba)
+		binary.BigEndian.PutUint16(c[7:], n)
+		return c
+	}
+
+	for _, tt := range []struct {
+		name   string
+		cdb    []byte
+		synced [2]int64
+	}{
+		{"LBAs 2-4", syncCache(false, 2, 3), [2]int64{1024, 1536}},
+		{"LBA 4 on", syncCache(false, 4, 0), [2]int64{2048, 8192 - 2048}},
+		{"IMMED", syncCache(true, 0, 0), [2]int64{0, 8192}},
+	} {
+		if fc, err := r.Do(tt.cdb, nil, 0); err != nil || fc.Status != scsi.SamStatGood {
+			t.Fatalf("%s: %v, status 0x%02x", tt.name, err, fc.Status)
+		}
+		m.expectSynced(t, tt.name, tt.synced)
+	}
+	fc, err := r.Do(syncCache(false, 15, 2), nil, 0)
+	expectSense(t, "past the end", fc, err, scsi.SenseIllegalRequest, scsi.AscLbaOutOfRange)
+	m.expectSynced(t, "past the end")
+
+	// A backend that can only sync all of itself is synced whole.
+	s := &syncCount{memRW: memRW{b: make([]byte, 8192)}}
+	r2 := newTestRing(t, "t", ReadWriteAtCmdHandler{RW: s}, 8192, DeviceOptions{}, FakeRingConfig{})
+	defer r2.Close()
+	if fc, err := r2.Do(syncCache(false, 2, 3), nil, 0); err != nil || fc.Status != scsi.SamStatGood || s.syncs != 1 {
+		t.Fatalf("Syncer: %v, status 0x%02x, %d syncs, want 1", err, fc.Status, s.syncs)
+	}
+}
+
+func TestWriteThrough(t *testing.T) {
+	m := &rangeSyncRW{memRW: memRW{b: make([]byte, 8192)}, synced: make(chan [2]int64, 4)}
+	r := newTestRing(t, "t", ReadWriteAtCmdHandler{RW: m}, 8192, DeviceOptions{}, FakeRingConfig{})
+	defer r.Close()
+	fua := rw10(scsi.Write10, 2, 2)
+	fua[1] = 0x08
+
+	// With the write cache on, only FUA writes are synced, and just the blocks written.
+	if fc, err := r.Do(rw10(scsi.Write10, 2, 2), make([]byte, 1024), 0); err != nil || fc.Status != scsi.SamStatGood {
+		t.Fatalf("WRITE: %v, status 0x%02x", err, fc.Status)
+	}
+	m.expectSynced(t, "WRITE with WCE set")
+	if fc, err := r.Do(fua, make([]byte, 1024), 0); err != nil || fc.Status != scsi.SamStatGood {
+		t.Fatalf("WRITE FUA: %v, status 0x%02x", err, fc.Status)
+	}
+	m.expectSynced(t, "WRITE FUA", [2]int64{1024, 1024})
+
+	// With it off, every write is.
+	p := cachingSelect(0)
+	if fc, err := r.Do(modeSelect6(false, p), p, 0); err != nil || fc.Status != scsi.SamStatGood {
+		t.Fatalf("MODE SELECT clearing WCE: %v, status 0x%02x", err, fc.Status)
+	}
+	fc, err := r.Do(testUnitReady, nil, 0)
+	expectSense(t, "after MODE SELECT", fc, err, scsi.SenseUnitAttention, scsi.AscModeParametersChanged)
+	if fc, err := r.Do(rw10(scsi.Write10, 6, 1), make([]byte, 512), 0); err != nil || fc.Status != scsi.SamStatGood {
+		t.Fatalf("WRITE: %v, status 0x%02x", err, fc.Status)
+	}
+	m.expectSynced(t, "WRITE with WCE clear", [2]int64{3072, 512})
+
+	// DPOFUA is set in the device-specific parameter of MODE SENSE.
+	if fc, err := r.Do([]byte{scsi.ModeSense, 0x08, 0x08, 0, 64, 0}, nil, 64); err != nil || fc.Data[2]&0x10 == 0 {
+		t.Fatalf("MODE SENSE: %v, device-specific parameter 0x%02x, want DPOFUA", err, fc.Data[2])
+	}
+}
+
+// compareAndWrite builds a COMPARE AND WRITE CDB for n blocks from lba.
+func compareAndWrite(lba uint64, n byte) []byte {
+	c := make([]byte, 16)
+	c[0] = scsi.CompareAndWrite
+	binary.BigEndian.PutUint64(c[2:], lba)
+	c[13] = n
+	return c
+}
+
+func TestCompareAndWriteMiscompare(t *testing.T) {
+	m := &memRW{b: make([]byte, 1<<20)}
+	r := newTestRing(t, "t", ReadWriteAtCmdHandler{RW: m}, 1<<20,
+		DeviceOptions{BlockLimits: BlockLimits{MaxCompareAndWriteLength: 2}}, FakeRingConfig{})
+	defer r.Close()
+
+	// The first byte that differs, in the second block, is reported in INFORMATION, and nothing is written.
+	out := append(make([]byte, 1024), bytes.Repeat([]byte{7}, 1024)...)
+	out[512+9] = 1
+	fc, err := r.Do(compareAndWrite(3, 2), out, 0)
+	expectSense(t, "COMPARE AND WRITE", fc, err, scsi.SenseMiscompare, scsi.AscMiscompareDuringVerifyOperation)
+	if fc.Sense[0]&0x80 == 0 || binary.BigEndian.Uint32(fc.Sense[3:7]) != 512+9 {
+		t.Fatalf("VALID %v, INFORMATION %d, want offset %d", fc.Sense[0]&0x80 != 0, binary.BigEndian.Uint32(fc.Sense[3:7]), 512+9)
+	}
+	if !isZero(m.b[3*512 : 5*512]) {
+		t.Fatal("a miscompare was written")
+	}
+
+	out[512+9] = 0
+	if fc, err := r.Do(compareAndWrite(3, 2), out, 0); err != nil || fc.Status != scsi.SamStatGood {
+		t.Fatalf("matching COMPARE AND WRITE: %v, status 0x%02x", err, fc.Status)
+	}
+	if !bytes.Equal(m.b[3*512:5*512], out[1024:]) {
+		t.Fatal("a match wasn't written")
+	}
+	fc, err = r.Do(compareAndWrite(3, 3), make([]byte, 3072), 0)
+	expectSense(t, "past MaxCompareAndWriteLength", fc, err, scsi.SenseIllegalRequest, scsi.AscInvalidFieldInCdb)
+}
+
+// tearRW is a memRW that writes each half of a buffer separately, so that unserialized writes tear.
+type tearRW struct {
+	memRW
+}
+
+func (w *tearRW) WriteAt(p []byte, off int64) (int, error) {
+	half := len(p) / 2
+	n, err := w.memRW.WriteAt(p[:half], off)
+	if err != nil {
+		return n, err
+	}
+	time.Sleep(50 * time.Microsecond)
+	m, err := w.memRW.WriteAt(p[half:], off+int64(half))
+	return n + m, err
+}
+
+func TestCompareAndWriteAtomic(t *testing.T) {
+	m := &tearRW{memRW{b: make([]byte, 1<<20)}}
+	r := newTestRing(t, "t", ReadWriteAtCmdHandler{RW: m}, 1<<20,
+		DeviceOptions{Workers: 8, BlockLimits: BlockLimits{MaxCompareAndWriteLength: 2}}, FakeRingConfig{})
+	defer r.Close()
+
+	// Each goroutine counts up in LBA 100, reading the count and swapping in the next one, while WRITEs of
+	// two whole blocks of one byte land on LBAs 200-201 alongside COMPARE AND WRITEs of them.
+	var wg sync.WaitGroup
+	var swapped int32
+	for g := 0; g < 8; g++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for done := 0; done < 10; {
+				fc, err := r.Do(rw10(scsi.Read10, 100, 1), nil, 512)
+				if err != nil || fc.Status != scsi.SamStatGood {
+					t.Errorf("READ: %v, status 0x%02x", err, fc.Status)
+					return
+				}
+				v := binary.BigEndian.Uint32(fc.Data)
+				out := make([]byte, 1024)
+				binary.BigEndian.PutUint32(out, v)
+				binary.BigEndian.PutUint32(out[512:], v+1)
+				if fc, _ := r.Do(compareAndWrite(100, 1), out, 0); fc.Status == scsi.SamStatGood {
+					done++
+					atomic.AddInt32(&swapped, 1)
+				}
+			}
+		}()
+		go func(g byte) {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				if fc, err := r.Do(rw10(scsi.Write10, 200, 2), bytes.Repeat([]byte{g}, 1024), 0); err != nil || fc.Status != scsi.SamStatGood {
+					t.Errorf("WRITE: %v, status 0x%02x", err, fc.Status)
+					return
+				}
+				out := append(bytes.Repeat([]byte{g}, 1024), bytes.Repeat([]byte{g + 100}, 1024)...)
+				r.Do(compareAndWrite(200, 2), out, 0)
+			}
+		}(byte(g))
+	}
+	wg.Wait()
+
+	m.Lock()
+	defer m.Unlock()
+	if v := binary.BigEndian.Uint32(m.b[100*512:]); v != uint32(swapped) {
+		t.Fatalf("count %d after %d swaps", v, swapped)
+	}
+	blocks := m.b[200*512 : 202*512]
+	if !bytes.Equal(blocks, bytes.Repeat(blocks[:1], 1024)) {
+		t.Fatalf("LBAs 200-201 were torn: 0x%02x...0x%02x", blocks[0], blocks[1023])
+	}
+}
+
+// verify builds a VERIFY(10) or WRITE AND VERIFY(10) CDB with the given BYTCHK.
+func verify(op byte, bytchk byte, lba uint32, n uint16) []byte {
+	c := rw10(op, lba, n)
+	c[1] = bytchk << 1
+	return c
+}
+
+func TestVerify(t *testing.T) {
+	// Each block of the first 4MiB holds its LBA, and the backend ends there, halfway through the device.
+	m := &memRW{b: make([]byte, 4<<20)}
+	for i := range m.b {
+		m.b[i] = byte(i / 512)
+	}
+	r := newTestRing(t, "t", ReadWriteAtCmdHandler{RW: m}, 8<<20, DeviceOptions{}, FakeRingConfig{DataSize: 4 << 20})
+	defer r.Close()
+	blocks := func(lba, n int) []byte {
+		return append([]byte(nil), m.b[lba*512:(lba+n)*512]...)
+	}
+	changed := func(b []byte, i int) []byte {
+		b[i]++
+		return b
+	}
+
+	for _, tt := range []struct {
+		name string
+		cdb  []byte
+		data []byte
+		// key is the sense key expected, or 0 for GOOD, and offset the INFORMATION of a MISCOMPARE.
+		key    byte
+		offset uint32
+	}{
+		{"BYTCHK 0", verify(scsi.Verify, 0, 0, 8192), nil, 0, 0},
+		{"BYTCHK 0 unreadable", verify(scsi.Verify, 0, 8000, 200), nil, scsi.SenseMediumError, 0},
+		{"BYTCHK 1", verify(scsi.Verify, 1, 2, 2), blocks(2, 2), 0, 0},
+		{"BYTCHK 1 miscompare", verify(scsi.Verify, 1, 2, 2), changed(blocks(2, 2), 519), scsi.SenseMiscompare, 519},
+		{"BYTCHK 3", verify(scsi.Verify, 3, 4, 1), blocks(4, 1), 0, 0},
+		{"BYTCHK 3 miscompare", verify(scsi.Verify, 3, 4, 3), blocks(4, 1), scsi.SenseMiscompare, 512},
+		// Past the first piece read back, the offset is still from the first block.
+		{"BYTCHK 1 miscompare in a later piece", verify(scsi.Verify, 1, 0, 4096), changed(blocks(0, 4096), 1<<20+700),
+			scsi.SenseMiscompare, 1<<20 + 700},
+		{"BYTCHK 2", verify(scsi.Verify, 2, 4, 1), nil, scsi.SenseIllegalRequest, 0},
+	} {
+		fc, err := r.Do(tt.cdb, tt.data, 0)
+		if tt.key == 0 {
+			if err != nil || fc.Status != scsi.SamStatGood {
+				t.Errorf("%s: %v, status 0x%02x, sense % x", tt.name, err, fc.Status, fc.Sense)
+			}
+			continue
+		}
+		if err != nil || fc.Status != scsi.SamStatCheckCondition || fc.Sense[2]&0x0f != tt.key {
+			t.Errorf("%s: %v, status 0x%02x, want sense key 0x%x", tt.name, err, fc.Status, tt.key)
+			continue
+		}
+		if tt.key == scsi.SenseMiscompare {
+			if offset := binary.BigEndian.Uint32(fc.Sense[3:7]); fc.Sense[0]&0x80 == 0 || offset != tt.offset {
+				t.Errorf("%s: miscompare at %d, want %d", tt.name, offset, tt.offset)
+			}
+		}
+	}
+}
+
+// corruptRW is a memRW that reads back LBA 50 with a bit flipped in its eleventh byte.
+type corruptRW struct {
+	memRW
+}
+
+func (c *corruptRW) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.memRW.ReadAt(p, off)
+	if off <= 50*512+10 && off+int64(n) > 50*512+10 {
+		p[50*512+10-off] ^= 1
+	}
+	return n, err
+}
+
+func TestWriteVerify(t *testing.T) {
+	m := &corruptRW{memRW{b: make([]byte, 1<<20)}}
+	r := newTestRing(t, "t", ReadWriteAtCmdHandler{RW: m}, 1<<20, DeviceOptions{}, FakeRingConfig{})
+	defer r.Close()
+	data := bytes.Repeat([]byte{0xaa}, 1024)
+
+	if fc, err := r.Do(verify(scsi.WriteVerify, 1, 10, 2), data, 0); err != nil || fc.Status != scsi.SamStatGood {
+		t.Fatalf("WRITE AND VERIFY: %v, status 0x%02x", err, fc.Status)
+	}
+	if !bytes.Equal(m.b[10*512:12*512], data) {
+		t.Fatal("WRITE AND VERIFY didn't write")
+	}
+
+	// LBA 50 doesn't read back what was written.
+	fc, err := r.Do(verify(scsi.WriteVerify, 1, 49, 2), data, 0)
+	expectSense(t, "BYTCHK 1", fc, err, scsi.SenseMiscompare, scsi.AscMiscompareDuringVerifyOperation)
+	if offset := binary.BigEndian.Uint32(fc.Sense[3:7]); offset != 512+10 {
+		t.Fatalf("BYTCHK 1: miscompare at %d, want %d", offset, 512+10)
+	}
+	fc, err = r.Do(verify(scsi.WriteVerify, 0, 49, 2), data, 0)
+	expectSense(t, "BYTCHK 0", fc, err, scsi.SenseMediumError, scsi.AscMiscompareDuringVerifyOperation)
+	fc, err = r.Do(verify(scsi.WriteVerify, 3, 49, 2), data, 0)
+	expectSense(t, "BYTCHK 3", fc, err, scsi.SenseIllegalRequest, scsi.AscInvalidFieldInCdb)
+}
+
+// vpdPage fetches VPD page from INQUIRY, failing the test unless it's returned.
+func vpdPage(t *testing.T, r *FakeRing, page byte) []byte {
+	t.Helper()
+	fc, err := r.Do([]byte{scsi.Inquiry, 0x01, page, 0x01, 0, 0}, nil, 256)
+	if err != nil || fc.Status != scsi.SamStatGood {
+		t.Fatalf("VPD page 0x%02x: %v, status 0x%02x", page, err, fc.Status)
+	}
+	if fc.Data[1] != page {
+		t.Fatalf("VPD page 0x%02x came back as page 0x%02x", page, fc.Data[1])
+	}
+	return fc.Data[:4+int(binary.BigEndian.Uint16(fc.Data[2:4]))]
+}
+
+func TestEvpdInquiry(t *testing.T) {
+	r := newTestRing(t, "t", memHandler(1<<20), 1<<20, DeviceOptions{}, FakeRingConfig{})
+	defer r.Close()
+	vbd := r.Device()
+
+	if p := vpdPage(t, r, 0x00); !bytes.Equal(p[4:], []byte{0x00, 0x80, 0x83, 0xb0, 0xb1, 0xb2}) {
+		t.Errorf("supported VPD pages % x", p[4:])
+	}
+	if p := vpdPage(t, r, 0x80); string(p[4:]) != vbd.Serial() || vbd.Serial() != strings.TrimPrefix(GenerateTestWWN("t").DeviceID(), "naa.") {
+		t.Errorf("unit serial number %q, want %q", p[4:], vbd.Serial())
+	}
+
+	naa, _ := hex.DecodeString(vbd.Serial())
+	want := []struct {
+		codeSet, typ byte
+		value        []byte
+	}{
+		{0x02, 0x01, append([]byte("libtcmu "), append([]byte(vbd.Serial()), 0)...)},
+		{0x01, 0x03, naa},
+		{0x61, 0x93, naa},
+		{0x61, 0x94, []byte{0, 0, 0, 1}},
+		{0x02, 0x00, []byte("libtcmu//t\x00")},
+	}
+	p := vpdPage(t, r, 0x83)[4:]
+	for i, w := range want {
+		if len(p) < 4 || len(p) < 4+int(p[3]) {
+			t.Fatalf("designator %d: the page ends after %d bytes", i, len(p))
+		}
+		if value := p[4 : 4+p[3]]; p[0] != w.codeSet || p[1] != w.typ || !bytes.Equal(value, w.value) {
+			t.Errorf("designator %d: 0x%02x 0x%02x % x, want 0x%02x 0x%02x % x", i, p[0], p[1], value, w.codeSet, w.typ, w.value)
+		}
+		p = p[4+p[3]:]
+	}
+	if len(p) != 0 {
+		t.Errorf("%d bytes after the designators", len(p))
+	}
+
+	fc, err := r.Do([]byte{scsi.Inquiry, 0x01, 0x86, 0, 64, 0}, nil, 64)
+	expectSense(t, "VPD page 0x86", fc, err, scsi.SenseIllegalRequest, scsi.AscInvalidFieldInCdb)
+}
+
+func TestNaaDesignator(t *testing.T) {
+	for _, tt := range []struct {
+		wwn  string
+		want string
+	}{
+		{GenerateTestWWN("t").DeviceID(), strings.TrimPrefix(GenerateTestWWN("t").DeviceID(), "naa.")},
+		{"NAA.6001405ABCDEF0120011223344556677", "6001405abcdef0120011223344556677"},
+		// Anything else goes under the OpenFabrics Company ID, with its hex digits for the rest.
+		{"foo-bar-1234", "6001405fba1234000000000000000000"},
+		{"naa.7001405abcdef012", "60014057001405abcdef012000000000"},
+	} {
+		if got := hex.EncodeToString(naaDesignator(tt.wwn)); got != tt.want {
+			t.Errorf("%s: %s, want %s", tt.wwn, got, tt.want)
+		}
+	}
+}
+
+func TestBlockLimitsVPD(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		rw   ReadWriteAt
+		opts DeviceOptions
+		// b0 are the fields of the Block Limits page from byte 4 on, rotation the Block Device
+		// Characteristics page's MEDIUM ROTATION RATE and b2 bytes 5 and 6 of the Logical Block Provisioning page.
+		b0       []byte
+		rotation uint16
+		b2       [2]byte
+	}{
+		{"defaults", &memRW{b: make([]byte, 1<<20)}, DeviceOptions{},
+			[]byte{
+				0x01, 1, 0, 0, // WSNZ, MAXIMUM COMPARE AND WRITE LENGTH, OPTIMAL TRANSFER LENGTH GRANULARITY
+				0, 0, 0, 128, // MAXIMUM TRANSFER LENGTH
+				0, 0, 0, 128, // OPTIMAL TRANSFER LENGTH
+				0, 0, 0, 0, // MAXIMUM PREFETCH LENGTH
+				0, 0, 0, 0, // MAXIMUM UNMAP LBA COUNT
+				0, 0, 0, 0, // MAXIMUM UNMAP BLOCK DESCRIPTOR COUNT
+				0, 0, 0, 0, // OPTIMAL UNMAP GRANULARITY
+				0, 0, 0, 0, // UGAVALID, UNMAP GRANULARITY ALIGNMENT
+				0, 0, 0, 0, 0, 0x40, 0, 0, // MAXIMUM WRITE SAME LENGTH
+			},
+			0, [2]byte{0, 0}},
+		{"configured", &zeroUnmapRW{memRW{b: make([]byte, 1<<20)}},
+			DeviceOptions{RotationRate: ROTATION_RATE_NON_ROTATING, Provisioning: ProvisioningResource, BlockLimits: BlockLimits{
+				MaxTransferLength:                16,
+				OptimalTransferLength:            8,
+				OptimalTransferLengthGranularity: 2,
+				MaxUnmapLBACount:                 1000,
+				MaxUnmapDescriptors:              4,
+				OptimalUnmapGranularity:          8,
+				UnmapGranularityAlignment:        3,
+				MaxWriteSameLength:               64,
+				MaxCompareAndWriteLength:         2,
+			}},
+			[]byte{
+				0x01, 2, 0, 2,
+				0, 0, 0, 16,
+				0, 0, 0, 8,
+				0, 0, 0, 0,
+				0, 0, 0x03, 0xe8,
+				0, 0, 0, 4,
+				0, 0, 0, 8,
+				0x80, 0, 0, 3,
+				0, 0, 0, 0, 0, 0, 0, 64,
+			},
+			ROTATION_RATE_NON_ROTATING, [2]byte{0xe0, 0x01}},
+	} {
+		r := newTestRing(t, "t", ReadWriteAtCmdHandler{RW: tt.rw}, 1<<20, tt.opts, FakeRingConfig{})
+		if p := vpdPage(t, r, 0xb0); len(p) != 64 || !bytes.Equal(p[4:4+len(tt.b0)], tt.b0) {
+			t.Errorf("%s: Block Limits % x, want % x", tt.name, p[4:], tt.b0)
+		}
+		if p := vpdPage(t, r, 0xb1); len(p) != 64 || binary.BigEndian.Uint16(p[4:6]) != tt.rotation {
+			t.Errorf("%s: Block Device Characteristics % x, want rotation rate %d", tt.name, p[4:8], tt.rotation)
+		}
+		if p := vpdPage(t, r, 0xb2); len(p) != 8 || p[5] != tt.b2[0] || p[6] != tt.b2[1] {
+			t.Errorf("%s: Logical Block Provisioning % x, want % x", tt.name, p[4:], tt.b2)
+		}
+
+		// The limits reported are the ones enforced.
+		max := binary.BigEndian.Uint32(tt.b0[4:8])
+		if fc, err := r.Do(rw10(scsi.Read10, 0, uint16(max)), nil, int(max)*512); err != nil || fc.Status != scsi.SamStatGood {
+			t.Errorf("%s: READ of %d blocks: %v, status 0x%02x", tt.name, max, err, fc.Status)
+		}
+		fc, err := r.Do(rw10(scsi.Read10, 0, uint16(max+1)), nil, int(max+1)*512)
+		expectSense(t, tt.name+": READ past MAXIMUM TRANSFER LENGTH", fc, err, scsi.SenseIllegalRequest, scsi.AscInvalidFieldInCdb)
+		r.Close()
+	}
+}
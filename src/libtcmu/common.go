@@ -1,8 +1,12 @@
 package tcmu
 
 import (
+	"errors"
+	"fmt"
 	"github.com/Sirupsen/logrus"
+	"golang.org/x/sys/unix"
 	"io"
+	"os"
 )
 
 var (
@@ -12,4 +16,224 @@ var (
 type ReadWriteAt interface {
 	io.ReaderAt
 	io.WriterAt
+}
+
+// Syncer is an optional interface for a backend that buffers writes, as *os.File does. Sync makes everything
+// written so far durable. A backend that's neither a Syncer nor a RangeSyncer is taken to write through.
+type Syncer interface {
+	Sync() error
+}
+
+// RangeSyncer is an optional interface for a backend that can make just part of itself durable. It's used in
+// preference to Syncer where the range is known.
+type RangeSyncer interface {
+	SyncRange(offset int64, length int64) error
+}
+
+// buffersWrites reports whether backend has writes to sync, and so whether the device has a write cache.
+func buffersWrites(backend interface{}) bool {
+	switch backend.(type) {
+	case Syncer, RangeSyncer:
+		return true
+	}
+	return false
+}
+
+// handlerBuffersWrites reports whether a device with this handler has a write cache: either it's a
+// ReadWriteAtCmdHandler whose backend buffers writes, or the handler is a Syncer or RangeSyncer itself.
+func handlerBuffersWrites(h ScsiCmdHandler) bool {
+	switch h := h.(type) {
+	case ReadWriteAtCmdHandler:
+		return buffersWrites(h.RW)
+	case *ReadWriteAtCmdHandler:
+		return buffersWrites(h.RW)
+	}
+	return buffersWrites(h)
+}
+
+// WriteSamer is an optional interface for a backend that can write one block over and over more efficiently
+// than WRITE SAME writing it out in full, eg. by zeroing a range in place. count is the number of copies of
+// block to write from offset.
+type WriteSamer interface {
+	WriteSame(block []byte, offset int64, count int64) error
+}
+
+// writeSameChunk bounds the buffer writeSame fills with copies of the block when the backend isn't a WriteSamer.
+const writeSameChunk = 1024 * 1024
+
+// writeSame writes count copies of block to backend from offset.
+func writeSame(backend io.WriterAt, block []byte, offset int64, count int64) error {
+	if ws, ok := backend.(WriteSamer); ok {
+		return ws.WriteSame(block, offset, count)
+	}
+	per := int64(writeSameChunk / len(block))
+	if per < 1 {
+		per = 1
+	}
+	if per > count {
+		per = count
+	}
+	buf := make([]byte, 0, per*int64(len(block)))
+	for i := int64(0); i < per; i++ {
+		buf = append(buf, block...)
+	}
+	for count > 0 {
+		n := per
+		if n > count {
+			n = count
+		}
+		b := buf[:n*int64(len(block))]
+		if _, err := backend.WriteAt(b, offset); err != nil {
+			return err
+		}
+		offset += int64(len(b))
+		count -= n
+	}
+	return nil
+}
+
+// Unmapper is an optional interface for a backend that can deallocate blocks, for UNMAP. Unmapped blocks may
+// read back as anything until they're written again. An *os.File backend gets one that punches holes, if it's
+// a regular file on a filesystem that supports that.
+type Unmapper interface {
+	Unmap(offset int64, length int64) error
+}
+
+const (
+	// From linux/falloc.h
+	fallocFlKeepSize  = 0x01
+	fallocFlPunchHole = 0x02
+)
+
+// fileUnmapper deallocates by punching holes in a file, keeping its size.
+type fileUnmapper struct {
+	f *os.File
+}
+
+func (u fileUnmapper) Unmap(offset int64, length int64) error {
+	return unix.Fallocate(int(u.f.Fd()), fallocFlPunchHole|fallocFlKeepSize, offset, length)
+}
+
+// canPunchHoles reports whether f is a regular file holes can be punched in. It punches one past the end of
+// the file, where there's nothing to lose, since a filesystem that can't refuses before looking at the range.
+// Block devices aren't probed: their fallocate writes zeroes, which isn't worth calling thin provisioning.
+func canPunchHoles(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return false
+	}
+	err = fileUnmapper{f}.Unmap(fi.Size(), 4096)
+	if err != nil {
+		log.Infof("[canPunchHoles] %s can't be unmapped, fully provisioning: %s", f.Name(), err)
+		return false
+	}
+	return true
+}
+
+// unmapperFor returns the Unmapper for backend, if it has one. An *os.File's is only any use if
+// canPunchHoles; handlerUnmaps checks that once, when the device is created.
+func unmapperFor(backend interface{}) (Unmapper, bool) {
+	switch b := backend.(type) {
+	case Unmapper:
+		return b, true
+	case *os.File:
+		return fileUnmapper{b}, true
+	}
+	return nil, false
+}
+
+// handlerUnmaps reports whether a device with this handler supports UNMAP, and so is thin provisioned: either
+// it's a ReadWriteAtCmdHandler whose backend has an Unmapper, or the handler is an Unmapper itself.
+func handlerUnmaps(h ScsiCmdHandler) bool {
+	switch h := h.(type) {
+	case ReadWriteAtCmdHandler:
+		return backendUnmaps(h.RW)
+	case *ReadWriteAtCmdHandler:
+		return backendUnmaps(h.RW)
+	}
+	_, ok := h.(Unmapper)
+	return ok
+}
+
+func backendUnmaps(backend interface{}) bool {
+	if f, ok := backend.(*os.File); ok {
+		return canPunchHoles(f)
+	}
+	_, ok := unmapperFor(backend)
+	return ok
+}
+
+// Resizer is an optional interface for a backend that has to be told when the device is resized, eg. to grow
+// the file behind it. Resize is called before initiators see the new size, and the resize fails if it does;
+// it's called again with the old size if the new one can't be set in configfs. A device can't be resized at
+// all without one. An *os.File backend gets one that extends a regular file and checks a block device is big
+// enough.
+type Resizer interface {
+	Resize(size int64) error
+}
+
+// errResizeNotSupported is returned for resizing a device whose backend has no Resizer to check it can serve
+// the new size.
+var errResizeNotSupported = errors.New("tcmu: backend can't be resized, it isn't a Resizer")
+
+// fileResizer grows a regular file to the new size, leaving it alone when the device shrinks so that nothing
+// past the end is lost, and checks that anything else, eg. a block device, is already big enough.
+type fileResizer struct {
+	f *os.File
+}
+
+func (r fileResizer) Resize(size int64) error {
+	fi, err := r.f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Mode().IsRegular() {
+		if fi.Size() >= size {
+			return nil
+		}
+		return r.f.Truncate(size)
+	}
+	end, err := r.f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if end < size {
+		return fmt.Errorf("tcmu: %s is %d bytes, too small for %d", r.f.Name(), end, size)
+	}
+	return nil
+}
+
+// resizerFor returns the Resizer for backend, if it has one.
+func resizerFor(backend interface{}) (Resizer, bool) {
+	switch b := backend.(type) {
+	case Resizer:
+		return b, true
+	case *os.File:
+		return fileResizer{b}, true
+	}
+	return nil, false
+}
+
+// handlerResizer returns the Resizer for a device with this handler: that of a ReadWriteAtCmdHandler's
+// backend, or the handler itself.
+func handlerResizer(h ScsiCmdHandler) (Resizer, bool) {
+	switch h := h.(type) {
+	case ReadWriteAtCmdHandler:
+		return resizerFor(h.RW)
+	case *ReadWriteAtCmdHandler:
+		return resizerFor(h.RW)
+	}
+	r, ok := h.(Resizer)
+	return r, ok
+}
+
+// syncRange makes length bytes of backend from offset durable.
+func syncRange(backend interface{}, offset int64, length int64) error {
+	if s, ok := backend.(RangeSyncer); ok {
+		return s.SyncRange(offset, length)
+	}
+	if s, ok := backend.(Syncer); ok {
+		return s.Sync()
+	}
+	return nil
 }
\ No newline at end of file
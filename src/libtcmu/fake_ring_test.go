@@ -0,0 +1,611 @@
+package tcmu
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"libtcmu/scsi"
+)
+
+const (
+	// Default sizes of a FakeRing's command ring and data area.
+	FAKE_RING_CMDR_SIZE = 64 * 1024
+	FAKE_RING_DATA_SIZE = 1024 * 1024
+
+	// The kernel hands out the data area in blocks of this size.
+	fakeDataBlockSize = 4096
+)
+
+// FakeRingConfig describes the mailbox a FakeRing presents to its device.
+type FakeRingConfig struct {
+	// Size in bytes of the command ring. Defaults to FAKE_RING_CMDR_SIZE.
+	CmdrSize int
+	// Size in bytes of the data area the iovecs point into. Defaults to FAKE_RING_DATA_SIZE.
+	DataSize int
+	// OutOfOrder advertises TCMU_MAILBOX_FLAG_CAP_OOOC, as newer kernels do.
+	OutOfOrder bool
+	// ReadLen advertises TCMU_MAILBOX_FLAG_CAP_READ_LEN.
+	ReadLen bool
+	// Tmr advertises TCMU_MAILBOX_FLAG_CAP_TMR, so SubmitTmr is allowed.
+	Tmr bool
+	// Mangle, if set, is given each command entry after it's been filled in and before the head is moved
+	// past it, so that a test can corrupt it the way a broken kernel might.
+	Mangle func(ent []byte)
+}
+
+// FakeCompletion is what the device wrote back to the ring for a command submitted through a FakeRing.
+type FakeCompletion struct {
+	Status byte
+	// Sense is the sense buffer, if Status isn't scsi.SamStatGood.
+	Sense []byte
+	// Data is the data-in buffer, as the device left it, and cut to the read length if one was reported.
+	Data []byte
+	// Residual is how much of the data-in buffer the device reported it didn't transfer.
+	Residual int
+	// UnknownOp is set if the device passed the command back with TCMU_UFLAG_UNKNOWN_OP.
+	UnknownOp bool
+}
+
+// FakeRing plays the kernel's side of target_core_user for a VirBlkDev, so that a ScsiCmdHandler can be
+// driven without the module loaded. The mailbox, command ring and data area live in a plain byte slice laid
+// out the way the kernel lays out the uio mmap, and a socketpair stands in for /dev/uioN.
+type FakeRing struct {
+	sync.Mutex
+	vbd    *VirBlkDev
+	mmap   []byte
+	kernFd int
+	devFd  int
+
+	cmdrSize uint32
+	dataOff  int
+	blocks   []bool
+	head     uint32
+	tail     uint32
+	nextId   uint16
+	inflight map[uint16]*fakeCmd
+	space    *sync.Cond
+	closed   bool
+	err      error
+	reaped   chan struct{}
+	mangle   func(ent []byte)
+}
+
+type fakeCmd struct {
+	blocks []int
+	iovs   [][]byte
+	dataIn int
+	done   chan FakeCompletion
+}
+
+// NewFakeRing creates a VirBlkDev for the given ScsiHandler, attached to an in-process ring rather than to the
+// kernel, and starts it polling. Nothing is created in configfs or /dev. The ring must be closed.
+func NewFakeRing(scsi *ScsiHandler, cfg FakeRingConfig) (*FakeRing, error) {
+	r, err := NewFakeUio(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	vbd := allocVirtBlockDevice("", scsi, Roots{})
+	vbd.pipeFds = make([]int, 2)
+	if err := unix.Pipe(vbd.pipeFds); err != nil {
+		r.Close()
+		return nil, err
+	}
+	vbd.deviceName = scsi.VolumeName
+	vbd.uioFd = r.devFd
+	vbd.mmap = r.mmap
+	vbd.mapsize = uint64(len(r.mmap))
+	vbd.cmdTail = vbd.mbCmdTail()
+	if err := vbd.checkMailbox(); err != nil {
+		unix.Close(vbd.pipeFds[0])
+		unix.Close(vbd.pipeFds[1])
+		r.Close()
+		return nil, err
+	}
+	vbd.initialize = true
+	r.devFd = -1
+	r.vbd = vbd
+
+	vbd.beginPoll()
+	return r, nil
+}
+
+// NewFakeUio creates a fake ring with no device attached. UioFileSystem serves it as a uio device node, so
+// that a device can find and open it through the usual create sequence against a simulated tree.
+// The ring must be closed.
+func NewFakeUio(cfg FakeRingConfig) (*FakeRing, error) {
+	if cfg.CmdrSize == 0 {
+		cfg.CmdrSize = FAKE_RING_CMDR_SIZE
+	}
+	if cfg.DataSize == 0 {
+		cfg.DataSize = FAKE_RING_DATA_SIZE
+	}
+	if cfg.CmdrSize%entAlignSize != 0 || cfg.CmdrSize < 2*cmdEntrySize {
+		return nil, fmt.Errorf("fake ring: bad command ring size %d", cfg.CmdrSize)
+	}
+	if cfg.DataSize%fakeDataBlockSize != 0 {
+		return nil, fmt.Errorf("fake ring: data size %d is not a multiple of %d", cfg.DataSize, fakeDataBlockSize)
+	}
+
+	r := &FakeRing{
+		mmap:     make([]byte, mbSize+cfg.CmdrSize+cfg.DataSize),
+		cmdrSize: uint32(cfg.CmdrSize),
+		dataOff:  mbSize + cfg.CmdrSize,
+		blocks:   make([]bool, cfg.DataSize/fakeDataBlockSize),
+		inflight: make(map[uint16]*fakeCmd),
+		reaped:   make(chan struct{}),
+		mangle:   cfg.Mangle,
+	}
+	r.space = sync.NewCond(r)
+	byteOrder.PutUint16(r.mmap[mbOffVersion:], 2)
+	byteOrder.PutUint32(r.mmap[mbOffCmdrOff:], mbSize)
+	byteOrder.PutUint32(r.mmap[mbOffCmdrSize:], r.cmdrSize)
+	var flags uint16
+	if cfg.OutOfOrder {
+		flags |= mbFlagCapOOOC
+	}
+	if cfg.ReadLen {
+		flags |= mbFlagCapReadLen
+	}
+	if cfg.Tmr {
+		flags |= mbFlagCapTmr
+	}
+	byteOrder.PutUint16(r.mmap[mbOffFlags:], flags)
+
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, err
+	}
+	// The device end behaves like the uio fd, which is opened O_NONBLOCK.
+	if err := unix.SetNonblock(fds[0], true); err != nil {
+		unix.Close(fds[0])
+		unix.Close(fds[1])
+		return nil, err
+	}
+	r.devFd = fds[0]
+	r.kernFd = fds[1]
+
+	go r.reap()
+	return r, nil
+}
+
+// Device returns the VirBlkDev serviced by this ring, if it was created by NewFakeRing.
+func (r *FakeRing) Device() *VirBlkDev {
+	return r.vbd
+}
+
+// Size returns the size of the ring's mmap, which a simulated sysfs should report as the uio device's
+// maps/map0/size.
+func (r *FakeRing) Size() int {
+	return len(r.mmap)
+}
+
+// UioFileSystem wraps fs so that OpenUio of a device node named uio (eg, "uio0") opens this ring. The
+// simulated tree still needs the node itself and its sysfs name and map size.
+func (r *FakeRing) UioFileSystem(fs FileSystem, uio string) FileSystem {
+	return fakeUioFileSystem{FileSystem: fs, r: r, uio: uio}
+}
+
+type fakeUioFileSystem struct {
+	FileSystem
+	r   *FakeRing
+	uio string
+}
+
+func (f fakeUioFileSystem) OpenUio(name string, size int) (int, []byte, error) {
+	if filepath.Base(name) != f.uio {
+		return f.FileSystem.OpenUio(name, size)
+	}
+	f.r.Lock()
+	defer f.r.Unlock()
+	if f.r.devFd == -1 {
+		return -1, nil, &os.PathError{Op: "open", Path: name, Err: unix.EBUSY}
+	}
+	if size > len(f.r.mmap) {
+		return -1, nil, &os.PathError{Op: "mmap", Path: name, Err: unix.EINVAL}
+	}
+	fd := f.r.devFd
+	f.r.devFd = -1
+	return fd, f.r.mmap[:size], nil
+}
+
+func (f fakeUioFileSystem) CloseUio(fd int, mmap []byte) error {
+	if len(mmap) == 0 || &mmap[0] != &f.r.mmap[0] {
+		return f.FileSystem.CloseUio(fd, mmap)
+	}
+	return unix.Close(fd)
+}
+
+// Err returns the first protocol violation seen from the device, such as a completion for a cmd_id that isn't
+// in flight, or nil.
+func (r *FakeRing) Err() error {
+	r.Lock()
+	defer r.Unlock()
+	return r.err
+}
+
+// Submit queues a TCMU_OP_CMD entry for cdb and wakes the device, as the kernel would for a command from the
+// initiator. dataOut is copied into the data area for commands that send data to the device, and dataIn
+// bytes are reserved for data sent back; the larger of the two sizes the iovecs. Submit blocks while the ring
+// is full. The completion is delivered on the returned channel, which is closed without a value if the ring
+// is closed first.
+func (r *FakeRing) Submit(cdb []byte, dataOut []byte, dataIn int) (<-chan FakeCompletion, error) {
+	dataLen := len(dataOut)
+	if dataIn > dataLen {
+		dataLen = dataIn
+	}
+	nblocks := (dataLen + fakeDataBlockSize - 1) / fakeDataBlockSize
+	if nblocks > len(r.blocks) {
+		return nil, fmt.Errorf("fake ring: %d bytes of data won't fit in the data area", dataLen)
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	var blocks []int
+	var entSize uint32
+	for {
+		if r.closed {
+			return nil, errors.New("fake ring: closed")
+		}
+		blocks = r.freeBlocks(nblocks)
+		if blocks != nil {
+			entSize = cmdEntSize(countRuns(blocks), len(cdb))
+			if entSize > r.cmdrSize/2 {
+				return nil, fmt.Errorf("fake ring: entry of %d bytes won't fit in the command ring", entSize)
+			}
+			if r.cmdrFits(entSize) {
+				break
+			}
+		}
+		r.space.Wait()
+	}
+
+	id := r.allocId()
+	c := &fakeCmd{
+		blocks: blocks,
+		dataIn: dataIn,
+		done:   make(chan FakeCompletion, 1),
+	}
+	for _, b := range blocks {
+		r.blocks[b] = true
+	}
+
+	if r.head+entSize > r.cmdrSize {
+		r.putPad(r.head, r.cmdrSize-r.head)
+		r.head = 0
+	}
+	off := mbSize + int(r.head)
+	ent := r.mmap[off : off+int(entSize)]
+	for i := range ent {
+		ent[i] = 0
+	}
+	byteOrder.PutUint32(ent[offLenOp:], entSize|uint32(tcmuOpCmd))
+	byteOrder.PutUint16(ent[offCmdId:], id)
+
+	// Contiguous blocks share an iovec, as they do in the kernel.
+	for i := 0; i < len(blocks); {
+		j := i + 1
+		for j < len(blocks) && blocks[j] == blocks[j-1]+1 {
+			j++
+		}
+		start := r.dataOff + blocks[i]*fakeDataBlockSize
+		end := start + (j-i)*fakeDataBlockSize
+		if len(c.iovs) == countRuns(blocks)-1 {
+			// The last iovec only covers what's left.
+			end = start + dataLen - iovsLen(c.iovs)
+		}
+		putIovec(ent, len(c.iovs), uint64(start), uint64(end-start))
+		c.iovs = append(c.iovs, r.mmap[start:end])
+		i = j
+	}
+	byteOrder.PutUint32(ent[offReqIovCnt:], uint32(len(c.iovs)))
+
+	cdbOff := off + cmdEntBaseSize(len(c.iovs))
+	byteOrder.PutUint64(ent[offReqCdbOff:], uint64(cdbOff))
+	copy(r.mmap[cdbOff:], cdb)
+
+	left := dataOut
+	for _, iov := range c.iovs {
+		n := copy(iov, left)
+		for i := n; i < len(iov); i++ {
+			iov[i] = 0
+		}
+		left = left[n:]
+	}
+	if r.mangle != nil {
+		r.mangle(ent)
+	}
+
+	r.inflight[id] = c
+	r.head = (r.head + entSize) % r.cmdrSize
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&r.mmap[mbOffCmdHead])), r.head)
+	r.kick()
+	return c.done, nil
+}
+
+// Do submits a command and waits for its completion.
+func (r *FakeRing) Do(cdb []byte, dataOut []byte, dataIn int) (FakeCompletion, error) {
+	done, err := r.Submit(cdb, dataOut, dataIn)
+	if err != nil {
+		return FakeCompletion{}, err
+	}
+	fc, ok := <-done
+	if !ok {
+		return FakeCompletion{}, errors.New("fake ring: closed before the command completed")
+	}
+	return fc, nil
+}
+
+// SubmitTmr queues a TCMU_OP_TMR entry naming the given cmd_ids and wakes the device, as the kernel does
+// after carrying out a task management function. The commands are still expected to complete.
+func (r *FakeRing) SubmitTmr(typ TmrType, cmdIds []uint16) error {
+	r.Lock()
+	defer r.Unlock()
+
+	if byteOrder.Uint16(r.mmap[mbOffFlags:])&mbFlagCapTmr == 0 {
+		return errors.New("fake ring: TMR notifications aren't enabled")
+	}
+	entSize := uint32((offTmrCmdIds + 2*len(cmdIds) + entAlignSize - 1) &^ (entAlignSize - 1))
+	if entSize > r.cmdrSize/2 {
+		return fmt.Errorf("fake ring: TMR entry of %d bytes won't fit in the command ring", entSize)
+	}
+	for !r.cmdrFits(entSize) {
+		if r.closed {
+			return errors.New("fake ring: closed")
+		}
+		r.space.Wait()
+	}
+	if r.closed {
+		return errors.New("fake ring: closed")
+	}
+
+	if r.head+entSize > r.cmdrSize {
+		r.putPad(r.head, r.cmdrSize-r.head)
+		r.head = 0
+	}
+	off := mbSize + int(r.head)
+	ent := r.mmap[off : off+int(entSize)]
+	for i := range ent {
+		ent[i] = 0
+	}
+	byteOrder.PutUint32(ent[offLenOp:], entSize|uint32(tcmuOpTmr))
+	ent[offTmrType] = byte(typ)
+	byteOrder.PutUint32(ent[offTmrCmdCnt:], uint32(len(cmdIds)))
+	for i, id := range cmdIds {
+		byteOrder.PutUint16(ent[offTmrCmdIds+2*i:], id)
+	}
+
+	r.head = (r.head + entSize) % r.cmdrSize
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&r.mmap[mbOffCmdHead])), r.head)
+	r.kick()
+	return nil
+}
+
+// InFlight returns the cmd_ids of the commands submitted but not yet completed, eg. to name in a TMR.
+func (r *FakeRing) InFlight() []uint16 {
+	r.Lock()
+	defer r.Unlock()
+	ids := make([]uint16, 0, len(r.inflight))
+	for id := range r.inflight {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Close stops the device's poll loop and releases the ring. Commands still in flight are abandoned.
+func (r *FakeRing) Close() error {
+	r.Lock()
+	if r.closed {
+		r.Unlock()
+		return nil
+	}
+	r.closed = true
+	r.space.Broadcast()
+	r.Unlock()
+
+	if r.vbd != nil {
+		r.vbd.stopPoll()
+		select {
+		case <-r.vbd.wait:
+		case <-time.After(30 * time.Second):
+			log.Errorf("[FakeRing] vbd:%s poll loop didn't exit", r.vbd.devPath)
+		}
+		unix.Close(r.vbd.uioFd)
+		unix.Close(r.vbd.pipeFds[0])
+		unix.Close(r.vbd.pipeFds[1])
+	}
+
+	// Pick up anything completed while the device drained.
+	r.Lock()
+	r.reapCompletions()
+	r.Unlock()
+
+	unix.Shutdown(r.kernFd, unix.SHUT_RDWR)
+	<-r.reaped
+	unix.Close(r.kernFd)
+	if r.devFd != -1 {
+		unix.Close(r.devFd)
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	for id, c := range r.inflight {
+		close(c.done)
+		delete(r.inflight, id)
+	}
+	return r.err
+}
+
+// reap collects completions each time the device writes to its uio fd, the way the kernel does.
+func (r *FakeRing) reap() {
+	defer close(r.reaped)
+	buf := make([]byte, 4)
+	for {
+		n, err := unix.Read(r.kernFd, buf)
+		if err == unix.EINTR {
+			continue
+		}
+		if n <= 0 {
+			return
+		}
+		r.Lock()
+		r.reapCompletions()
+		r.Unlock()
+	}
+}
+
+func (r *FakeRing) reapCompletions() {
+	tail := atomic.LoadUint32((*uint32)(unsafe.Pointer(&r.mmap[mbOffCmdTail])))
+	for r.tail != tail {
+		off := mbSize + int(r.tail)
+		lenOp := byteOrder.Uint32(r.mmap[off+offLenOp:])
+		entLen := lenOp &^ 0x7
+		if entLen == 0 || r.tail+entLen > r.cmdrSize {
+			r.fail(fmt.Errorf("fake ring: device moved the tail to %d, past a bad entry at %d", tail, r.tail))
+			return
+		}
+		if tcmuOpcode(lenOp&0x7) == tcmuOpCmd {
+			r.complete(off)
+		}
+		r.tail = (r.tail + entLen) % r.cmdrSize
+	}
+	r.space.Broadcast()
+}
+
+func (r *FakeRing) complete(off int) {
+	id := byteOrder.Uint16(r.mmap[off+offCmdId:])
+	c, ok := r.inflight[id]
+	if !ok {
+		r.fail(fmt.Errorf("fake ring: completion for cmd_id %d, which isn't in flight", id))
+		return
+	}
+	delete(r.inflight, id)
+
+	fc := FakeCompletion{
+		Status:    r.mmap[off+offRespSCSIStatus],
+		Data:      make([]byte, c.dataIn),
+		UnknownOp: r.mmap[off+offUFlags]&uflagUnknownOp != 0,
+	}
+	if fc.Status != scsi.SamStatGood {
+		fc.Sense = make([]byte, SENSE_BUFFER_SIZE)
+		copy(fc.Sense, r.mmap[off+offRespSense:])
+	}
+	left := fc.Data
+	for _, iov := range c.iovs {
+		left = left[copy(left, iov):]
+	}
+	if r.mmap[off+offUFlags]&uflagReadLen != 0 {
+		if readLen := int(byteOrder.Uint32(r.mmap[off+offRespReadLen:])); readLen < c.dataIn {
+			fc.Residual = c.dataIn - readLen
+			fc.Data = fc.Data[:readLen]
+		}
+	}
+	for _, b := range c.blocks {
+		r.blocks[b] = false
+	}
+	c.done <- fc
+}
+
+func (r *FakeRing) fail(err error) {
+	log.Errorf("[FakeRing] %s", err)
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+func (r *FakeRing) kick() {
+	if _, err := unix.Write(r.kernFd, make([]byte, 4)); err != nil {
+		log.Errorf("[FakeRing] kick failed: %s", err)
+	}
+}
+
+func (r *FakeRing) putPad(head uint32, length uint32) {
+	off := mbSize + int(head)
+	byteOrder.PutUint32(r.mmap[off+offLenOp:], length|uint32(tcmuOpPad))
+	byteOrder.PutUint16(r.mmap[off+offCmdId:], 0)
+}
+
+// cmdrFits reports whether an entry of entSize bytes, and any padding needed to wrap to it, fits between the
+// head and the last entry the device hasn't completed yet.
+func (r *FakeRing) cmdrFits(entSize uint32) bool {
+	used := (r.head + r.cmdrSize - r.tail) % r.cmdrSize
+	need := entSize
+	if r.head+entSize > r.cmdrSize {
+		need += r.cmdrSize - r.head
+	}
+	return used+need < r.cmdrSize
+}
+
+func (r *FakeRing) freeBlocks(n int) []int {
+	out := make([]int, 0, n)
+	for i := 0; i < len(r.blocks) && len(out) < n; i++ {
+		if !r.blocks[i] {
+			out = append(out, i)
+		}
+	}
+	if len(out) < n {
+		return nil
+	}
+	return out
+}
+
+func (r *FakeRing) allocId() uint16 {
+	for {
+		r.nextId++
+		if _, ok := r.inflight[r.nextId]; r.nextId != 0 && !ok {
+			return r.nextId
+		}
+	}
+}
+
+// cmdEntBaseSize is the size of a command entry with iovCnt iovecs, before the CDB.
+func cmdEntBaseSize(iovCnt int) int {
+	size := offReqIov0Base + iovCnt*iovSize
+	if size < cmdEntrySize {
+		size = cmdEntrySize
+	}
+	return size
+}
+
+func cmdEntSize(iovCnt int, cdbLen int) uint32 {
+	size := cmdEntBaseSize(iovCnt) + cdbLen
+	return uint32((size + entAlignSize - 1) &^ (entAlignSize - 1))
+}
+
+func putIovec(ent []byte, idx int, base uint64, length uint64) {
+	off := offReqIov0Base + idx*iovSize
+	if iovSize == 16 {
+		byteOrder.PutUint64(ent[off:], base)
+		byteOrder.PutUint64(ent[off+8:], length)
+	} else {
+		byteOrder.PutUint32(ent[off:], uint32(base))
+		byteOrder.PutUint32(ent[off+4:], uint32(length))
+	}
+}
+
+func countRuns(blocks []int) int {
+	runs := 0
+	for i := range blocks {
+		if i == 0 || blocks[i] != blocks[i-1]+1 {
+			runs++
+		}
+	}
+	return runs
+}
+
+func iovsLen(iovs [][]byte) int {
+	n := 0
+	for _, iov := range iovs {
+		n += len(iov)
+	}
+	return n
+}
@@ -0,0 +1,185 @@
+package tcmu
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// FileSystem is the set of file operations the device lifecycle code performs on configfs, sysfs and devfs.
+// OSFileSystem is the real thing; tests can substitute a simulated tree.
+type FileSystem interface {
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte, perm os.FileMode) error
+	Stat(name string) (os.FileInfo, error)
+	ReadDir(dirname string) ([]os.FileInfo, error)
+	Mkdir(name string, perm os.FileMode) error
+	MkdirAll(path string, perm os.FileMode) error
+	Remove(name string) error
+	Symlink(oldname, newname string) error
+	Mknod(path string, mode uint32, dev int) error
+	// OpenUio opens the uio device node at name and maps size bytes of its first memory region.
+	OpenUio(name string, size int) (fd int, mmap []byte, err error)
+	// CloseUio unmaps and closes what OpenUio returned.
+	CloseUio(fd int, mmap []byte) error
+}
+
+// OSFileSystem implements FileSystem with the os and syscall packages.
+type OSFileSystem struct{}
+
+func (OSFileSystem) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(name)
+}
+
+func (OSFileSystem) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return ioutil.WriteFile(name, data, perm)
+}
+
+func (OSFileSystem) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (OSFileSystem) ReadDir(dirname string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(dirname)
+}
+
+func (OSFileSystem) Mkdir(name string, perm os.FileMode) error {
+	return os.Mkdir(name, perm)
+}
+
+func (OSFileSystem) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (OSFileSystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (OSFileSystem) Symlink(oldname, newname string) error {
+	return os.Symlink(oldname, newname)
+}
+
+func (OSFileSystem) Mknod(path string, mode uint32, dev int) error {
+	return syscall.Mknod(path, mode, dev)
+}
+
+func (OSFileSystem) OpenUio(name string, size int) (int, []byte, error) {
+	fd, err := syscall.Open(name, syscall.O_RDWR|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0600)
+	if err != nil {
+		return -1, nil, err
+	}
+	mmap, err := syscall.Mmap(fd, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		syscall.Close(fd)
+		return -1, nil, err
+	}
+	return fd, mmap, nil
+}
+
+func (OSFileSystem) CloseUio(fd int, mmap []byte) error {
+	if mmap != nil {
+		syscall.Munmap(mmap)
+	}
+	return syscall.Close(fd)
+}
+
+// Roots locates configfs, sysfs, devfs and procfs for the device lifecycle code, the FileSystem used to reach
+// them and the source of block device events. Zero fields take their value from DefaultRoots.
+type Roots struct {
+	ConfigFS string
+	SysFS    string
+	DevFS    string
+	ProcFS   string
+	FS       FileSystem
+	Events   DeviceEvents
+}
+
+var DefaultRoots = Roots{
+	ConfigFS: "/sys/kernel/config",
+	SysFS:    "/sys",
+	DevFS:    "/dev",
+	ProcFS:   "/proc",
+	FS:       OSFileSystem{},
+	Events:   UdevEvents{},
+}
+
+const (
+	// Paths relative to Roots.ConfigFS.
+	configUserDirFormat = "target/core/user_%d"
+	configLoopbackDir   = "target/loopback"
+)
+
+func (r Roots) withDefaults() Roots {
+	if r.ConfigFS == "" {
+		r.ConfigFS = DefaultRoots.ConfigFS
+	}
+	if r.SysFS == "" {
+		r.SysFS = DefaultRoots.SysFS
+	}
+	if r.DevFS == "" {
+		r.DevFS = DefaultRoots.DevFS
+	}
+	if r.ProcFS == "" {
+		r.ProcFS = DefaultRoots.ProcFS
+	}
+	if r.FS == nil {
+		r.FS = DefaultRoots.FS
+	}
+	if r.Events == nil {
+		r.Events = DefaultRoots.Events
+	}
+	return r
+}
+
+func (r Roots) config(elem ...string) string {
+	return filepath.Join(append([]string{r.ConfigFS}, elem...)...)
+}
+
+func (r Roots) sys(elem ...string) string {
+	return filepath.Join(append([]string{r.SysFS}, elem...)...)
+}
+
+func (r Roots) dev(elem ...string) string {
+	return filepath.Join(append([]string{r.DevFS}, elem...)...)
+}
+
+func (r Roots) proc(elem ...string) string {
+	return filepath.Join(append([]string{r.ProcFS}, elem...)...)
+}
+
+func (r Roots) userHbaDir(hba int) string {
+	return r.config(fmt.Sprintf(configUserDirFormat, hba))
+}
+
+// isTcmuDevice reports whether the block device at devnode was created by target_core_user.
+func (r Roots) isTcmuDevice(devnode string) (bool, error) {
+	buf, err := r.FS.ReadFile(r.sys("block", filepath.Base(devnode), "device", "model"))
+	if err != nil {
+		return false, err
+	}
+	return strings.Contains(string(buf), "TCMU"), nil
+}
+
+// isMounted reports whether the block device major:minor is mounted, according to the mountinfo of this
+// process's mount namespace.
+func (r Roots) isMounted(major, minor int) (bool, error) {
+	buf, err := r.FS.ReadFile(r.proc("self", "mountinfo"))
+	if err != nil {
+		return false, err
+	}
+	dev := fmt.Sprintf("%d:%d", major, minor)
+	for _, line := range strings.Split(string(buf), "\n") {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		if fields[2] == dev {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,129 @@
+package tcmu
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// FaultFileSystem wraps a FileSystem and fails any operation Fault returns an error for, so tests can
+// simulate the kernel refusing one, eg. EBUSY from rmdir on a configfs directory that's still in use.
+type FaultFileSystem struct {
+	FileSystem
+	// Fault is called with the method name ("Remove", "WriteFile", ...) and the path before each operation.
+	Fault func(op string, name string) error
+}
+
+func (f FaultFileSystem) fault(op string, name string) error {
+	if f.Fault == nil {
+		return nil
+	}
+	if err := f.Fault(op, name); err != nil {
+		return &os.PathError{Op: op, Path: name, Err: err}
+	}
+	return nil
+}
+
+func (f FaultFileSystem) ReadFile(name string) ([]byte, error) {
+	if err := f.fault("ReadFile", name); err != nil {
+		return nil, err
+	}
+	return f.FileSystem.ReadFile(name)
+}
+
+func (f FaultFileSystem) WriteFile(name string, data []byte, perm os.FileMode) error {
+	if err := f.fault("WriteFile", name); err != nil {
+		return err
+	}
+	return f.FileSystem.WriteFile(name, data, perm)
+}
+
+func (f FaultFileSystem) Stat(name string) (os.FileInfo, error) {
+	if err := f.fault("Stat", name); err != nil {
+		return nil, err
+	}
+	return f.FileSystem.Stat(name)
+}
+
+func (f FaultFileSystem) ReadDir(dirname string) ([]os.FileInfo, error) {
+	if err := f.fault("ReadDir", dirname); err != nil {
+		return nil, err
+	}
+	return f.FileSystem.ReadDir(dirname)
+}
+
+func (f FaultFileSystem) Mkdir(name string, perm os.FileMode) error {
+	if err := f.fault("Mkdir", name); err != nil {
+		return err
+	}
+	return f.FileSystem.Mkdir(name, perm)
+}
+
+func (f FaultFileSystem) MkdirAll(path string, perm os.FileMode) error {
+	if err := f.fault("MkdirAll", path); err != nil {
+		return err
+	}
+	return f.FileSystem.MkdirAll(path, perm)
+}
+
+func (f FaultFileSystem) Remove(name string) error {
+	if err := f.fault("Remove", name); err != nil {
+		return err
+	}
+	return f.FileSystem.Remove(name)
+}
+
+func (f FaultFileSystem) Symlink(oldname, newname string) error {
+	if err := f.fault("Symlink", newname); err != nil {
+		return err
+	}
+	return f.FileSystem.Symlink(oldname, newname)
+}
+
+func (f FaultFileSystem) Mknod(path string, mode uint32, dev int) error {
+	if err := f.fault("Mknod", path); err != nil {
+		return err
+	}
+	return f.FileSystem.Mknod(path, mode, dev)
+}
+
+func (f FaultFileSystem) OpenUio(name string, size int) (int, []byte, error) {
+	if err := f.fault("OpenUio", name); err != nil {
+		return -1, nil, err
+	}
+	return f.FileSystem.OpenUio(name, size)
+}
+
+func TestIsMounted(t *testing.T) {
+	dir := t.TempDir()
+	roots := Roots{ProcFS: dir}.withDefaults()
+	if err := os.MkdirAll(filepath.Join(dir, "self"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := roots.isMounted(8, 16); err == nil {
+		t.Fatal("isMounted with no mountinfo succeeded")
+	}
+
+	mountinfo := "22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw\n" +
+		"36 22 8:16 / /mnt rw,noatime shared:20 - xfs /dev/sdb rw\n" +
+		"37 22 0:42 / /proc rw - proc proc rw\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "self", "mountinfo"), []byte(mountinfo), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		major, minor int
+		mounted      bool
+	}{
+		{8, 16, true},
+		{8, 1, true},
+		{8, 0, false},
+		{8, 160, false},
+		{42, 0, false},
+	} {
+		mounted, err := roots.isMounted(tt.major, tt.minor)
+		if err != nil || mounted != tt.mounted {
+			t.Errorf("isMounted(%d, %d) = %v, %v, want %v", tt.major, tt.minor, mounted, err, tt.mounted)
+		}
+	}
+}
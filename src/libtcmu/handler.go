@@ -2,6 +2,7 @@ package tcmu
 
 import (
 	"fmt"
+	"sync"
 
 	"libtcmu/scsi"
 
@@ -96,88 +97,148 @@ func (vbd *VirBlkDev) startPoll0() {
 }
 */
 
+// indexedResponse is a response from a pool worker, tagged with the slot in cmdRing its command was given.
+type indexedResponse struct {
+	index int
+	resp  ScsiResponse
+}
+
+// startPollx is startPoll for DeviceOptions.Workers > 1: commands are handed to a pool of workers, at most
+// cmdRing.capacity of them in flight. If the kernel supports out-of-order completion, each worker completes
+// its command as soon as the handler returns; otherwise startRespx completes them on the ring in the order
+// they arrived. When the poll is stopped, commands already taken from the ring are drained before the loop
+// reports it's done.
 func (vbd *VirBlkDev) startPollx() {
 	//log.Debugf("startPollx")
 	ch := make(chan bool)
 	defer close(ch)
 
-	//go vbd.recvResponse()
-	go vbd.startRespx()
+	work := make(chan indexedCmd, vbd.cmdRing.capacity)
+	slots := make(chan struct{}, vbd.cmdRing.capacity)
+	respDone := make(chan struct{})
+	outOfOrder := vbd.mbCapOOOC()
+	workers := sync.WaitGroup{}
+	workers.Add(vbd.scsi.Options.Workers)
+	for i := 0; i < vbd.scsi.Options.Workers; i++ {
+		go func() {
+			defer workers.Done()
+			for c := range work {
+				if outOfOrder {
+					vbd.HandleRequest(c.cmd)
+					<-slots
+					continue
+				}
+				vbd.HandleRequestx(c.cmd, c.index)
+			}
+		}()
+	}
+	respStop := make(chan struct{})
+	go vbd.startRespx(slots, respStop, respDone)
 	go vbd.waitForNextCommand(ch)
+
+	// cmdDone stays open, so that a response sent after the pool has gone can't panic: once the workers have
+	// returned, startRespx is told to finish with what they left in it.
+	drain := func() {
+		close(work)
+		workers.Wait()
+		close(respStop)
+		<-respDone
+		vbd.wait <- struct{}{}
+	}
+
 	for {
 		select {
 		case success := <-ch:
 			if !success {
-				vbd.wait <- struct{}{}
+				drain()
 				return
 			}
-           // log.Debugf("11111")
 			vbd.clearUioEvents()
-			cmd, _ := vbd.getNextCommand() //never return err
+			cmd, err := vbd.getNextCommand()
+			vbd.logRingErr(err)
 			for cmd != nil {
 				//log.Debugf("head:%d tail:%d size: %d", vbd.cmdRing.head, vbd.cmdRing.tail,vbd.cmdRing.head - vbd.cmdRing.tail)
-
-				go vbd.HandleRequestx(cmd, vbd.cmdRing.head)
+				// Wait for a slot, so the queue never runs further ahead of the ring than its capacity.
+				slots <- struct{}{}
+				work <- indexedCmd{cmd: cmd, index: vbd.cmdRing.head}
 				vbd.cmdRing.head += 1
-				if vbd.cmdRing.head >= CMD_RING_SIZE {
+				if vbd.cmdRing.head >= vbd.cmdRing.capacity {
 					vbd.cmdRing.head = 0
 				}
-				cmd, _ = vbd.getNextCommand() //never return err
+				cmd, err = vbd.getNextCommand()
+				vbd.logRingErr(err)
 			}
 		case <-vbd.shut:
 			log.Infof("[startPoll] vbd:%s Exit...", vbd.devPath)
-			vbd.wait <- struct{}{}
+			drain()
 			return
 		}
 	}
 }
 
-func (vbd *VirBlkDev) HandleRequestx(cmd *ScsiCmd, index int) {
-
-	resp, _ := vbd.scsi.Handler.HandleCommand(cmd)
+// indexedCmd is a command for a pool worker, tagged with the slot in cmdRing its response goes in.
+type indexedCmd struct {
+	cmd   *ScsiCmd
+	index int
+}
 
-	vbd.cmdRing.data[index] = &resp
+func (vbd *VirBlkDev) HandleRequestx(cmd *ScsiCmd, index int) {
+	resp, err := vbd.handleCommand(cmd)
+	if err != nil {
+		log.Errorf("[HandleRequestx] vbd:%s handler error: %s", vbd.devPath, err)
+	}
 
-    vbd.cmdDone <- index
+	vbd.cmdDone <- indexedResponse{index: index, resp: resp}
 }
 
-func (vbd *VirBlkDev) startRespx() {
+// startRespx owns cmdRing.data: it holds on to each response until every command that arrived before it has
+// been completed, then writes them to the ring in order and frees their slots. It returns once stop is closed
+// and everything already in cmdDone has been completed.
+func (vbd *VirBlkDev) startRespx(slots chan struct{}, stop chan struct{}, done chan struct{}) {
 	//log.Debugf("startRespx")
+	defer close(done)
 	for {
 		select {
-		case index := <-vbd.cmdDone:
-			if vbd.cmdRing.tail == index {
-				for {
-					resp := vbd.cmdRing.data[vbd.cmdRing.tail]
-					if resp == nil {
-						break
-					}
-					buf := make([]byte, 4)
-					vbd.completeCommand(*resp) //never return err, ignore ret value
-
-					/* Tell the fd there's something new */
-					n, err := unix.Write(vbd.uioFd, buf)
-					if n == -1 && err != nil {
-						log.Errorf("[HandleRequest] write to uio error: %s", err)
-					}
-					vbd.cmdRing.data[vbd.cmdRing.tail] = nil
-					vbd.cmdRing.tail++
-					if vbd.cmdRing.tail >= CMD_RING_SIZE {
-						vbd.cmdRing.tail = 0
-					}
+		case ir := <-vbd.cmdDone:
+			vbd.collectResponse(ir, slots)
+		case <-stop:
+			for {
+				select {
+				case ir := <-vbd.cmdDone:
+					vbd.collectResponse(ir, slots)
+				default:
+					return
 				}
-
-			} else if vbd.cmdRing.tail > index {
-				//fatal error
 			}
-		case <-vbd.shut:
-			log.Infof("[startRespx] vbd:%s Exit...", vbd.devPath)
-			vbd.wait <- struct{}{}
-			return
 		}
 	}
 }
 
+func (vbd *VirBlkDev) collectResponse(ir indexedResponse, slots chan struct{}) {
+	if vbd.cmdRing.data[ir.index] != nil {
+		log.Errorf("[startRespx] vbd:%s response slot %d completed twice", vbd.devPath, ir.index)
+		return
+	}
+	resp := ir.resp
+	vbd.cmdRing.data[ir.index] = &resp
+
+	completed := false
+	for vbd.cmdRing.data[vbd.cmdRing.tail] != nil {
+		vbd.completeCommand(*vbd.cmdRing.data[vbd.cmdRing.tail]) //never return err, ignore ret value
+		vbd.cmdRing.data[vbd.cmdRing.tail] = nil
+		vbd.cmdRing.tail++
+		if vbd.cmdRing.tail >= vbd.cmdRing.capacity {
+			vbd.cmdRing.tail = 0
+		}
+		completed = true
+		<-slots
+	}
+	if completed {
+		/* Tell the fd there's something new */
+		vbd.kickUio()
+	}
+}
+
 func (vbd *VirBlkDev) startPoll() {
 	ch := make(chan bool)
 	defer close(ch)
@@ -192,12 +253,14 @@ func (vbd *VirBlkDev) startPoll() {
 			}
 
 			vbd.clearUioEvents()
-			cmd, _ := vbd.getNextCommand() //never return err
+			cmd, err := vbd.getNextCommand()
+			vbd.logRingErr(err)
 			for cmd != nil {
 				//vbd.cmdChan <- cmd
 				//go vbd.HandleRequest(cmd)
 				vbd.HandleRequest(cmd)
-				cmd, _ = vbd.getNextCommand() //never return err
+				cmd, err = vbd.getNextCommand()
+				vbd.logRingErr(err)
 			}
 		case <-vbd.shut:
 			log.Infof("[startPoll] vbd:%s Exit...", vbd.devPath)
@@ -207,11 +270,28 @@ func (vbd *VirBlkDev) startPoll() {
 	}
 }
 
-func (vbd *VirBlkDev) HandleRequest(cmd *ScsiCmd) {
-	resp, err := vbd.scsi.Handler.HandleCommand(cmd)
+// handleCommand passes cmd to the handler, unless its ring entry was malformed.
+func (vbd *VirBlkDev) handleCommand(cmd *ScsiCmd) (ScsiResponse, error) {
+	if cmd.badEntry != nil {
+		return cmd.IllegalRequest(), nil
+	}
+	if resp, ok := vbd.reportUnitAttention(cmd); ok {
+		return resp, nil
+	}
+	if resp, ok := vbd.aluaNotReady(cmd); ok {
+		return resp, nil
+	}
+	if resp, ok := vbd.reservationConflict(cmd); ok {
+		return resp, nil
+	}
+	return vbd.scsi.Handler.HandleCommand(cmd)
+}
 
-	buf := make([]byte, 4)
-	var n int
+func (vbd *VirBlkDev) HandleRequest(cmd *ScsiCmd) {
+	resp, err := vbd.handleCommand(cmd)
+	if err != nil {
+		log.Errorf("[HandleRequest] vbd:%s handler error: %s", vbd.devPath, err)
+	}
 
 	//vbd.Lock()
 	//defer vbd.Unlock()
@@ -219,9 +299,24 @@ func (vbd *VirBlkDev) HandleRequest(cmd *ScsiCmd) {
 	vbd.completeCommand(resp) //never return err, ignore ret value
 
 	/* Tell the fd there's something new */
-	n, err = unix.Write(vbd.uioFd, buf)
+	vbd.kickUio()
+}
+
+// logRingErr reports a corrupt ring the first time getNextCommand finds it. The device stops taking
+// commands from then on, but keeps polling so that it can still be closed.
+func (vbd *VirBlkDev) logRingErr(err error) {
+	if err != nil && !vbd.ringErrLogged {
+		vbd.ringErrLogged = true
+		log.Errorf("[getNextCommand] vbd:%s command ring is corrupt, no more commands will be handled: %s", vbd.devPath, err)
+	}
+}
+
+// kickUio tells the kernel there are completions on the ring.
+func (vbd *VirBlkDev) kickUio() {
+	buf := make([]byte, 4)
+	n, err := unix.Write(vbd.uioFd, buf)
 	if n == -1 && err != nil {
-		log.Errorf("[HandleRequest] write to uio error: %s", err.Error())
+		log.Errorf("[kickUio] vbd:%s write to uio error: %s", vbd.devPath, err)
 	}
 }
 
@@ -306,7 +401,13 @@ func (vbd *VirBlkDev) recvResponse() {
 }
 */
 
+// completeCommand writes resp into the entry at the mailbox tail and moves the tail past it. The entry needn't
+// be the one the command arrived in: the kernel finds the command by the cmd_id written back, which is what
+// makes out-of-order completion work.
 func (vbd *VirBlkDev) completeCommand(resp ScsiResponse) error {
+	vbd.ringLock.Lock()
+	defer vbd.ringLock.Unlock()
+
 	off := vbd.tailEntryOff()
 	for vbd.entHdrOp(off) != tcmuOpCmd {
 		vbd.mbSetTail((vbd.mbCmdTail() + uint32(vbd.entHdrGetLen(off))) % vbd.mbCmdrSize())
@@ -315,6 +416,12 @@ func (vbd *VirBlkDev) completeCommand(resp ScsiResponse) error {
 	if vbd.entCmdId(off) != resp.id {
 		vbd.setEntCmdId(off, resp.id)
 	}
+	if resp.unknownOp {
+		vbd.setEntUflagUnknownOp(off)
+	}
+	if resp.readLenSet && vbd.mbCapReadLen() {
+		vbd.setEntRespReadLen(off, resp.readLen)
+	}
 	vbd.setEntRespSCSIStatus(off, resp.status)
 	if resp.status != scsi.SamStatGood {
 		vbd.copyEntRespSenseData(off, resp.senseBuffer)
@@ -327,8 +434,20 @@ func (vbd *VirBlkDev) getNextCommand() (*ScsiCmd, error) {
 	//vbd.debugPrintMb()
 	//fmt.Printf("nextEntryOff: %d\n", vbd.nextEntryOff())
 	//fmt.Printf("headEntryOff: %d\n", vbd.headEntryOff())
-	for vbd.nextEntryOff() != vbd.headEntryOff() {
+	if vbd.ringErr != nil {
+		return nil, vbd.ringErr
+	}
+	head := vbd.mbCmdHead()
+	if head >= vbd.mbCmdrSize() || head%entAlignSize != 0 || vbd.cmdTail >= vbd.mbCmdrSize() || vbd.cmdTail%entAlignSize != 0 {
+		vbd.ringErr = fmt.Errorf("ring head %d or tail %d is outside the %d byte command ring", head, vbd.cmdTail, vbd.mbCmdrSize())
+		return nil, vbd.ringErr
+	}
+	for vbd.cmdTail != head {
 		off := vbd.nextEntryOff()
+		if err := vbd.checkEnt(off, vbd.cmdTail, head); err != nil {
+			vbd.ringErr = err
+			return nil, err
+		}
 		if vbd.entHdrOp(off) == tcmuOpPad {
 			vbd.cmdTail = (vbd.cmdTail + uint32(vbd.entHdrGetLen(off))) % vbd.mbCmdrSize()
 		} else if vbd.entHdrOp(off) == tcmuOpCmd {
@@ -337,22 +456,62 @@ func (vbd *VirBlkDev) getNextCommand() (*ScsiCmd, error) {
 				id:  vbd.entCmdId(off),
 				vbd: vbd,
 			}
-			out.cdb = vbd.entCdb(off)
-			vecs := int(vbd.entReqIovCnt(off))
-			out.vecs = make([][]byte, vecs)
-			for i := 0; i < vecs; i++ {
-				v := vbd.entIovecN(off, i)
-				out.vecs[i] = v
+			out.cdb, out.badEntry = vbd.entCdb(off)
+			if out.badEntry == nil {
+				out.vecs, out.badEntry = vbd.entIovecs(off)
+			}
+			if out.badEntry != nil {
+				log.Errorf("[getNextCommand] vbd:%s malformed command entry, cmd_id %d: %s", vbd.devPath, out.id, out.badEntry)
 			}
 			vbd.cmdTail = (vbd.cmdTail + uint32(vbd.entHdrGetLen(off))) % vbd.mbCmdrSize()
 			return out, nil
+		} else if vbd.entHdrOp(off) == tcmuOpTmr {
+			vbd.handleTmr(Tmr{
+				Type:   vbd.entTmrType(off),
+				CmdIds: vbd.entTmrCmdIds(off),
+			})
+			vbd.cmdTail = (vbd.cmdTail + uint32(vbd.entHdrGetLen(off))) % vbd.mbCmdrSize()
 		} else {
-			panic(fmt.Sprintf("unsupported command from tcmu? %d", vbd.entHdrOp(off)))
+			// Nothing to complete for an entry we don't understand; completeCommand moves the tail past it.
+			log.Warnf("[getNextCommand] vbd:%s skipping unsupported entry opcode %d", vbd.devPath, vbd.entHdrOp(off))
+			vbd.cmdTail = (vbd.cmdTail + uint32(vbd.entHdrGetLen(off))) % vbd.mbCmdrSize()
 		}
 	}
+	vbd.releaseIdleEntries()
 	return nil, nil
 }
 
+// releaseIdleEntries gives back the ring space of entries that need no completion (PAD, TMR and anything
+// unrecognised) once nothing before them is outstanding. completeCommand does it too, but only when there's
+// a command to complete.
+func (vbd *VirBlkDev) releaseIdleEntries() {
+	vbd.ringLock.Lock()
+	moved := false
+	for vbd.mbCmdTail() != vbd.cmdTail {
+		off := vbd.tailEntryOff()
+		if vbd.entHdrOp(off) == tcmuOpCmd {
+			break
+		}
+		vbd.mbSetTail((vbd.mbCmdTail() + uint32(vbd.entHdrGetLen(off))) % vbd.mbCmdrSize())
+		moved = true
+	}
+	vbd.ringLock.Unlock()
+	if moved {
+		vbd.kickUio()
+	}
+}
+
+func (vbd *VirBlkDev) handleTmr(tmr Tmr) {
+	log.Infof("[handleTmr] vbd:%s %s for cmd_ids %v", vbd.devPath, tmr.Type, tmr.CmdIds)
+	switch tmr.Type {
+	case TmrLunReset, TmrTargetWarmReset, TmrTargetColdReset:
+		vbd.reservations.resetSPC2()
+	}
+	if h, ok := vbd.scsi.Handler.(TmrHandler); ok {
+		h.HandleTmr(tmr)
+	}
+}
+
 func (vbd *VirBlkDev) printEnt(off int) {
 	for i, x := range vbd.mmap[off : off + vbd.entHdrGetLen(off)] {
 		fmt.Printf("0x%02x ", x)
@@ -0,0 +1,296 @@
+package tcmu
+
+import (
+	"bytes"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"libtcmu/scsi"
+)
+
+// slowRW is a memRW that takes up to 3ms over each read, so that commands finish out of order.
+type slowRW struct {
+	memRW
+	reads int32
+}
+
+func (s *slowRW) ReadAt(p []byte, off int64) (int, error) {
+	atomic.AddInt32(&s.reads, 1)
+	time.Sleep(time.Duration(rand.Intn(3000)) * time.Microsecond)
+	return s.memRW.ReadAt(p, off)
+}
+
+// gateHandler holds every command until the gate is closed, and counts how many it holds at once.
+type gateHandler struct {
+	gate    chan struct{}
+	held    int32
+	maxHeld int32
+	handled int32
+}
+
+func (h *gateHandler) HandleCommand(cmd *ScsiCmd) (ScsiResponse, error) {
+	n := atomic.AddInt32(&h.held, 1)
+	for {
+		max := atomic.LoadInt32(&h.maxHeld)
+		if n <= max || atomic.CompareAndSwapInt32(&h.maxHeld, max, n) {
+			break
+		}
+	}
+	<-h.gate
+	atomic.AddInt32(&h.held, -1)
+	atomic.AddInt32(&h.handled, 1)
+	return cmd.Ok(), nil
+}
+
+func (h *gateHandler) waitHeld(t *testing.T, n int32) {
+	deadline := time.Now().Add(10 * time.Second)
+	for atomic.LoadInt32(&h.held) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d commands reached the handler, want %d", atomic.LoadInt32(&h.held), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// gateRW is a memRW that holds every write until the gate is closed.
+type gateRW struct {
+	memRW
+	gate chan struct{}
+}
+
+func (g *gateRW) WriteAt(p []byte, off int64) (int, error) {
+	<-g.gate
+	return g.memRW.WriteAt(p, off)
+}
+
+// ringEntry returns the cmd_id of the command ring entry at off and the mailbox's cmd_tail, as the kernel
+// would see them.
+func (r *FakeRing) ringEntry(off uint32) (id uint16, tail uint32) {
+	r.Lock()
+	defer r.Unlock()
+	tail = atomic.LoadUint32((*uint32)(unsafe.Pointer(&r.mmap[mbOffCmdTail])))
+	return byteOrder.Uint16(r.mmap[mbSize+int(off)+offCmdId:]), tail
+}
+
+func (r *FakeRing) ringHead() uint32 {
+	r.Lock()
+	defer r.Unlock()
+	return r.head
+}
+
+// waitKicksRead waits for the device to read every kick off its uio fd. Each read is followed by taking every
+// command up to the ring's head before the poll loop looks at anything else, so the commands submitted before
+// are then taken from the ring, or about to be.
+func (r *FakeRing) waitKicksRead(t *testing.T) {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var n int32
+		if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(r.vbd.uioFd), unix.TIOCINQ, uintptr(unsafe.Pointer(&n))); errno != 0 {
+			t.Fatal(errno)
+		}
+		if n == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d bytes of kicks left unread", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestOutOfOrderCompletion(t *testing.T) {
+	for _, outOfOrder := range []bool{false, true} {
+		g := &gateRW{memRW: memRW{b: make([]byte, 1<<20)}, gate: make(chan struct{})}
+		r := newTestRing(t, "t", ReadWriteAtCmdHandler{RW: g}, 1<<20, DeviceOptions{Workers: 4}, FakeRingConfig{OutOfOrder: outOfOrder})
+
+		writeOff := r.ringHead()
+		wch, err := r.Submit(rw10(scsi.Write10, 0, 1), bytes.Repeat([]byte{1}, 512), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Completions are written over the entries at the tail, so read the cmd_ids while the WRITE holds it.
+		writeId, _ := r.ringEntry(writeOff)
+		readOff := r.ringHead()
+		rch, err := r.Submit(rw10(scsi.Read10, 8, 1), nil, 512)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readId, _ := r.ringEntry(readOff)
+
+		select {
+		case fc := <-rch:
+			if !outOfOrder {
+				t.Fatal("the READ completed ahead of the WRITE without CAP_OOOC")
+			}
+			if fc.Status != scsi.SamStatGood {
+				t.Fatalf("READ: status 0x%02x", fc.Status)
+			}
+			// The READ took the WRITE's place at the tail, which moved past that one entry.
+			if id, tail := r.ringEntry(writeOff); id != readId || tail != readOff {
+				t.Fatalf("READ completed with cmd_id %d, tail %d, want %d, %d", id, tail, readId, readOff)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if outOfOrder {
+				t.Fatal("the READ waited for the WRITE with CAP_OOOC")
+			}
+		}
+
+		close(g.gate)
+		if fc := <-wch; fc.Status != scsi.SamStatGood {
+			t.Fatalf("out of order %v: WRITE: status 0x%02x", outOfOrder, fc.Status)
+		}
+		if !outOfOrder {
+			if fc := <-rch; fc.Status != scsi.SamStatGood {
+				t.Fatalf("READ: status 0x%02x", fc.Status)
+			}
+		}
+		wantWrite, wantRead := writeId, readId
+		if outOfOrder {
+			wantWrite, wantRead = readId, writeId
+		}
+		first, _ := r.ringEntry(writeOff)
+		second, tail := r.ringEntry(readOff)
+		if first != wantWrite || second != wantRead || tail != r.ringHead() {
+			t.Fatalf("out of order %v: completed cmd_ids %d, %d, tail %d, want %d, %d, %d",
+				outOfOrder, first, second, tail, wantWrite, wantRead, r.ringHead())
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWorkerPoolCompletesEachCommandOnce(t *testing.T) {
+	for _, outOfOrder := range []bool{false, true} {
+		m := &slowRW{memRW: memRW{b: make([]byte, 1<<20)}}
+		for i := range m.b {
+			m.b[i] = byte(i / 512)
+		}
+		r := newTestRing(t, "t", ReadWriteAtCmdHandler{RW: m}, 1<<20, DeviceOptions{Workers: 8, QueueDepth: 16}, FakeRingConfig{CmdrSize: 8192, OutOfOrder: outOfOrder})
+
+		var completed int32
+		var wg sync.WaitGroup
+		for g := 0; g < 20; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 30; i++ {
+					lba := uint32(rand.Intn(2000))
+					fc, err := r.Do(rw10(scsi.Read10, lba, 1), nil, 512)
+					if err != nil || fc.Status != scsi.SamStatGood || !bytes.Equal(fc.Data, bytes.Repeat([]byte{byte(lba)}, 512)) {
+						t.Errorf("out of order %v: read of LBA %d: %v, status 0x%02x", outOfOrder, lba, err, fc.Status)
+						return
+					}
+					atomic.AddInt32(&completed, 1)
+				}
+			}()
+		}
+		wg.Wait()
+
+		// The fake ring fails on a completion for a cmd_id that isn't in flight, which is what a lost
+		// response would turn into, or one completed twice.
+		if err := r.Close(); err != nil {
+			t.Fatalf("out of order %v: %v", outOfOrder, err)
+		}
+		if completed != 600 || m.reads != 600 {
+			t.Fatalf("out of order %v: %d commands completed, %d read, want 600", outOfOrder, completed, m.reads)
+		}
+	}
+}
+
+func TestWorkerPoolQueueDepth(t *testing.T) {
+	for _, outOfOrder := range []bool{false, true} {
+		h := &gateHandler{gate: make(chan struct{})}
+		r := newTestRing(t, "t", h, 1<<20, DeviceOptions{Workers: 8, QueueDepth: 4}, FakeRingConfig{OutOfOrder: outOfOrder})
+
+		var chs []<-chan FakeCompletion
+		for i := 0; i < 12; i++ {
+			ch, err := r.Submit(testUnitReady, nil, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			chs = append(chs, ch)
+		}
+		h.waitHeld(t, 4)
+		time.Sleep(20 * time.Millisecond)
+		if max := atomic.LoadInt32(&h.maxHeld); max != 4 {
+			t.Fatalf("out of order %v: %d commands in flight at once, want the queue depth, 4", outOfOrder, max)
+		}
+
+		close(h.gate)
+		for i, ch := range chs {
+			if fc, ok := <-ch; !ok || fc.Status != scsi.SamStatGood {
+				t.Fatalf("out of order %v: command %d: completed %v, status 0x%02x", outOfOrder, i, ok, fc.Status)
+			}
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestQueueDepthFollowsRing(t *testing.T) {
+	tests := []struct {
+		queueDepth int
+		cmdrSize   int
+		want       int
+	}{
+		{0, FAKE_RING_CMDR_SIZE, CMD_RING_SIZE},
+		{4, FAKE_RING_CMDR_SIZE, 4},
+		{1024, FAKE_RING_CMDR_SIZE, FAKE_RING_CMDR_SIZE / cmdEntrySize},
+		{0, 1024, 1024 / cmdEntrySize},
+		{64, 1024, 1024 / cmdEntrySize},
+	}
+	for _, tt := range tests {
+		r := newTestRing(t, "t", &gateHandler{gate: make(chan struct{})}, 1<<20, DeviceOptions{Workers: 2, QueueDepth: tt.queueDepth}, FakeRingConfig{CmdrSize: tt.cmdrSize})
+		if got := r.Device().cmdRing.capacity; got != tt.want {
+			t.Errorf("QueueDepth %d, %d byte ring: depth %d, want %d", tt.queueDepth, tt.cmdrSize, got, tt.want)
+		}
+		r.Close()
+	}
+}
+
+func TestWorkerPoolDrainsOnClose(t *testing.T) {
+	for _, outOfOrder := range []bool{false, true} {
+		h := &gateHandler{gate: make(chan struct{})}
+		r := newTestRing(t, "t", h, 1<<20, DeviceOptions{Workers: 4, QueueDepth: 8}, FakeRingConfig{OutOfOrder: outOfOrder})
+		vbd := r.Device()
+
+		var chs []<-chan FakeCompletion
+		for i := 0; i < 6; i++ {
+			ch, err := r.Submit(testUnitReady, nil, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			chs = append(chs, ch)
+		}
+		h.waitHeld(t, 4)
+		r.waitKicksRead(t)
+
+		// Closing waits for the commands already taken from the ring, held or queued for a worker.
+		closed := make(chan error)
+		go func() { closed <- r.Close() }()
+		time.Sleep(20 * time.Millisecond)
+		close(h.gate)
+		if err := <-closed; err != nil {
+			t.Fatal(err)
+		}
+		for i, ch := range chs {
+			if fc, ok := <-ch; !ok || fc.Status != scsi.SamStatGood {
+				t.Fatalf("out of order %v: command %d: completed %v, status 0x%02x", outOfOrder, i, ok, fc.Status)
+			}
+		}
+		if h.handled != 6 {
+			t.Fatalf("out of order %v: %d commands handled, want 6", outOfOrder, h.handled)
+		}
+
+		// A response that turns up after the pool has gone is dropped rather than panicking.
+		vbd.HandleRequestx(&ScsiCmd{vbd: vbd, cdb: testUnitReady}, 0)
+	}
+}
@@ -3,13 +3,11 @@ package tcmu
 import (
 	"fmt"
 	"os"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/jochenvg/go-udev"
 	//"util/fs"
-	"io/ioutil"
 )
 
 const (
@@ -29,23 +27,91 @@ var (
 type HBA struct {
 	sync.Mutex
 	id              int
+	roots           Roots
 	devPath         string
 	lunid           int
 	module          string
 	vbdInitializing *VirBlkDev
-	devEvent        chan *udev.Device
+	devEvent        chan BlockEvent
 	vbds            map[string]*VirBlkDev
 	stopC           chan struct{}
 }
 
+// BlockEvent is the part of a udev block device event the HBA cares about.
+type BlockEvent struct {
+	Action  string
+	Devnode string
+	Major   int
+	Minor   int
+}
+
+// DeviceEvents is where an HBA hears about block devices coming and going, which is how it learns the
+// device number of the disk the kernel creates for a new device. UdevEvents is the real thing; tests can
+// substitute a source that reports the disks of a simulated tree.
+type DeviceEvents interface {
+	// Watch sends an event for each block disk added or removed until stop is closed.
+	Watch(stop <-chan struct{}, events chan<- BlockEvent)
+}
+
+// UdevEvents implements DeviceEvents with a udev netlink monitor.
+type UdevEvents struct{}
+
+func (UdevEvents) Watch(stop <-chan struct{}, events chan<- BlockEvent) {
+	defer func() {
+		if err := recover(); err != nil {
+
+		}
+	}()
+
+	u := udev.Udev{}
+	m := u.NewMonitorFromNetlink("udev")
+
+	// Add filters to monitor
+	m.FilterAddMatchSubsystemDevtype("block", "disk")
+	//m.FilterAddMatchTag("systemd")
+
+	// Start monitor goroutine and get receive channel
+	ch, _ := m.DeviceChan(stop)
+	for {
+		select {
+		case dev := <-ch:
+			// avoid strace process cause udev panic
+			if dev == nil {
+				ch, _ = m.DeviceChan(stop)
+				continue
+			}
+
+			dnum := dev.Devnum()
+			select {
+			case events <- BlockEvent{
+				Action:  dev.Action(),
+				Devnode: dev.Devnode(),
+				Major:   dnum.Major(),
+				Minor:   dnum.Minor(),
+			}:
+			case <-stop:
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
 func NewHBA(module string) (*HBA, error) {
+	return NewHBAWithRoots(module, DefaultRoots)
+}
+
+// NewHBAWithRoots is NewHBA, with configfs, sysfs and devfs reached through roots rather than DefaultRoots.
+func NewHBAWithRoots(module string, roots Roots) (*HBA, error) {
 	if hba != nil && module == hba.module {
 		return hba, nil
 	}
 
-	devPath := fmt.Sprintf("/dev/%s", module)
-	if IsDirExists(devPath) == false {
-		err := os.Mkdir(devPath, os.ModeDir)
+	roots = roots.withDefaults()
+	devPath := roots.dev(module)
+	if fi, err := roots.FS.Stat(devPath); err != nil || !fi.IsDir() {
+		err := roots.FS.Mkdir(devPath, os.ModeDir)
 		if err != nil {
 			return nil, err
 		}
@@ -53,12 +119,13 @@ func NewHBA(module string) (*HBA, error) {
 
 	hba = &HBA{
 		id:      42,
+		roots:   roots,
 		devPath: devPath,
 		lunid:   0,
 		module:  module,
 	}
 	hba.stopC = make(chan struct{})
-	hba.devEvent = make(chan *udev.Device, 32)
+	hba.devEvent = make(chan BlockEvent, 32)
 	hba.vbds = make(map[string]*VirBlkDev)
 	hba.vbdInitializing = nil
 	return hba, nil
@@ -79,10 +146,16 @@ func (h *HBA) Stop() error {
 }
 
 func (h *HBA) CreateDevice(name string, size int64, sectorSize int64, rw ReadWriteAt) (*VirBlkDev, error) {
+	return h.CreateDeviceWithOptions(name, size, sectorSize, rw, DeviceOptions{})
+}
+
+// CreateDeviceWithOptions is CreateDevice, with the device's optional settings.
+func (h *HBA) CreateDeviceWithOptions(name string, size int64, sectorSize int64, rw ReadWriteAt, opts DeviceOptions) (*VirBlkDev, error) {
 	h.Lock()
 	//defer h.Unlock()
 
 	if h.vbdInitializing != nil {
+		h.Unlock()
 		return nil, fmt.Errorf("other vbd initializing, try again")
 	}
 
@@ -93,6 +166,7 @@ func (h *HBA) CreateDevice(name string, size int64, sectorSize int64, rw ReadWri
 		WWN:        GenerateTestWWN(name),
 		DataSizes:  DataSizes{size, sectorSize},
 		Handler:    ReadWriteAtCmdHandler{RW: rw},
+		Options:    opts,
 		/*
 			DevReady: MultiThreadedDevReady(
 				ReadWriteAtCmdHandler{
@@ -104,14 +178,16 @@ func (h *HBA) CreateDevice(name string, size int64, sectorSize int64, rw ReadWri
 	}
 	//h.lunid++
 
-	completion := make(chan int)
-	go h.CreateDeviceComplete(completion)
-	vbd, err := newVirtBlockDevice(h.devPath, handler)
+	vbd, err := newVirtBlockDevice(h.devPath, handler, h.roots)
 	if err != nil {
+		h.Unlock()
 		log.Errorf("[CreateDevice] devPath:%s error:%s", h.devPath, err.Error())
-		return nil, fmt.Errorf(err.Error())
+		return nil, err
 	}
 	h.vbdInitializing = vbd
+	// The disk's add event waits in devEvent until CreateDeviceComplete, which unlocks h, picks it up.
+	completion := make(chan int)
+	go h.CreateDeviceComplete(completion)
 	result := <-completion
 	if result != SUCCESS {
 		vbd.Close()
@@ -129,22 +205,20 @@ func (h *HBA) CreateDeviceComplete(completion chan int) {
 		select {
 		case dev := <-h.devEvent:
 			//log.Infof("[CreateDeviceComplete] receive event")
-			if "add" != dev.Action() {
+			if "add" != dev.Action {
 				continue
 			}
 
-			res, err := IsTcmuDevice(dev.Devnode())
+			res, err := h.roots.isTcmuDevice(dev.Devnode)
 			if res == false || err != nil {
-				log.Errorf("[CreateDeviceComplete] udev report not tcmu device:%s, waiting", dev.Devnode())
+				log.Errorf("[CreateDeviceComplete] udev report not tcmu device:%s, waiting", dev.Devnode)
 				continue
 			}
 
 		    retry := 300
 		    for i := 0; i < retry; i++ {
 			    if h.vbdInitializing != nil {
-				    dnum := dev.Devnum()
-
-				    h.vbdInitializing.SetDeviceNumber(dnum.Major(), dnum.Minor())
+				    h.vbdInitializing.SetDeviceNumber(dev.Major, dev.Minor)
 				    err := h.vbdInitializing.GenerateDevice()
 				    h.Unlock()
 				    if err != nil {
@@ -179,54 +253,53 @@ func (h *HBA) RemoveDevice(name string) error {
 		return fmt.Errorf("get mount info error")
 	}
 
-	remove(vbd.devPath)
-	vbd.Close()
+	remove(h.roots.FS, vbd.devPath)
+	if err := vbd.Close(); err != nil {
+		// Still registered, so that removing it can be retried once whatever holds it lets go.
+		log.Errorf("[RemoveDevice] name:%s teardown error:%s", name, err.Error())
+		return err
+	}
 	delete(h.vbds, name)
 	return nil
 }
 
-func (h *HBA) monitorDeviceEvent() {
-	defer func() {
-		if err := recover(); err != nil {
+// ResizeDevice changes the size of the named device to size bytes without taking it offline. See
+// VirBlkDev.Resize.
+func (h *HBA) ResizeDevice(name string, size int64) error {
+	h.Lock()
+	vbd, exist := h.vbds[name]
+	h.Unlock()
+	if !exist {
+		return fmt.Errorf("device %s doesn't exist", name)
+	}
 
-		}
-	}()
+	if err := vbd.Resize(size); err != nil {
+		log.Errorf("[ResizeDevice] name:%s size:%d error:%s", name, size, err.Error())
+		return err
+	}
+	return nil
+}
 
+func (h *HBA) monitorDeviceEvent() {
 	log.Infof("[monitorDeviceEvent] Start Monitor Device Event")
-	u := udev.Udev{}
-	m := u.NewMonitorFromNetlink("udev")
-
-	// Add filters to monitor
-	m.FilterAddMatchSubsystemDevtype("block", "disk")
-	//m.FilterAddMatchTag("systemd")
-
-	// Create a done signal channel
-
-	// Start monitor goroutine and get receive channel
-	done := make(chan struct{})
-	ch, _ := m.DeviceChan(done)
+	events := make(chan BlockEvent)
+	go h.roots.Events.Watch(h.stopC, events)
 	for {
 		select {
-		case dev := <-ch:
-			// avoid strace process cause udev panic
-			if dev == nil {
-				ch, _ = m.DeviceChan(done)
+		case dev := <-events:
+			if "add" != dev.Action {
 				continue
 			}
 
-			if "add" != dev.Action() {
-				continue
-			}
-
-			res, err := IsTcmuDevice(dev.Devnode())
+			res, err := h.roots.isTcmuDevice(dev.Devnode)
 			if res == false || err != nil {
-				log.Errorf("[monitorDeviceEvent] udev report not tcmu device, wait for:%s", dev.Devnode())
+				log.Errorf("[monitorDeviceEvent] udev report not tcmu device, wait for:%s", dev.Devnode)
 				continue
 			}
 
-			//log.Infof("[monitorDeviceEvent] dev: %s", dev.Devnode())
+			//log.Infof("[monitorDeviceEvent] dev: %s", dev.Devnode)
 			h.devEvent <- dev
-		//log.Debugf("[monitorDeviceEvent] receive event:%s", dev.Action())
+		//log.Debugf("[monitorDeviceEvent] receive event:%s", dev.Action)
 		case <-h.stopC:
 			log.Infof("[monitorDeviceEvent] Stop Monitor Device Event")
 			return
@@ -236,12 +309,7 @@ func (h *HBA) monitorDeviceEvent() {
 }
 
 func IsTcmuDevice(bd string) (bool, error) {
-	blockdevice := strings.TrimLeft(bd, "/dev/")
-	buf, err := ioutil.ReadFile("/sys/block/" + blockdevice + "/device/model")
-	if err != nil {
-		return false, err
-	}
-	return strings.Contains(string(buf), "TCMU"), nil
+	return DefaultRoots.isTcmuDevice(bd)
 }
 
 func IsDirExists(path string) bool {
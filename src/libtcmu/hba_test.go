@@ -0,0 +1,279 @@
+package tcmu
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"libtcmu/scsi"
+)
+
+// testTreeFS is OSFileSystem over a simulated tree in a temporary directory. Directories are removed with
+// whatever the kernel would have put in them, as configfs does, and device nodes are plain files.
+type testTreeFS struct {
+	OSFileSystem
+}
+
+func (testTreeFS) Mkdir(name string, perm os.FileMode) error {
+	return os.Mkdir(name, perm|0755)
+}
+
+func (testTreeFS) Remove(name string) error {
+	if fi, err := os.Lstat(name); err == nil && fi.IsDir() {
+		return os.RemoveAll(name)
+	}
+	return os.Remove(name)
+}
+
+func (testTreeFS) Mknod(path string, mode uint32, dev int) error {
+	return ioutil.WriteFile(path, []byte(fmt.Sprintf("%d\n", dev)), 0600)
+}
+
+// testEvents is a DeviceEvents that reports whatever is sent on it.
+type testEvents chan BlockEvent
+
+func (e testEvents) Watch(stop <-chan struct{}, events chan<- BlockEvent) {
+	for {
+		select {
+		case ev := <-e:
+			select {
+			case events <- ev:
+			case <-stop:
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// testTree lays out what target_core_user and tcm_loop would create for volume vol on HBA 42: the uio device
+// served by r, and the disk sdz, 8:240, that appears once it's exported.
+func testTree(t *testing.T, r *FakeRing, vol string) Roots {
+	dir := t.TempDir()
+	roots := Roots{
+		ConfigFS: filepath.Join(dir, "config"),
+		SysFS:    filepath.Join(dir, "sys"),
+		DevFS:    filepath.Join(dir, "dev"),
+		ProcFS:   filepath.Join(dir, "proc"),
+		FS:       r.UioFileSystem(testTreeFS{}, "uio0"),
+	}
+	files := map[string]string{
+		filepath.Join(roots.DevFS, "uio0"):                                  "",
+		filepath.Join(roots.SysFS, "class/uio/uio0/name"):                   fmt.Sprintf("tcm-user/42/%s/libtcmu//%s\n", vol, vol),
+		filepath.Join(roots.SysFS, "class/uio/uio0/maps/map0/size"):         fmt.Sprintf("0x%x\n", r.Size()),
+		filepath.Join(roots.SysFS, "block/sdz/device/model"):                "TCMU device\n",
+		filepath.Join(roots.ProcFS, "self/mountinfo"):                       "22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw\n",
+		filepath.Join(roots.ConfigFS, "target/core/user_42", vol, "enable"): "",
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return roots
+}
+
+func newTestHBA(t *testing.T, roots Roots) *HBA {
+	hba = nil
+	t.Cleanup(func() { hba = nil })
+	h, err := NewHBAWithRoots("test", roots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Start()
+	return h
+}
+
+func TestHBACreateAndRemoveDevice(t *testing.T) {
+	r, err := NewFakeUio(FakeRingConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	roots := testTree(t, r, "vol")
+	events := make(testEvents, 1)
+	roots.Events = events
+	var busy int32
+	roots.FS = FaultFileSystem{FileSystem: roots.FS, Fault: func(op string, name string) error {
+		if op == "Remove" && filepath.Base(name) == "vol" && filepath.Base(filepath.Dir(name)) == "user_42" &&
+			atomic.CompareAndSwapInt32(&busy, 1, 0) {
+			return syscall.EBUSY
+		}
+		return nil
+	}}
+	h := newTestHBA(t, roots)
+	defer h.Stop()
+
+	// Without the disk's add event, CreateDevice would wait for it until it timed out.
+	events <- BlockEvent{Action: "add", Devnode: "/dev/sdz", Major: 8, Minor: 240}
+	m := &memRW{b: make([]byte, 1<<20)}
+	vbd, err := h.CreateDevice("vol", 1<<20, 512, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := filepath.Join(roots.DevFS, "test", "vol")
+	if b, err := ioutil.ReadFile(node); err != nil || string(b) != fmt.Sprintf("%d\n", 8<<8|240) {
+		t.Fatalf("device node %s: %q, %v", node, b, err)
+	}
+	lun := filepath.Join(roots.ConfigFS, "target/loopback", vbd.scsi.WWN.DeviceID(), "tpgt_1/lun/lun_0/vol")
+	if dst, err := os.Readlink(lun); err != nil || dst != filepath.Join(roots.ConfigFS, "target/core/user_42/vol") {
+		t.Fatalf("lun link %s: %q, %v", lun, dst, err)
+	}
+
+	r.Do(testUnitReady, nil, 0)
+	data := bytes.Repeat([]byte{0x5a}, 512)
+	if fc, err := r.Do(rw10(scsi.Write10, 3, 1), data, 0); err != nil || fc.Status != scsi.SamStatGood {
+		t.Fatalf("write: %v, status 0x%02x", err, fc.Status)
+	}
+	if !bytes.Equal(m.b[3*512:4*512], data) {
+		t.Fatal("write didn't reach the backend")
+	}
+
+	// A mounted disk can't be removed.
+	mountinfo := filepath.Join(roots.ProcFS, "self/mountinfo")
+	if err := ioutil.WriteFile(mountinfo, []byte("36 22 8:240 / /mnt rw - xfs /dev/sdz rw\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !vbd.IsBusy() {
+		t.Fatal("mounted device isn't busy")
+	}
+	if err := h.RemoveDevice("vol"); err == nil {
+		t.Fatal("removed a mounted device")
+	}
+	if _, ok := h.vbds["vol"]; !ok {
+		t.Fatal("mounted device was unregistered")
+	}
+	if err := ioutil.WriteFile(mountinfo, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nor can one configfs won't let go of yet, but it stays registered for another try.
+	atomic.StoreInt32(&busy, 1)
+	if err := h.RemoveDevice("vol"); err == nil {
+		t.Fatal("RemoveDevice ignored EBUSY from configfs")
+	}
+	if _, ok := h.vbds["vol"]; !ok {
+		t.Fatal("device was unregistered after a failed teardown")
+	}
+	if fc, err := r.Do(testUnitReady, nil, 0); err != nil || fc.Status != scsi.SamStatGood {
+		t.Fatalf("after a failed teardown: %v, status 0x%02x", err, fc.Status)
+	}
+
+	if err := h.RemoveDevice("vol"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := h.vbds["vol"]; ok {
+		t.Fatal("device is still registered")
+	}
+	for _, p := range []string{
+		node,
+		filepath.Join(roots.ConfigFS, "target/core/user_42/vol"),
+		filepath.Join(roots.ConfigFS, "target/loopback", vbd.scsi.WWN.DeviceID()),
+	} {
+		if _, err := os.Lstat(p); !os.IsNotExist(err) {
+			t.Errorf("%s is still there: %v", p, err)
+		}
+	}
+}
+
+func TestHBAIgnoresOtherDisks(t *testing.T) {
+	r, err := NewFakeUio(FakeRingConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	roots := testTree(t, r, "vol")
+	if err := os.MkdirAll(filepath.Join(roots.SysFS, "block/sdy/device"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(roots.SysFS, "block/sdy/device/model"), []byte("Virtual disk\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	events := make(testEvents, 3)
+	roots.Events = events
+	h := newTestHBA(t, roots)
+	defer h.Stop()
+
+	// Only the add of a disk target_core_user made gives the device its number.
+	events <- BlockEvent{Action: "add", Devnode: "/dev/sdy", Major: 8, Minor: 224}
+	events <- BlockEvent{Action: "remove", Devnode: "/dev/sdz", Major: 8, Minor: 240}
+	events <- BlockEvent{Action: "add", Devnode: "/dev/sdz", Major: 8, Minor: 240}
+	vbd, err := h.CreateDevice("vol", 1<<20, 512, &memRW{b: make([]byte, 1<<20)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vbd.major != 8 || vbd.minor != 240 {
+		t.Fatalf("device number %d:%d, want 8:240", vbd.major, vbd.minor)
+	}
+}
+
+func TestHBACreateDeviceFailure(t *testing.T) {
+	r, err := NewFakeUio(FakeRingConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	roots := testTree(t, r, "vol")
+	events := make(testEvents, 1)
+	roots.Events = events
+	h := newTestHBA(t, roots)
+	defer h.Stop()
+
+	// There's no uio device for "other", and the failure mustn't leave the HBA locked for the next device.
+	if _, err := h.CreateDevice("other", 1<<20, 512, &memRW{b: make([]byte, 1<<20)}); err == nil {
+		t.Fatal("created a device with no uio device")
+	}
+	events <- BlockEvent{Action: "add", Devnode: "/dev/sdz", Major: 8, Minor: 240}
+	if _, err := h.CreateDevice("vol", 1<<20, 512, &memRW{b: make([]byte, 1<<20)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHBAEmulateReservations(t *testing.T) {
+	r, err := NewFakeUio(FakeRingConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	roots := testTree(t, r, "vol")
+	events := make(testEvents, 1)
+	roots.Events = events
+	// Like configfs, give the device its attributes as it's configured, but only if the kernel has emulate_pr.
+	attr := filepath.Join(roots.ConfigFS, "target/core/user_42/vol/attrib/emulate_pr")
+	var hasEmulatePR bool
+	roots.FS = FaultFileSystem{FileSystem: roots.FS, Fault: func(op string, name string) error {
+		if op != "WriteFile" || filepath.Base(name) != "control" || !hasEmulatePR {
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(attr), 0755); err != nil {
+			return err
+		}
+		return ioutil.WriteFile(attr, []byte("1\n"), 0644)
+	}}
+	h := newTestHBA(t, roots)
+	defer h.Stop()
+	opts := DeviceOptions{EmulateReservations: true}
+
+	// target_core would go on handling the reservations itself.
+	if _, err := h.CreateDeviceWithOptions("vol", 1<<20, 512, &memRW{b: make([]byte, 1<<20)}, opts); err == nil {
+		t.Fatal("created a device emulating reservations without emulate_pr")
+	}
+
+	hasEmulatePR = true
+	events <- BlockEvent{Action: "add", Devnode: "/dev/sdz", Major: 8, Minor: 240}
+	if _, err := h.CreateDeviceWithOptions("vol", 1<<20, 512, &memRW{b: make([]byte, 1<<20)}, opts); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(attr); err != nil || string(b) != "0\n" {
+		t.Fatalf("emulate_pr: %q, %v, want 0", b, err)
+	}
+}
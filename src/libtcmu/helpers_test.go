@@ -0,0 +1,86 @@
+package tcmu
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"testing"
+
+	"libtcmu/scsi"
+)
+
+// memRW is a ReadWriteAt backed by a byte slice.
+type memRW struct {
+	sync.Mutex
+	b []byte
+}
+
+func (m *memRW) ReadAt(p []byte, off int64) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+	if off >= int64(len(m.b)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.b[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *memRW) WriteAt(p []byte, off int64) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+	if off >= int64(len(m.b)) {
+		return 0, io.ErrShortWrite
+	}
+	return copy(m.b[off:], p), nil
+}
+
+// memHandler serves a zeroed in-memory volume of size bytes.
+func memHandler(size int64) ScsiCmdHandler {
+	return ReadWriteAtCmdHandler{RW: &memRW{b: make([]byte, size)}}
+}
+
+// newTestRing creates the volume vol of size bytes in 512 byte blocks with opts, served by h on a fake ring,
+// with its power-on unit attention already cleared.
+func newTestRing(t *testing.T, vol string, h ScsiCmdHandler, size int64, opts DeviceOptions, cfg FakeRingConfig) *FakeRing {
+	sh := &ScsiHandler{VolumeName: vol, DataSizes: DataSizes{size, 512}, WWN: GenerateTestWWN(vol), Handler: h, Options: opts}
+	r, err := readyFakeRing(sh, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// readyFakeRing creates a fake ring and clears the power-on unit attention.
+func readyFakeRing(sh *ScsiHandler, cfg FakeRingConfig) (*FakeRing, error) {
+	r, err := NewFakeRing(sh, cfg)
+	if err != nil {
+		return nil, err
+	}
+	r.Do([]byte{0, 0, 0, 0, 0, 0}, nil, 0)
+	return r, nil
+}
+
+// expectSense fails the test unless the command completed with CHECK CONDITION and the given sense.
+func expectSense(t *testing.T, what string, fc FakeCompletion, err error, key byte, asc uint16) {
+	t.Helper()
+	if err != nil || fc.Status != scsi.SamStatCheckCondition || fc.Sense[2]&0x0f != key ||
+		uint16(fc.Sense[12])<<8|uint16(fc.Sense[13]) != asc {
+		sense := fc.Sense
+		if len(sense) > 14 {
+			sense = sense[:14]
+		}
+		t.Fatalf("%s: %v, status 0x%02x, sense % x, want key 0x%x ASC 0x%04x", what, err, fc.Status, sense, key, asc)
+	}
+}
+
+// rw10 builds a 10 byte READ or WRITE CDB.
+func rw10(op byte, lba uint32, n uint16) []byte {
+	c := make([]byte, 10)
+	c[0] = op
+	binary.BigEndian.PutUint32(c[2:], lba)
+	binary.BigEndian.PutUint16(c[7:], n)
+	return c
+}
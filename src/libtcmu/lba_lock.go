@@ -0,0 +1,56 @@
+package tcmu
+
+import (
+	"sync"
+)
+
+// lbaRangeLock serializes commands that modify overlapping ranges of blocks, so that COMPARE AND WRITE is
+// atomic against writes handled concurrently by other workers. The zero value is unlocked.
+type lbaRangeLock struct {
+	mu   sync.Mutex
+	held []*lbaRange
+}
+
+type lbaRange struct {
+	start, end uint64
+	// done is closed when the range is released.
+	done chan struct{}
+}
+
+// lock waits until no held range overlaps the count blocks from lba, then holds them until the returned
+// function is called.
+func (l *lbaRangeLock) lock(lba uint64, count uint64) (unlock func()) {
+	r := &lbaRange{start: lba, end: lba + count, done: make(chan struct{})}
+	for {
+		l.mu.Lock()
+		busy := l.overlapping(r)
+		if busy == nil {
+			l.held = append(l.held, r)
+			l.mu.Unlock()
+			return func() { l.release(r) }
+		}
+		l.mu.Unlock()
+		<-busy.done
+	}
+}
+
+func (l *lbaRangeLock) overlapping(r *lbaRange) *lbaRange {
+	for _, h := range l.held {
+		if r.start < h.end && h.start < r.end {
+			return h
+		}
+	}
+	return nil
+}
+
+func (l *lbaRangeLock) release(r *lbaRange) {
+	l.mu.Lock()
+	for i, h := range l.held {
+		if h == r {
+			l.held = append(l.held[:i], l.held[i+1:]...)
+			break
+		}
+	}
+	l.mu.Unlock()
+	close(r.done)
+}
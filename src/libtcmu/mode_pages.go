@@ -0,0 +1,351 @@
+package tcmu
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Page control values from the PC field of MODE SENSE.
+const (
+	modePCCurrent    = 0
+	modePCChangeable = 1
+	modePCDefault    = 2
+	modePCSaved      = 3
+)
+
+const (
+	modePageAll    = 0x3f
+	modeSubpageAll = 0xff
+
+	// modePageSPF is set in the first byte of a page in subpage format.
+	modePageSPF = 0x40
+	// modePagePS is set in the first byte of a page by MODE SENSE if it can be saved.
+	modePagePS = 0x80
+)
+
+var (
+	errModePageUnknown      = errors.New("tcmu: unsupported mode page")
+	errModePageInvalid      = errors.New("tcmu: mode page sets a field that can't be changed")
+	errModePageLength       = errors.New("tcmu: mode parameter list is cut short")
+	errModeSaveNotSupported = errors.New("tcmu: mode pages can't be saved without a StateDir")
+)
+
+// modePage is one mode page or subpage the device supports: the value it starts with and the bits MODE SELECT
+// may change. Both include the page header.
+type modePage struct {
+	code       byte
+	subpage    byte
+	def        []byte
+	changeable []byte
+}
+
+func (p modePage) key() string {
+	if p.subpage == 0 {
+		return fmt.Sprintf("%02x", p.code)
+	}
+	return fmt.Sprintf("%02x.%02x", p.code, p.subpage)
+}
+
+// defaultModePages are the pages every device supports, in the order MODE SENSE reports them. wce is whether
+// the backend buffers writes, and so has a write cache to enable and disable.
+func defaultModePages(wce bool) []modePage {
+	caching := cachingModePage(wce)
+
+	control := modePage{code: 0x0a, def: make([]byte, 12), changeable: make([]byte, 12)}
+	control.def[0] = 0x0a
+	control.def[1] = 0x0a
+	control.def[3] = 0x10 // QUEUE ALGORITHM MODIFIER: unrestricted reordering
+	control.def[8] = 0xff // BUSY TIMEOUT PERIOD: unlimited
+	control.def[9] = 0xff
+	control.changeable[2] = 0x04 // D_SENSE
+
+	controlExt := modePage{code: 0x0a, subpage: 0x01, def: make([]byte, 32), changeable: make([]byte, 32)}
+	controlExt.def[0] = 0x0a | modePageSPF
+	controlExt.def[1] = 0x01
+	controlExt.def[3] = 0x1c
+
+	recovery := modePage{code: 0x01, def: make([]byte, 12), changeable: make([]byte, 12)}
+	recovery.def[0] = 0x01
+	recovery.def[1] = 0x0a
+
+	exceptions := modePage{code: 0x1c, def: make([]byte, 12), changeable: make([]byte, 12)}
+	exceptions.def[0] = 0x1c
+	exceptions.def[1] = 0x0a
+	exceptions.def[2] = 0x08                             // DEXCPT: nothing is reported
+	exceptions.changeable[2] = 0x80 | 0x10 | 0x08 | 0x01 // PERF, EWASC, DEXCPT, LOGERR
+	exceptions.changeable[3] = 0x0f                      // MRIE
+	for i := 4; i < 12; i++ {
+		exceptions.changeable[i] = 0xff // INTERVAL TIMER, REPORT COUNT
+	}
+
+	return []modePage{recovery, caching, control, controlExt, exceptions}
+}
+
+// cachingModePage is the Caching mode page, whose WCE bit starts set and can be changed if wce is set.
+func cachingModePage(wce bool) modePage {
+	caching := modePage{code: 0x08, def: make([]byte, 20), changeable: make([]byte, 20)}
+	caching.def[0] = 0x08
+	caching.def[1] = 0x12
+	caching.changeable[2] = 0x01 // RCD, which is only reported
+	if wce {
+		caching.def[2] = 0x04 // WCE
+		caching.changeable[2] |= 0x04
+	}
+	return caching
+}
+
+// modePages holds a device's current and saved mode page values. Saved values are kept in a file under
+// DeviceOptions.StateDir, and become the current ones when the device is next created.
+type modePages struct {
+	sync.Mutex
+	pages   []modePage
+	current map[string][]byte
+	saved   map[string][]byte
+	// path is the file saved pages are kept in, or "" if they can't be saved.
+	path string
+}
+
+func newModePages(wce bool, stateDir string, volume string) *modePages {
+	m := &modePages{
+		pages:   defaultModePages(wce),
+		current: make(map[string][]byte),
+	}
+	for _, p := range m.pages {
+		m.current[p.key()] = append([]byte(nil), p.def...)
+	}
+	if stateDir == "" {
+		return m
+	}
+	m.path = filepath.Join(stateDir, volume+".modepages")
+	m.saved = make(map[string][]byte)
+	if err := m.load(); err != nil && !os.IsNotExist(err) {
+		log.Warnf("[newModePages] ignoring saved mode pages in %s: %v", m.path, err)
+	}
+	return m
+}
+
+// load reads the saved pages, which also become current. Anything no longer changeable, or no longer
+// the right length, is dropped back to its default.
+func (m *modePages) load() error {
+	buf, err := ioutil.ReadFile(m.path)
+	if err != nil {
+		return err
+	}
+	var saved map[string][]byte
+	if err := json.Unmarshal(buf, &saved); err != nil {
+		return err
+	}
+	for _, p := range m.pages {
+		b, ok := saved[p.key()]
+		if !ok || len(b) != len(p.def) {
+			continue
+		}
+		v := append([]byte(nil), p.def...)
+		for i := 2; i < len(v); i++ {
+			v[i] = v[i]&^p.changeable[i] | b[i]&p.changeable[i]
+		}
+		m.saved[p.key()] = v
+		m.current[p.key()] = append([]byte(nil), v...)
+	}
+	return nil
+}
+
+func (m *modePages) store() error {
+	return writeJSONFile(m.path, m.saved)
+}
+
+// writeJSONFile replaces the file at path with v in JSON, through a temporary file renamed over it so that a
+// crash leaves either the old state or the new.
+func writeJSONFile(path string, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (m *modePages) find(code, subpage byte) (modePage, bool) {
+	for _, p := range m.pages {
+		if p.code == code && p.subpage == subpage {
+			return p, true
+		}
+	}
+	return modePage{}, false
+}
+
+// sense returns the pages MODE SENSE asks for with the given page control, page code and subpage code, one
+// after another. Page code 0x3f is all pages, and subpage code 0xff all subpages.
+func (m *modePages) sense(pc, code, subpage byte) ([]byte, error) {
+	m.Lock()
+	defer m.Unlock()
+	if pc == modePCSaved && m.path == "" {
+		return nil, errModeSaveNotSupported
+	}
+	var out []byte
+	for _, p := range m.pages {
+		if code != modePageAll && p.code != code {
+			continue
+		}
+		if subpage != modeSubpageAll && p.subpage != subpage {
+			continue
+		}
+		var v []byte
+		switch pc {
+		case modePCCurrent:
+			v = m.current[p.key()]
+		case modePCChangeable:
+			v = append([]byte(nil), p.changeable...)
+			copy(v[:2], p.def[:2])
+			if p.subpage != 0 {
+				copy(v[:4], p.def[:4])
+			}
+		case modePCDefault:
+			v = p.def
+		case modePCSaved:
+			var ok bool
+			if v, ok = m.saved[p.key()]; !ok {
+				v = p.def
+			}
+		}
+		start := len(out)
+		out = append(out, v...)
+		if m.path != "" {
+			out[start] |= modePagePS
+		}
+	}
+	if out == nil {
+		return nil, errModePageUnknown
+	}
+	return out, nil
+}
+
+// sel checks the pages in a MODE SELECT parameter list, after the header and block descriptors, and if all of
+// them are acceptable makes them current, and saved too if save is set. changed is whether any current value
+// is now different. If a page is refused, field is the offset into params of the byte at fault.
+func (m *modePages) sel(params []byte, save bool) (changed bool, field int, err error) {
+	m.Lock()
+	defer m.Unlock()
+	if save && m.path == "" {
+		return false, 0, errModeSaveNotSupported
+	}
+
+	updates := make(map[string][]byte)
+	for off := 0; off < len(params); {
+		page := params[off:]
+		if len(page) < 2 {
+			return false, off, errModePageLength
+		}
+		if page[0]&modePagePS != 0 {
+			// PS is reserved in MODE SELECT.
+			return false, off, errModePageInvalid
+		}
+		code := page[0] & 0x3f
+		var subpage byte
+		n := int(page[1]) + 2
+		if page[0]&modePageSPF != 0 {
+			if len(page) < 4 {
+				return false, off, errModePageLength
+			}
+			subpage = page[1]
+			n = (int(page[2])<<8 | int(page[3])) + 4
+		}
+		if len(page) < n {
+			return false, off, errModePageLength
+		}
+		p, ok := m.find(code, subpage)
+		if !ok {
+			return false, off, errModePageUnknown
+		}
+		if n != len(p.def) {
+			return false, off + 1, errModePageUnknown
+		}
+		cur := m.current[p.key()]
+		v := append([]byte(nil), cur...)
+		for i := 2; i < n; i++ {
+			if p.subpage != 0 && i < 4 {
+				continue
+			}
+			if (page[i]^cur[i])&^p.changeable[i] != 0 {
+				return false, off + i, errModePageInvalid
+			}
+			v[i] = page[i]
+		}
+		updates[p.key()] = v
+		off += n
+	}
+
+	for k, v := range updates {
+		if !bytes.Equal(m.current[k], v) {
+			changed = true
+		}
+		m.current[k] = v
+	}
+	if save {
+		for k, v := range updates {
+			m.saved[k] = append([]byte(nil), v...)
+		}
+		if err := m.store(); err != nil {
+			return changed, 0, err
+		}
+	}
+	return changed, 0, nil
+}
+
+// seedWCE makes the WCE bit of the Caching mode page wce, by default and currently, and stops MODE SELECT
+// changing it. It's for handlers that keep track of their own write cache and say whether it's enabled each
+// time they call EmulateModeSense or EmulateModeSelect.
+func (m *modePages) seedWCE(wce bool) {
+	m.Lock()
+	defer m.Unlock()
+	p, ok := m.find(0x08, 0)
+	if !ok {
+		return
+	}
+	var bit byte
+	if wce {
+		bit = 0x04
+	}
+	p.def[2] = p.def[2]&^0x04 | bit
+	p.changeable[2] &^= 0x04
+	for _, vals := range []map[string][]byte{m.current, m.saved} {
+		if v, ok := vals[p.key()]; ok {
+			v[2] = v[2]&^0x04 | bit
+		}
+	}
+}
+
+// bit reports whether any of the bits in mask are set in byte i of the current value of a page.
+func (m *modePages) bit(code, subpage byte, i int, mask byte) bool {
+	if m == nil {
+		return false
+	}
+	m.Lock()
+	defer m.Unlock()
+	p, ok := m.find(code, subpage)
+	if !ok {
+		return false
+	}
+	return m.current[p.key()][i]&mask != 0
+}
+
+// WriteCacheEnabled reports whether the WCE bit of the Caching mode page is set. While it isn't, writes are
+// made durable before they complete, as if they all had FUA set.
+func (vbd *VirBlkDev) WriteCacheEnabled() bool {
+	return vbd.modePages.bit(0x08, 0, 2, 0x04)
+}
+
+// DescriptorSense reports whether the D_SENSE bit of the Control mode page is set, asking for sense data
+// in descriptor format.
+func (vbd *VirBlkDev) DescriptorSense() bool {
+	return vbd.modePages.bit(0x0a, 0, 2, 0x04)
+}
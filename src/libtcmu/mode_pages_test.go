@@ -0,0 +1,167 @@
+package tcmu
+
+import (
+	"bytes"
+	"testing"
+
+	"libtcmu/scsi"
+)
+
+// syncCount is a memRW with a write cache, counting how often it's flushed.
+type syncCount struct {
+	memRW
+	syncs int
+}
+
+func (s *syncCount) Sync() error {
+	s.syncs++
+	return nil
+}
+
+// cachingSelect is a MODE SELECT(6) parameter list with a block descriptor for 512 byte blocks and the
+// Caching mode page with the given third byte.
+func cachingSelect(b2 byte) []byte {
+	p := make([]byte, 4+8+20)
+	p[3] = 8
+	p[4+6] = 2
+	p[12] = 0x08
+	p[13] = 0x12
+	p[14] = b2
+	return p
+}
+
+func modeSelect6(sp bool, params []byte) []byte {
+	c := []byte{scsi.ModeSelect, 0x10, 0, 0, byte(len(params)), 0}
+	if sp {
+		c[1] |= 0x01
+	}
+	return c
+}
+
+func TestModeSelectSavesPages(t *testing.T) {
+	dir := t.TempDir()
+	m := &syncCount{memRW: memRW{b: make([]byte, 1<<20)}}
+	r := newTestRing(t, "t", ReadWriteAtCmdHandler{RW: m}, 1<<20, DeviceOptions{StateDir: dir}, FakeRingConfig{})
+
+	// With the write cache on, writes aren't flushed.
+	r.Do(rw10(scsi.Write10, 0, 1), make([]byte, 512), 0)
+	if m.syncs != 0 {
+		t.Fatalf("%d syncs with WCE set", m.syncs)
+	}
+	p := cachingSelect(0)
+	if fc, err := r.Do(modeSelect6(true, p), p, 0); err != nil || fc.Status != scsi.SamStatGood {
+		t.Fatalf("MODE SELECT clearing WCE: %v, status 0x%02x", err, fc.Status)
+	}
+	fc, err := r.Do(testUnitReady, nil, 0)
+	expectSense(t, "after MODE SELECT", fc, err, scsi.SenseUnitAttention, scsi.AscModeParametersChanged)
+	// Selecting the same values again changes nothing, so there's nothing to report.
+	if fc, err := r.Do(modeSelect6(false, p), p, 0); err != nil || fc.Status != scsi.SamStatGood {
+		t.Fatalf("MODE SELECT again: %v, status 0x%02x", err, fc.Status)
+	}
+	r.Do(rw10(scsi.Write10, 0, 1), make([]byte, 512), 0)
+	if m.syncs != 1 {
+		t.Fatalf("%d syncs with WCE clear, want 1", m.syncs)
+	}
+
+	// Saved pages are current again the next time the device is created.
+	r.Close()
+	r = newTestRing(t, "t", ReadWriteAtCmdHandler{RW: m}, 1<<20, DeviceOptions{StateDir: dir}, FakeRingConfig{})
+	defer r.Close()
+	if r.Device().WriteCacheEnabled() {
+		t.Fatal("the saved WCE wasn't loaded")
+	}
+	fc, err = r.Do([]byte{scsi.ModeSense, 0x08, 0xc8, 0, 64, 0}, nil, 64)
+	if err != nil || fc.Status != scsi.SamStatGood {
+		t.Fatalf("MODE SENSE saved values: %v, status 0x%02x", err, fc.Status)
+	}
+	if want := append([]byte{0x88, 0x12}, make([]byte, 18)...); !bytes.Equal(fc.Data[4:24], want) {
+		t.Fatalf("saved Caching page % x, want % x", fc.Data[4:24], want)
+	}
+}
+
+func TestModeSelectRefused(t *testing.T) {
+	m := &syncCount{memRW: memRW{b: make([]byte, 1<<20)}}
+	r := newTestRing(t, "t", ReadWriteAtCmdHandler{RW: m}, 1<<20, DeviceOptions{}, FakeRingConfig{})
+	defer r.Close()
+
+	tests := []struct {
+		name   string
+		sp     bool
+		params []byte
+		asc    byte
+		field  int
+	}{
+		{"unchangeable bit", false, cachingSelect(0x06), 0x26, 14},
+		{"PS set", false, func() []byte { p := cachingSelect(0x04); p[12] |= 0x80; return p }(), 0x26, 12},
+		{"other block size", false, func() []byte { p := cachingSelect(0x04); p[4+6] = 4; return p }(), 0x26, 9},
+		{"unknown page", false, func() []byte { p := cachingSelect(0x04); p[12] = 0x07; return p }(), 0x26, 12},
+		{"save without a StateDir", true, cachingSelect(0), 0x39, -1},
+	}
+	for _, tt := range tests {
+		fc, err := r.Do(modeSelect6(tt.sp, tt.params), tt.params, 0)
+		if err != nil || fc.Status != scsi.SamStatCheckCondition || fc.Sense[12] != tt.asc {
+			t.Errorf("%s: %v, status 0x%02x, ASC 0x%02x, want 0x%02x", tt.name, err, fc.Status, fc.Sense[12], tt.asc)
+			continue
+		}
+		if tt.field >= 0 && (fc.Sense[15]&0x80 == 0 || int(fc.Sense[16])<<8|int(fc.Sense[17]) != tt.field) {
+			t.Errorf("%s: field pointer % x, want byte %d", tt.name, fc.Sense[15:18], tt.field)
+		}
+		if !r.Device().WriteCacheEnabled() {
+			t.Fatalf("%s: a refused MODE SELECT cleared WCE", tt.name)
+		}
+	}
+	if fc, err := r.Do(testUnitReady, nil, 0); err != nil || fc.Status != scsi.SamStatGood {
+		t.Fatalf("a refused MODE SELECT established a unit attention: %v, status 0x%02x", err, fc.Status)
+	}
+}
+
+// modeWrapperHandler serves MODE SENSE and MODE SELECT through the entry points handlers used before
+// devices kept their own mode pages, with its own write cache setting.
+type modeWrapperHandler struct {
+	wce bool
+}
+
+func (h modeWrapperHandler) HandleCommand(cmd *ScsiCmd) (ScsiResponse, error) {
+	switch cmd.Command() {
+	case scsi.ModeSense, scsi.ModeSense10:
+		return EmulateModeSense(cmd, h.wce)
+	case scsi.ModeSelect, scsi.ModeSelect10:
+		return EmulateModeSelect(cmd, h.wce)
+	}
+	return cmd.NotHandled(), nil
+}
+
+func TestModeSenseWrappers(t *testing.T) {
+	for _, wce := range []bool{false, true} {
+		r := newTestRing(t, "t", modeWrapperHandler{wce}, 1<<20, DeviceOptions{}, FakeRingConfig{})
+		fc, err := r.Do([]byte{scsi.ModeSense, 0x08, 0x08, 0, 64, 0}, nil, 64)
+		if err != nil || fc.Status != scsi.SamStatGood {
+			t.Fatalf("WCE %v: MODE SENSE: %v, status 0x%02x", wce, err, fc.Status)
+		}
+		var page bytes.Buffer
+		CachingModePage(&page, wce)
+		if !bytes.Equal(fc.Data[4:24], page.Bytes()) {
+			t.Fatalf("WCE %v: Caching page % x, want % x", wce, fc.Data[4:24], page.Bytes())
+		}
+		if r.Device().WriteCacheEnabled() != wce {
+			t.Fatalf("WCE %v: the device's write cache doesn't follow the handler's", wce)
+		}
+		// The handler owns WCE, so it isn't changeable.
+		if fc, _ := r.Do([]byte{scsi.ModeSense, 0x08, 0x48, 0, 64, 0}, nil, 64); fc.Data[6]&0x04 != 0 {
+			t.Fatalf("WCE %v: WCE is changeable", wce)
+		}
+
+		var b2 byte
+		if wce {
+			b2 = 0x04
+		}
+		p := cachingSelect(b2)
+		if fc, err := r.Do(modeSelect6(false, p), p, 0); err != nil || fc.Status != scsi.SamStatGood {
+			t.Fatalf("WCE %v: MODE SELECT: %v, status 0x%02x", wce, err, fc.Status)
+		}
+		p = cachingSelect(b2 ^ 0x04)
+		fc, err = r.Do(modeSelect6(false, p), p, 0)
+		expectSense(t, "MODE SELECT changing WCE", fc, err, scsi.SenseIllegalRequest, scsi.AscInvalidFieldInParameterList)
+		r.Close()
+	}
+}
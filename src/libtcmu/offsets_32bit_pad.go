@@ -22,5 +22,6 @@ const (
 	offReqIov0Len = entReqRespOff + 44
 
 	offRespSCSIStatus = entReqRespOff + 0
+	offRespReadLen = entReqRespOff + 4
 	offRespSense = entReqRespOff + 8
 )
@@ -0,0 +1,628 @@
+package tcmu
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"libtcmu/scsi"
+)
+
+// PRType is the type of a persistent reservation, from the TYPE field of PERSISTENT RESERVE OUT.
+type PRType uint8
+
+const (
+	PRWriteExclusive                 PRType = 0x1
+	PRExclusiveAccess                PRType = 0x3
+	PRWriteExclusiveRegistrantsOnly  PRType = 0x5
+	PRExclusiveAccessRegistrantsOnly PRType = 0x6
+	PRWriteExclusiveAllRegistrants   PRType = 0x7
+	PRExclusiveAccessAllRegistrants  PRType = 0x8
+)
+
+func (t PRType) valid() bool {
+	switch t {
+	case PRWriteExclusive, PRExclusiveAccess, PRWriteExclusiveRegistrantsOnly, PRExclusiveAccessRegistrantsOnly,
+		PRWriteExclusiveAllRegistrants, PRExclusiveAccessAllRegistrants:
+		return true
+	}
+	return false
+}
+
+// registrantsOnly is whether any registered nexus has access, not just the reservation holder.
+func (t PRType) registrantsOnly() bool {
+	return t == PRWriteExclusiveRegistrantsOnly || t == PRExclusiveAccessRegistrantsOnly || t.allRegistrants()
+}
+
+// allRegistrants is whether every registered nexus holds the reservation.
+func (t PRType) allRegistrants() bool {
+	return t == PRWriteExclusiveAllRegistrants || t == PRExclusiveAccessAllRegistrants
+}
+
+// exclusiveAccess is whether nexuses without access can't read either.
+func (t PRType) exclusiveAccess() bool {
+	return t == PRExclusiveAccess || t == PRExclusiveAccessRegistrantsOnly || t == PRExclusiveAccessAllRegistrants
+}
+
+// Persistent reservation service actions.
+const (
+	prInReadKeys           = 0x00
+	prInReadReservation    = 0x01
+	prInReportCapabilities = 0x02
+
+	prOutRegister                  = 0x00
+	prOutReserve                   = 0x01
+	prOutRelease                   = 0x02
+	prOutClear                     = 0x03
+	prOutPreempt                   = 0x04
+	prOutPreemptAndAbort           = 0x05
+	prOutRegisterAndIgnoreExisting = 0x06
+)
+
+// prOutParamLen is the length of the PERSISTENT RESERVE OUT parameter list, without SPEC_I_P's transport IDs.
+const prOutParamLen = 24
+
+// maxPRRegistrations bounds the reservation keys registered at once.
+const maxPRRegistrations = 128
+
+// PRRegistration is a reservation key registered by an I_T nexus.
+type PRRegistration struct {
+	Nexus string
+	Key   uint64
+}
+
+// PRState is a device's persistent reservation state, as a PRStore keeps it.
+type PRState struct {
+	// Generation counts the PERSISTENT RESERVE OUT commands that changed the registrations.
+	Generation    uint32
+	Registrations []PRRegistration
+	// Reserved is set while there's a reservation, of type Type, held by the nexus Holder. For the all
+	// registrants types every registered nexus holds it, and Holder is just the one that took it.
+	Reserved bool
+	Holder   string
+	Type     PRType
+	// APTPL is set if the last registration asked for the state to persist through power loss.
+	APTPL bool
+}
+
+func (s *PRState) clone() PRState {
+	c := *s
+	c.Registrations = append([]PRRegistration(nil), s.Registrations...)
+	return c
+}
+
+func (s *PRState) registration(nexus string) (int, bool) {
+	for i, r := range s.Registrations {
+		if r.Nexus == nexus {
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+func (s *PRState) isHolder(nexus string) bool {
+	if !s.Reserved {
+		return false
+	}
+	if s.Type.allRegistrants() {
+		_, ok := s.registration(nexus)
+		return ok
+	}
+	return s.Holder == nexus
+}
+
+func (s *PRState) holderKey() uint64 {
+	if i, ok := s.registration(s.Holder); ok {
+		return s.Registrations[i].Key
+	}
+	return 0
+}
+
+func (s *PRState) release() {
+	s.Reserved = false
+	s.Holder = ""
+	s.Type = 0
+}
+
+// unregister removes registration i, releasing the reservation if it was the holder's.
+func (s *PRState) unregister(i int) {
+	nexus := s.Registrations[i].Nexus
+	s.Registrations = append(s.Registrations[:i], s.Registrations[i+1:]...)
+	if !s.Reserved {
+		return
+	}
+	if s.Type.allRegistrants() && len(s.Registrations) == 0 || !s.Type.allRegistrants() && s.Holder == nexus {
+		s.release()
+	}
+}
+
+// removeKey removes the registrations of key, other than nexus's own, and returns how many it removed.
+func (s *PRState) removeKey(key uint64, nexus string) int {
+	removed := 0
+	kept := s.Registrations[:0]
+	for _, r := range s.Registrations {
+		if r.Key == key && r.Nexus != nexus {
+			removed++
+			continue
+		}
+		kept = append(kept, r)
+	}
+	s.Registrations = kept
+	return removed
+}
+
+// PRStore keeps a device's persistent reservations from one run of the daemon to the next. Load returns nil
+// and no error if nothing has been saved. Save is called with the new state after every change.
+type PRStore interface {
+	Load() (*PRState, error)
+	Save(state *PRState) error
+}
+
+// FilePRStore is a PRStore keeping the state as JSON in the file at path.
+func FilePRStore(path string) PRStore {
+	return filePRStore(path)
+}
+
+type filePRStore string
+
+func (f filePRStore) Load() (*PRState, error) {
+	buf, err := ioutil.ReadFile(string(f))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state PRState
+	if err := json.Unmarshal(buf, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func (f filePRStore) Save(state *PRState) error {
+	return writeJSONFile(string(f), state)
+}
+
+// reservations holds a device's persistent reservations, and its SPC-2 RESERVE, which doesn't persist.
+type reservations struct {
+	sync.Mutex
+	state PRState
+	store PRStore
+	// spc2Held is set while the nexus spc2Holder has the device reserved with RESERVE.
+	spc2Held   bool
+	spc2Holder string
+}
+
+func newReservations(store PRStore, volume string) *reservations {
+	r := &reservations{store: store}
+	if store == nil {
+		return r
+	}
+	state, err := store.Load()
+	if err != nil {
+		log.Warnf("[newReservations] vol:%s ignoring saved persistent reservations: %v", volume, err)
+		return r
+	}
+	// Without APTPL the registrations and the reservation don't survive a power loss, which a restart is as
+	// far as the initiator can tell.
+	if state != nil && state.APTPL {
+		r.state = *state
+	}
+	return r
+}
+
+var (
+	errReservationConflict = errors.New("tcmu: reservation conflict")
+	errPRInvalidRelease    = errors.New("tcmu: release of a persistent reservation of another type")
+	errPRNoResources       = errors.New("tcmu: too many reservation keys registered")
+)
+
+// prFieldError is an invalid field in the PERSISTENT RESERVE OUT CDB or parameter list.
+type prFieldError struct {
+	cdb        bool
+	field, bit int
+}
+
+func (e prFieldError) Error() string {
+	return "tcmu: invalid field in PERSISTENT RESERVE OUT"
+}
+
+// prOut is a PERSISTENT RESERVE OUT command from nexus.
+type prOut struct {
+	nexus  string
+	action byte
+	scope  byte
+	typ    PRType
+	key    uint64
+	saKey  uint64
+	aptpl  bool
+}
+
+// apply carries out a PERSISTENT RESERVE OUT on s. The unit attentions SPC has it establish are all for the
+// other registered nexuses, and there's only ever the one nexus (see unitAttentions), so it establishes none.
+// For the same reason PREEMPT AND ABORT is just PREEMPT: the commands it would abort are those of the nexuses
+// it preempts, never the one it came in on.
+func (s *PRState) apply(o prOut) error {
+	ignore := o.action == prOutRegisterAndIgnoreExisting
+	i, registered := s.registration(o.nexus)
+	if o.action != prOutRegister && !ignore && (!registered || s.Registrations[i].Key != o.key) {
+		return errReservationConflict
+	}
+
+	switch o.action {
+	case prOutRegister, prOutRegisterAndIgnoreExisting:
+		switch {
+		case !registered && !ignore && o.key != 0:
+			return errReservationConflict
+		case !registered && o.saKey == 0:
+			return nil
+		case !registered:
+			if len(s.Registrations) >= maxPRRegistrations {
+				return errPRNoResources
+			}
+			s.Registrations = append(s.Registrations, PRRegistration{Nexus: o.nexus, Key: o.saKey})
+		case !ignore && o.key != s.Registrations[i].Key:
+			return errReservationConflict
+		case o.saKey == 0:
+			s.unregister(i)
+		default:
+			s.Registrations[i].Key = o.saKey
+		}
+		s.APTPL = o.aptpl
+		s.bump()
+		return nil
+
+	case prOutReserve:
+		if s.Reserved {
+			if !s.isHolder(o.nexus) || s.Type != o.typ {
+				return errReservationConflict
+			}
+			return nil
+		}
+		s.Reserved, s.Holder, s.Type = true, o.nexus, o.typ
+		return nil
+
+	case prOutRelease:
+		if !s.isHolder(o.nexus) {
+			return nil
+		}
+		if s.Type != o.typ {
+			return errPRInvalidRelease
+		}
+		s.release()
+		return nil
+
+	case prOutClear:
+		s.Registrations = nil
+		s.release()
+		s.bump()
+		return nil
+
+	case prOutPreempt, prOutPreemptAndAbort:
+		return s.preempt(o)
+	}
+	return prFieldError{cdb: true, field: 1, bit: 4}
+}
+
+// preempt removes the registrations of the service action reservation key and, if that's the holder's, takes
+// over the reservation with the type given.
+func (s *PRState) preempt(o prOut) error {
+	takeOver := s.Reserved && (s.Type.allRegistrants() && o.saKey == 0 ||
+		!s.Type.allRegistrants() && o.saKey == s.holderKey())
+	if !takeOver {
+		if o.saKey == 0 {
+			return prFieldError{cdb: false, field: 8, bit: -1}
+		}
+		if s.removeKey(o.saKey, o.nexus) == 0 {
+			return errReservationConflict
+		}
+		s.bump()
+		return nil
+	}
+
+	if o.saKey == 0 {
+		i, _ := s.registration(o.nexus)
+		s.Registrations = []PRRegistration{s.Registrations[i]}
+	} else {
+		s.removeKey(o.saKey, o.nexus)
+	}
+	s.Reserved, s.Holder, s.Type = true, o.nexus, o.typ
+	s.bump()
+	return nil
+}
+
+func (s *PRState) bump() {
+	s.Generation++
+}
+
+// prAccess is how a command touches the medium, for deciding whether a reservation conflicts with it.
+type prAccess int
+
+const (
+	// prAccessAlways commands run whatever the reservation.
+	prAccessAlways prAccess = iota
+	prAccessRead
+	prAccessWrite
+)
+
+func commandAccess(cmd *ScsiCmd) prAccess {
+	switch cmd.Command() {
+	case scsi.Inquiry, scsi.ReportLuns, scsi.RequestSense, scsi.TestUnitReady, scsi.ReadCapacity,
+		scsi.ServiceActionIn16, scsi.LogSense, scsi.MaintenanceIn,
+		scsi.PersistentReserveIn, scsi.PersistentReserveOut,
+		scsi.Reserve, scsi.Reserve10, scsi.Release, scsi.Release10:
+		return prAccessAlways
+	case scsi.Read6, scsi.Read10, scsi.Read12, scsi.Read16, scsi.Verify, scsi.Verify12, scsi.Verify16,
+		scsi.ModeSense, scsi.ModeSense10:
+		return prAccessRead
+	case scsi.VariableLengthCmd:
+		switch uint16(cmd.GetCDB(8))<<8 | uint16(cmd.GetCDB(9)) {
+		case scsi.Read32, scsi.Verify32:
+			return prAccessRead
+		}
+	}
+	return prAccessWrite
+}
+
+// conflicts reports whether a reservation keeps cmd, from nexus, from running.
+func (r *reservations) conflicts(cmd *ScsiCmd, nexus string) bool {
+	r.Lock()
+	defer r.Unlock()
+	if r.spc2Held && r.spc2Holder != nexus {
+		switch cmd.Command() {
+		case scsi.Inquiry, scsi.ReportLuns, scsi.RequestSense, scsi.Release, scsi.Release10:
+			return false
+		}
+		return true
+	}
+
+	s := &r.state
+	if !s.Reserved || s.isHolder(nexus) {
+		return false
+	}
+	access := commandAccess(cmd)
+	if access == prAccessAlways {
+		return false
+	}
+	if _, registered := s.registration(nexus); registered && s.Type.registrantsOnly() {
+		return false
+	}
+	return access == prAccessWrite || s.Type.exclusiveAccess()
+}
+
+// reservationConflict returns RESERVATION CONFLICT if the device is reserved in a way that keeps cmd from
+// running.
+func (vbd *VirBlkDev) reservationConflict(cmd *ScsiCmd) (ScsiResponse, bool) {
+	if vbd.reservations == nil || !vbd.reservations.conflicts(cmd, cmd.Nexus()) {
+		return ScsiResponse{}, false
+	}
+	return cmd.ResponseStatus(scsi.SamStatReservationConflict), true
+}
+
+// resetSPC2 drops any RESERVE, as a LUN or target reset does.
+func (r *reservations) resetSPC2() {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	r.spc2Held = false
+	r.spc2Holder = ""
+	r.Unlock()
+}
+
+// EmulatePersistentReserveOut registers and unregisters reservation keys, and takes, releases and preempts
+// persistent reservations, of any type but only with logical unit scope. SPEC_I_P, ALL_TG_PT and REGISTER AND
+// MOVE aren't supported. PREEMPT AND ABORT preempts like PREEMPT, and has no other nexus's commands to abort.
+// The state is saved to the device's PRStore after every change. Without
+// DeviceOptions.EmulateReservations the command is passed back to the kernel.
+func EmulatePersistentReserveOut(cmd *ScsiCmd) (ScsiResponse, error) {
+	if cmd.VirBlkDev().reservations == nil {
+		return cmd.PassToKernel(), nil
+	}
+	o := prOut{
+		nexus:  cmd.Nexus(),
+		action: cmd.GetCDB(1) & 0x1f,
+		scope:  cmd.GetCDB(2) >> 4,
+		typ:    PRType(cmd.GetCDB(2) & 0x0f),
+	}
+	switch o.action {
+	case prOutReserve, prOutRelease, prOutPreempt, prOutPreemptAndAbort:
+		if o.scope != 0 {
+			return cmd.InvalidFieldInCDB(2, 7), nil
+		}
+		if !o.typ.valid() {
+			return cmd.InvalidFieldInCDB(2, 3), nil
+		}
+	case prOutRegister, prOutClear, prOutRegisterAndIgnoreExisting:
+	default:
+		return cmd.InvalidFieldInCDB(1, 4), nil
+	}
+
+	paramLen := int(binary.BigEndian.Uint32([]byte{cmd.GetCDB(5), cmd.GetCDB(6), cmd.GetCDB(7), cmd.GetCDB(8)}))
+	if paramLen != prOutParamLen || cmd.BufferLen() < paramLen {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscParameterListLengthError), nil
+	}
+	params := make([]byte, paramLen)
+	n, err := cmd.Read(params)
+	if err != nil && err != io.EOF {
+		return ScsiResponse{}, err
+	}
+	if n < paramLen {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscParameterListLengthError), nil
+	}
+	o.key = binary.BigEndian.Uint64(params[0:8])
+	o.saKey = binary.BigEndian.Uint64(params[8:16])
+	if params[20]&0x08 != 0 {
+		return cmd.InvalidFieldInParameterList(20, 3), nil // SPEC_I_P
+	}
+	if params[20]&0x04 != 0 {
+		return cmd.InvalidFieldInParameterList(20, 2), nil // ALL_TG_PT
+	}
+	o.aptpl = params[20]&0x01 != 0
+
+	vbd := cmd.VirBlkDev()
+	r := vbd.reservations
+	r.Lock()
+	old := r.state.clone()
+	err = r.state.apply(o)
+	if err == nil && r.store != nil && !prStateEqual(&old, &r.state) {
+		if err = r.store.Save(&r.state); err != nil {
+			log.Errorf("[EmulatePersistentReserveOut] vbd:%s saving persistent reservations: %v", vbd.devPath, err)
+			r.state = old
+			r.Unlock()
+			return cmd.TargetFailure(), nil
+		}
+	}
+	r.Unlock()
+
+	switch e := err.(type) {
+	case nil:
+	case prFieldError:
+		if e.cdb {
+			return cmd.InvalidFieldInCDB(e.field, e.bit), nil
+		}
+		return cmd.InvalidFieldInParameterList(e.field, e.bit), nil
+	default:
+		switch err {
+		case errReservationConflict:
+			return cmd.ResponseStatus(scsi.SamStatReservationConflict), nil
+		case errPRInvalidRelease:
+			return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidReleaseOfPersistentReservation), nil
+		case errPRNoResources:
+			return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInsufficientRegistrationResources), nil
+		}
+		return ScsiResponse{}, err
+	}
+	return cmd.Ok(), nil
+}
+
+func prStateEqual(a, b *PRState) bool {
+	if a.Generation != b.Generation || a.Reserved != b.Reserved || a.Holder != b.Holder || a.Type != b.Type ||
+		a.APTPL != b.APTPL || len(a.Registrations) != len(b.Registrations) {
+		return false
+	}
+	for i := range a.Registrations {
+		if a.Registrations[i] != b.Registrations[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// EmulatePersistentReserveIn reports the registered keys, the reservation and what's supported. READ FULL
+// STATUS isn't supported. Without DeviceOptions.EmulateReservations the command is passed back to the kernel.
+func EmulatePersistentReserveIn(cmd *ScsiCmd) (ScsiResponse, error) {
+	r := cmd.VirBlkDev().reservations
+	if r == nil {
+		return cmd.PassToKernel(), nil
+	}
+	r.Lock()
+	s := r.state.clone()
+	r.Unlock()
+
+	order := binary.BigEndian
+	var buf []byte
+	switch cmd.GetCDB(1) & 0x1f {
+	case prInReadKeys:
+		buf = make([]byte, 8+8*len(s.Registrations))
+		order.PutUint32(buf[0:4], s.Generation)
+		order.PutUint32(buf[4:8], uint32(8*len(s.Registrations)))
+		for i, reg := range s.Registrations {
+			order.PutUint64(buf[8+8*i:], reg.Key)
+		}
+	case prInReadReservation:
+		buf = make([]byte, 8)
+		order.PutUint32(buf[0:4], s.Generation)
+		if s.Reserved {
+			buf = append(buf, make([]byte, 16)...)
+			order.PutUint32(buf[4:8], 16)
+			if !s.Type.allRegistrants() {
+				order.PutUint64(buf[8:16], s.holderKey())
+			}
+			buf[21] = byte(s.Type) // SCOPE is the logical unit
+		}
+	case prInReportCapabilities:
+		buf = make([]byte, 8)
+		order.PutUint16(buf[0:2], 8)
+		buf[2] = 0x10 | 0x01 // CRH, PTPL_C
+		buf[3] = 0x80        // TMV: the type mask is valid
+		if s.APTPL {
+			buf[3] |= 0x01 // PTPL_A
+		}
+		buf[4] = 0x80 | 0x40 | 0x20 | 0x08 | 0x02 // WR_EX_AR, EX_AC_RO, WR_EX_RO, EX_AC, WR_EX
+		buf[5] = 0x01                             // EX_AC_AR
+	default:
+		return cmd.InvalidFieldInCDB(1, 4), nil
+	}
+	return cmd.WriteData(buf), nil
+}
+
+// EmulateReserve reserves the device for the nexus with the SPC-2 RESERVE(6) or RESERVE(10) command.
+// Third-party reservations aren't supported. While there are persistent reservation keys registered it only
+// succeeds, doing nothing, for the persistent reservation's holder. Without DeviceOptions.EmulateReservations
+// the command is passed back to the kernel.
+func EmulateReserve(cmd *ScsiCmd) (ScsiResponse, error) {
+	r := cmd.VirBlkDev().reservations
+	if r == nil {
+		return cmd.PassToKernel(), nil
+	}
+	if cmd.Command() == scsi.Reserve10 && cmd.GetCDB(1)&0x12 != 0 {
+		return cmd.InvalidFieldInCDB(1, 4), nil // 3RDPTY, LONGID
+	}
+	nexus := cmd.Nexus()
+	r.Lock()
+	defer r.Unlock()
+	if len(r.state.Registrations) > 0 {
+		if r.state.isHolder(nexus) {
+			return cmd.Ok(), nil
+		}
+		return cmd.ResponseStatus(scsi.SamStatReservationConflict), nil
+	}
+	if r.spc2Held && r.spc2Holder != nexus {
+		return cmd.ResponseStatus(scsi.SamStatReservationConflict), nil
+	}
+	r.spc2Held = true
+	r.spc2Holder = nexus
+	return cmd.Ok(), nil
+}
+
+// EmulateRelease releases the nexus's SPC-2 reservation, if it has one. While there are persistent reservation
+// keys registered it does nothing. Without DeviceOptions.EmulateReservations the command is passed back to the
+// kernel.
+func EmulateRelease(cmd *ScsiCmd) (ScsiResponse, error) {
+	r := cmd.VirBlkDev().reservations
+	if r == nil {
+		return cmd.PassToKernel(), nil
+	}
+	r.Lock()
+	defer r.Unlock()
+	if len(r.state.Registrations) == 0 && r.spc2Held && r.spc2Holder == cmd.Nexus() {
+		r.spc2Held = false
+		r.spc2Holder = ""
+	}
+	return cmd.Ok(), nil
+}
+
+// reservations returns the device's reservations, or nil unless it emulates them.
+func (o DeviceOptions) reservations(volume string) *reservations {
+	if !o.EmulateReservations {
+		return nil
+	}
+	return newReservations(o.prStore(volume), volume)
+}
+
+func (o DeviceOptions) prStore(volume string) PRStore {
+	if o.PRStore != nil {
+		return o.PRStore
+	}
+	if o.StateDir == "" {
+		return nil
+	}
+	return FilePRStore(filepath.Join(o.StateDir, volume+".pr"))
+}
@@ -0,0 +1,269 @@
+package tcmu
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"libtcmu/scsi"
+)
+
+func prOutCDB(sa byte, typ PRType, key, saKey uint64, flags byte) ([]byte, []byte) {
+	c := []byte{scsi.PersistentReserveOut, sa, byte(typ), 0, 0, 0, 0, 0, prOutParamLen, 0}
+	p := make([]byte, prOutParamLen)
+	binary.BigEndian.PutUint64(p[0:], key)
+	binary.BigEndian.PutUint64(p[8:], saKey)
+	p[20] = flags
+	return c, p
+}
+
+func prInCDB(sa byte) []byte {
+	return []byte{scsi.PersistentReserveIn, sa, 0, 0, 0, 0, 0, 0, 64, 0}
+}
+
+// memPRStore is a PRStore holding the state in memory.
+type memPRStore struct {
+	state *PRState
+}
+
+func (m *memPRStore) Load() (*PRState, error) {
+	if m.state == nil {
+		return nil, nil
+	}
+	s := m.state.clone()
+	return &s, nil
+}
+
+func (m *memPRStore) Save(state *PRState) error {
+	s := state.clone()
+	m.state = &s
+	return nil
+}
+
+func TestReservationsPassedToKernel(t *testing.T) {
+	r := newTestRing(t, "t", memHandler(1<<20), 1<<20, DeviceOptions{}, FakeRingConfig{})
+	defer r.Close()
+	c, p := prOutCDB(prOutRegister, 0, 0, 7, 0)
+	for _, tt := range []struct {
+		name string
+		cdb  []byte
+		data []byte
+	}{
+		{"PERSISTENT RESERVE OUT", c, p},
+		{"PERSISTENT RESERVE IN", prInCDB(prInReadKeys), nil},
+		{"RESERVE", []byte{scsi.Reserve, 0, 0, 0, 0, 0}, nil},
+		{"RELEASE", []byte{scsi.Release, 0, 0, 0, 0, 0}, nil},
+	} {
+		if fc, err := r.Do(tt.cdb, tt.data, 64); err != nil || !fc.UnknownOp {
+			t.Errorf("%s: %v, status 0x%02x, wasn't passed back to the kernel", tt.name, err, fc.Status)
+		}
+	}
+}
+
+func TestPersistentReservations(t *testing.T) {
+	dir := t.TempDir()
+	m := &memRW{b: make([]byte, 1<<20)}
+	r := newTestRing(t, "t", ReadWriteAtCmdHandler{RW: m}, 1<<20, DeviceOptions{StateDir: dir, EmulateReservations: true}, FakeRingConfig{})
+	do := func(what string, cdb, data []byte, status byte) FakeCompletion {
+		t.Helper()
+		fc, err := r.Do(cdb, data, 64)
+		if err != nil || fc.Status != status {
+			t.Fatalf("%s: %v, status 0x%02x, want 0x%02x", what, err, fc.Status, status)
+		}
+		return fc
+	}
+
+	c, p := prOutCDB(prOutRegister, 0, 5, 7, 0)
+	do("REGISTER with a key while unregistered", c, p, scsi.SamStatReservationConflict)
+	c, p = prOutCDB(prOutRegister, 0, 0, 7, 0x01)
+	do("REGISTER", c, p, scsi.SamStatGood)
+	c, p = prOutCDB(prOutReserve, PRWriteExclusive, 7, 0, 0)
+	do("RESERVE", c, p, scsi.SamStatGood)
+	c, p = prOutCDB(prOutReserve, PRExclusiveAccess, 7, 0, 0)
+	do("RESERVE of another type", c, p, scsi.SamStatReservationConflict)
+	c, p = prOutCDB(prOutRelease, PRExclusiveAccess, 7, 0, 0)
+	if fc := do("RELEASE of another type", c, p, scsi.SamStatCheckCondition); fc.Sense[12] != 0x26 || fc.Sense[13] != 0x04 {
+		t.Fatalf("RELEASE of another type: ASC 0x%02x%02x, want INVALID RELEASE OF PERSISTENT RESERVATION",
+			fc.Sense[12], fc.Sense[13])
+	}
+	c, p = prOutCDB(prOutRegister, 0, 0, 7, 0)
+	c[8] = 20
+	if fc := do("short parameter list", c, p[:20], scsi.SamStatCheckCondition); fc.Sense[12] != 0x1a {
+		t.Fatalf("short parameter list: ASC 0x%02x, want PARAMETER LIST LENGTH ERROR", fc.Sense[12])
+	}
+
+	// PREEMPT AND ABORT of its own key lets the holder change the reservation's type, as PREEMPT does.
+	c, p = prOutCDB(prOutPreemptAndAbort, PRExclusiveAccess, 7, 7, 0)
+	do("PREEMPT AND ABORT", c, p, scsi.SamStatGood)
+	if fc := do("READ RESERVATION", prInCDB(prInReadReservation), nil, scsi.SamStatGood); fc.Data[21] != byte(PRExclusiveAccess) {
+		t.Fatalf("after PREEMPT AND ABORT: type 0x%02x, want exclusive access", fc.Data[21])
+	}
+	c, p = prOutCDB(prOutPreemptAndAbort, PRWriteExclusive, 5, 7, 0)
+	do("PREEMPT AND ABORT with the wrong key", c, p, scsi.SamStatReservationConflict)
+	c, p = prOutCDB(prOutPreemptAndAbort, PRWriteExclusive, 7, 7, 0)
+	do("PREEMPT AND ABORT back", c, p, scsi.SamStatGood)
+
+	fc := do("READ KEYS", prInCDB(prInReadKeys), nil, scsi.SamStatGood)
+	// REGISTER and each PREEMPT AND ABORT bumped the generation.
+	if binary.BigEndian.Uint32(fc.Data[0:]) != 3 || binary.BigEndian.Uint32(fc.Data[4:]) != 8 ||
+		binary.BigEndian.Uint64(fc.Data[8:]) != 7 {
+		t.Fatalf("READ KEYS: % x", fc.Data[:16])
+	}
+	fc = do("READ RESERVATION", prInCDB(prInReadReservation), nil, scsi.SamStatGood)
+	if fc.Data[7] != 16 || binary.BigEndian.Uint64(fc.Data[8:]) != 7 || fc.Data[21] != byte(PRWriteExclusive) {
+		t.Fatalf("READ RESERVATION: % x", fc.Data[:24])
+	}
+	fc = do("REPORT CAPABILITIES", prInCDB(prInReportCapabilities), nil, scsi.SamStatGood)
+	if fc.Data[2] != 0x11 || fc.Data[3] != 0x81 || fc.Data[4] != 0xea || fc.Data[5] != 0x01 {
+		t.Fatalf("REPORT CAPABILITIES: % x, want CRH, PTPL_C, TMV, PTPL_A and every type", fc.Data[:8])
+	}
+
+	// The holder's SPC-2 RESERVE succeeds, doing nothing, while keys are registered.
+	do("SPC-2 RESERVE", []byte{scsi.Reserve, 0, 0, 0, 0, 0}, nil, scsi.SamStatGood)
+
+	// The state outlasts the device, in StateDir.
+	r.Close()
+	if _, err := os.Stat(filepath.Join(dir, "t.pr")); err != nil {
+		t.Fatal(err)
+	}
+	r = newTestRing(t, "t", ReadWriteAtCmdHandler{RW: m}, 1<<20, DeviceOptions{StateDir: dir, EmulateReservations: true}, FakeRingConfig{})
+	defer r.Close()
+	fc = do("READ RESERVATION after restart", prInCDB(prInReadReservation), nil, scsi.SamStatGood)
+	if fc.Data[7] != 16 || fc.Data[21] != byte(PRWriteExclusive) {
+		t.Fatalf("READ RESERVATION after restart: % x", fc.Data[:24])
+	}
+	c, p = prOutCDB(prOutClear, 0, 7, 0, 0)
+	do("CLEAR", c, p, scsi.SamStatGood)
+	fc = do("READ KEYS after CLEAR", prInCDB(prInReadKeys), nil, scsi.SamStatGood)
+	if binary.BigEndian.Uint32(fc.Data[0:]) != 4 || binary.BigEndian.Uint32(fc.Data[4:]) != 0 {
+		t.Fatalf("READ KEYS after CLEAR: % x", fc.Data[:8])
+	}
+}
+
+func TestReservationHeldElsewhere(t *testing.T) {
+	// A reservation another nexus took, eg. through a peer's device sharing the store, keeps this one's out.
+	store := &memPRStore{state: &PRState{
+		Generation:    1,
+		Registrations: []PRRegistration{{Nexus: "naa.5001405000000001", Key: 9}},
+		Reserved:      true,
+		Holder:        "naa.5001405000000001",
+		Type:          PRWriteExclusive,
+		APTPL:         true,
+	}}
+	r := newTestRing(t, "t", memHandler(1<<20), 1<<20, DeviceOptions{EmulateReservations: true, PRStore: store}, FakeRingConfig{})
+	defer r.Close()
+	if fc, err := r.Do(rw10(scsi.Read10, 0, 1), nil, 512); err != nil || fc.Status != scsi.SamStatGood {
+		t.Fatalf("read: %v, status 0x%02x", err, fc.Status)
+	}
+	if fc, err := r.Do(rw10(scsi.Write10, 0, 1), make([]byte, 512), 0); err != nil ||
+		fc.Status != scsi.SamStatReservationConflict {
+		t.Fatalf("write: %v, status 0x%02x, want RESERVATION CONFLICT", err, fc.Status)
+	}
+	c, p := prOutCDB(prOutRegister, 0, 0, 3, 0)
+	if fc, err := r.Do(c, p, 0); err != nil || fc.Status != scsi.SamStatGood {
+		t.Fatalf("REGISTER: %v, status 0x%02x", err, fc.Status)
+	}
+	c, p = prOutCDB(prOutPreempt, PRWriteExclusive, 3, 9, 0)
+	if fc, err := r.Do(c, p, 0); err != nil || fc.Status != scsi.SamStatGood {
+		t.Fatalf("PREEMPT: %v, status 0x%02x", err, fc.Status)
+	}
+	if fc, err := r.Do(rw10(scsi.Write10, 0, 1), make([]byte, 512), 0); err != nil || fc.Status != scsi.SamStatGood {
+		t.Fatalf("write after PREEMPT: %v, status 0x%02x", err, fc.Status)
+	}
+	if len(store.state.Registrations) != 1 || store.state.Holder != r.Device().nexusID() {
+		t.Fatalf("saved state %+v, want this nexus holding the reservation alone", store.state)
+	}
+}
+
+func TestPRStateApply(t *testing.T) {
+	var s PRState
+	apply := func(o prOut) {
+		t.Helper()
+		if err := s.apply(o); err != nil {
+			t.Fatalf("%+v: %v", o, err)
+		}
+	}
+	apply(prOut{nexus: "a", action: prOutRegister, saKey: 1})
+	apply(prOut{nexus: "b", action: prOutRegister, saKey: 2})
+	apply(prOut{nexus: "c", action: prOutRegisterAndIgnoreExisting, saKey: 3})
+	apply(prOut{nexus: "a", action: prOutReserve, key: 1, typ: PRWriteExclusiveRegistrantsOnly})
+	if err := s.apply(prOut{nexus: "b", action: prOutReserve, key: 2, typ: PRWriteExclusiveRegistrantsOnly}); err != errReservationConflict {
+		t.Fatalf("RESERVE while another nexus holds it: %v", err)
+	}
+
+	r := &reservations{state: s}
+	write := &ScsiCmd{cdb: rw10(scsi.Write10, 0, 1)}
+	read := &ScsiCmd{cdb: rw10(scsi.Read10, 0, 1)}
+	if r.conflicts(write, "b") || !r.conflicts(write, "z") || r.conflicts(read, "z") {
+		t.Fatal("write exclusive, registrants only: registrants should have access, and others only to read")
+	}
+
+	// b preempts the holder, a, taking over with another type.
+	apply(prOut{nexus: "b", action: prOutPreempt, key: 2, saKey: 1, typ: PRExclusiveAccess})
+	if !s.isHolder("b") || s.Type != PRExclusiveAccess || len(s.Registrations) != 2 {
+		t.Fatalf("after PREEMPT: %+v", s)
+	}
+	r.state = s
+	if !r.conflicts(read, "c") || r.conflicts(read, "b") || r.conflicts(&ScsiCmd{cdb: []byte{scsi.Inquiry, 0, 0, 0, 36, 0}}, "c") {
+		t.Fatal("exclusive access: only the holder should read, though anyone may INQUIRY")
+	}
+
+	if err := s.apply(prOut{nexus: "b", action: prOutRelease, key: 2, typ: PRWriteExclusive}); err != errPRInvalidRelease {
+		t.Fatalf("RELEASE of another type: %v", err)
+	}
+	apply(prOut{nexus: "c", action: prOutRelease, key: 3, typ: PRExclusiveAccess})
+	if !s.Reserved {
+		t.Fatal("RELEASE by a nexus that doesn't hold the reservation released it")
+	}
+
+	// With all registrants holding it, the reservation lasts until the last one unregisters.
+	apply(prOut{nexus: "b", action: prOutRelease, key: 2, typ: PRExclusiveAccess})
+	apply(prOut{nexus: "c", action: prOutReserve, key: 3, typ: PRExclusiveAccessAllRegistrants})
+	if !s.isHolder("b") || !s.isHolder("c") {
+		t.Fatal("all registrants: every registered nexus should hold the reservation")
+	}
+	apply(prOut{nexus: "c", action: prOutRegister, key: 3})
+	if !s.Reserved || !s.isHolder("b") {
+		t.Fatal("all registrants: released while a registrant is left")
+	}
+	apply(prOut{nexus: "b", action: prOutRegister, key: 2})
+	if s.Reserved {
+		t.Fatal("all registrants: still reserved with nobody registered")
+	}
+
+	apply(prOut{nexus: "a", action: prOutRegister, saKey: 9})
+	if err := s.apply(prOut{nexus: "a", action: prOutPreempt, key: 9, typ: PRWriteExclusive}); err == nil {
+		t.Fatal("PREEMPT of key 0 without a reservation succeeded")
+	}
+	if err := s.apply(prOut{nexus: "a", action: prOutPreempt, key: 9, saKey: 77, typ: PRWriteExclusive}); err != errReservationConflict {
+		t.Fatalf("PREEMPT of a key nobody has: %v", err)
+	}
+
+	// PREEMPT AND ABORT preempts the same way.
+	apply(prOut{nexus: "b", action: prOutRegister, saKey: 2})
+	apply(prOut{nexus: "a", action: prOutReserve, key: 9, typ: PRWriteExclusive})
+	apply(prOut{nexus: "b", action: prOutPreemptAndAbort, key: 2, saKey: 9, typ: PRExclusiveAccess})
+	if !s.isHolder("b") || s.Type != PRExclusiveAccess || len(s.Registrations) != 1 {
+		t.Fatalf("after PREEMPT AND ABORT: %+v", s)
+	}
+}
+
+func TestReservationsLostWithoutAPTPL(t *testing.T) {
+	store := &memPRStore{state: &PRState{
+		Generation:    1,
+		Registrations: []PRRegistration{{Nexus: "naa.5001405000000001", Key: 9}},
+		Reserved:      true,
+		Holder:        "naa.5001405000000001",
+		Type:          PRExclusiveAccess,
+	}}
+	r := newTestRing(t, "t", memHandler(1<<20), 1<<20, DeviceOptions{EmulateReservations: true, PRStore: store}, FakeRingConfig{})
+	defer r.Close()
+	if fc, err := r.Do(rw10(scsi.Write10, 0, 1), make([]byte, 512), 0); err != nil || fc.Status != scsi.SamStatGood {
+		t.Fatalf("write: %v, status 0x%02x, want the saved reservation gone", err, fc.Status)
+	}
+	fc, err := r.Do(prInCDB(prInReadKeys), nil, 64)
+	if err != nil || fc.Status != scsi.SamStatGood || binary.BigEndian.Uint32(fc.Data[4:]) != 0 {
+		t.Fatalf("READ KEYS: %v, status 0x%02x, % x, want no keys", err, fc.Status, fc.Data[:8])
+	}
+}
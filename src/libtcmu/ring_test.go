@@ -0,0 +1,457 @@
+package tcmu
+
+import (
+	"bytes"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+
+	"libtcmu/scsi"
+)
+
+var testUnitReady = []byte{scsi.TestUnitReady, 0, 0, 0, 0, 0}
+
+// newTestMailbox returns a device with a bare mailbox, a command ring of cmdrSize bytes right after it and a
+// data area of dataSize bytes, for looking at ring entries without a poll loop.
+func newTestMailbox(cmdrSize, dataSize int) *VirBlkDev {
+	vbd := &VirBlkDev{mmap: make([]byte, mbSize+cmdrSize+dataSize)}
+	byteOrder.PutUint16(vbd.mmap[mbOffVersion:], 2)
+	byteOrder.PutUint32(vbd.mmap[mbOffCmdrOff:], mbSize)
+	byteOrder.PutUint32(vbd.mmap[mbOffCmdrSize:], uint32(cmdrSize))
+	return vbd
+}
+
+// putTestCmd writes a command entry for cdb at ringOff, with an iovec for each {base, length} pair, and
+// returns its offset in the map and its length.
+func putTestCmd(vbd *VirBlkDev, ringOff uint32, cdb []byte, iovs ...[2]uint64) (int, uint32) {
+	off := mbSize + int(ringOff)
+	size := cmdEntSize(len(iovs), len(cdb))
+	byteOrder.PutUint32(vbd.mmap[off+offLenOp:], size|uint32(tcmuOpCmd))
+	byteOrder.PutUint32(vbd.mmap[off+offReqIovCnt:], uint32(len(iovs)))
+	for i, iov := range iovs {
+		putIovec(vbd.mmap[off:], i, iov[0], iov[1])
+	}
+	cdbOff := off + cmdEntBaseSize(len(iovs))
+	byteOrder.PutUint64(vbd.mmap[off+offReqCdbOff:], uint64(cdbOff))
+	copy(vbd.mmap[cdbOff:], cdb)
+	return off, size
+}
+
+func TestRingWrapsWithPad(t *testing.T) {
+	m := &memRW{b: make([]byte, 1<<20)}
+	r := newTestRing(t, "t", ReadWriteAtCmdHandler{RW: m}, 1<<20, DeviceOptions{}, FakeRingConfig{CmdrSize: 1024})
+	defer r.Close()
+	vbd := r.Device()
+
+	// A TEST UNIT READY entry is 120 bytes, which doesn't divide the ring, so the head has to skip a gap
+	// with a TCMU_OP_PAD entry each time it wraps.
+	entSize := cmdEntSize(0, len(testUnitReady))
+	wraps := 0
+	for i := 0; i < 40; i++ {
+		r.Lock()
+		head := r.head
+		r.Unlock()
+
+		fc, err := r.Do(testUnitReady, nil, 0)
+		if err != nil || fc.Status != scsi.SamStatGood {
+			t.Fatalf("command %d: %v, status 0x%02x", i, err, fc.Status)
+		}
+
+		if head+entSize > r.cmdrSize {
+			wraps++
+			if op := vbd.entHdrOp(mbSize + int(head)); op != tcmuOpPad {
+				t.Fatalf("command %d: entry at %d has opcode %d, want a pad", i, head, op)
+			}
+			if l := vbd.entHdrGetLen(mbSize + int(head)); uint32(l) != r.cmdrSize-head {
+				t.Fatalf("command %d: pad at %d is %d bytes, want %d", i, head, l, r.cmdrSize-head)
+			}
+		}
+		r.Lock()
+		head = r.head
+		r.Unlock()
+		if tail := vbd.mbCmdTail(); tail != head {
+			t.Fatalf("command %d: cmd_tail is %d, want it at the head, %d", i, tail, head)
+		}
+	}
+	if wraps < 2 {
+		t.Fatalf("ring wrapped %d times, want at least 2", wraps)
+	}
+
+	// Data still goes through the iovecs after the ring has wrapped.
+	data := bytes.Repeat([]byte{0xa5}, 8*512)
+	if fc, err := r.Do(rw10(scsi.Write10, 8, 8), data, 0); err != nil || fc.Status != scsi.SamStatGood {
+		t.Fatalf("write: %v, status 0x%02x", err, fc.Status)
+	}
+	fc, err := r.Do(rw10(scsi.Read10, 8, 8), nil, len(data))
+	if err != nil || fc.Status != scsi.SamStatGood || !bytes.Equal(fc.Data, data) {
+		t.Fatalf("read: %v, status 0x%02x", err, fc.Status)
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRingTailPassesTmr(t *testing.T) {
+	r := newTestRing(t, "t", memHandler(1<<20), 1<<20, DeviceOptions{}, FakeRingConfig{Tmr: true})
+	defer r.Close()
+	vbd := r.Device()
+
+	// Nothing completes a TMR entry, so the device has to give its space back on its own.
+	if err := r.SubmitTmr(TmrAbortTask, []uint16{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	r.Lock()
+	head := r.head
+	r.Unlock()
+	deadline := time.Now().Add(10 * time.Second)
+	for vbd.mbCmdTail() != head {
+		if time.Now().After(deadline) {
+			t.Fatalf("cmd_tail stuck at %d behind a TMR entry, head %d", vbd.mbCmdTail(), head)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if fc, err := r.Do(testUnitReady, nil, 0); err != nil || fc.Status != scsi.SamStatGood {
+		t.Fatalf("%v, status 0x%02x", err, fc.Status)
+	}
+}
+
+// tmrBackend holds WRITEs until the gate is closed, and passes on each Tmr it hears about.
+type tmrBackend struct {
+	ReadWriteAtCmdHandler
+	gate chan struct{}
+	tmrs chan Tmr
+}
+
+func (b *tmrBackend) HandleCommand(cmd *ScsiCmd) (ScsiResponse, error) {
+	if cmd.Command() == scsi.Write10 {
+		<-b.gate
+	}
+	return b.ReadWriteAtCmdHandler.HandleCommand(cmd)
+}
+
+func (b *tmrBackend) HandleTmr(tmr Tmr) {
+	b.tmrs <- tmr
+}
+
+func TestTmrHandler(t *testing.T) {
+	b := &tmrBackend{ReadWriteAtCmdHandler{RW: &memRW{b: make([]byte, 1<<20)}}, make(chan struct{}), make(chan Tmr, 1)}
+	r := newTestRing(t, "t", b, 1<<20, DeviceOptions{Workers: 4, EmulateReservations: true},
+		FakeRingConfig{Tmr: true, OutOfOrder: true})
+	defer r.Close()
+	vbd := r.Device()
+	spc2Held := func() bool {
+		vbd.reservations.Lock()
+		defer vbd.reservations.Unlock()
+		return vbd.reservations.spc2Held
+	}
+
+	if fc, err := r.Do([]byte{scsi.Reserve, 0, 0, 0, 0, 0}, nil, 0); err != nil || fc.Status != scsi.SamStatGood {
+		t.Fatalf("RESERVE: %v, status 0x%02x", err, fc.Status)
+	}
+	done, err := r.Submit(rw10(scsi.Write10, 0, 1), make([]byte, 512), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := r.InFlight()
+	if len(ids) != 1 {
+		t.Fatalf("%d commands in flight, want the WRITE", len(ids))
+	}
+
+	if err := r.SubmitTmr(TmrAbortTask, ids); err != nil {
+		t.Fatal(err)
+	}
+	if tmr := <-b.tmrs; tmr.Type != TmrAbortTask || len(tmr.CmdIds) != 1 || tmr.CmdIds[0] != ids[0] {
+		t.Fatalf("handler told of %s for cmd_ids %v, want ABORT TASK for %v", tmr.Type, tmr.CmdIds, ids)
+	}
+	if !spc2Held() {
+		t.Fatal("ABORT TASK dropped the RESERVE")
+	}
+
+	if err := r.SubmitTmr(TmrLunReset, nil); err != nil {
+		t.Fatal(err)
+	}
+	if tmr := <-b.tmrs; tmr.Type != TmrLunReset || len(tmr.CmdIds) != 0 {
+		t.Fatalf("handler told of %s for cmd_ids %v, want LUN RESET for none", tmr.Type, tmr.CmdIds)
+	}
+	if spc2Held() {
+		t.Fatal("LUN RESET didn't drop the RESERVE")
+	}
+
+	// The aborted WRITE still completes.
+	close(b.gate)
+	if fc, ok := <-done; !ok || fc.Status != scsi.SamStatGood {
+		t.Fatalf("WRITE: completed %v, status 0x%02x", ok, fc.Status)
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRingMalformedEntry(t *testing.T) {
+	tests := []struct {
+		name   string
+		mangle func(ent []byte)
+	}{
+		{"cdb_off before the entry", func(ent []byte) {
+			byteOrder.PutUint64(ent[offReqCdbOff:], 0)
+		}},
+		{"cdb_off past the entry", func(ent []byte) {
+			byteOrder.PutUint64(ent[offReqCdbOff:], 1<<40)
+		}},
+		{"iovec in the command ring", func(ent []byte) {
+			putIovec(ent, 0, mbSize, 512)
+		}},
+		{"iovec past the map", func(ent []byte) {
+			putIovec(ent, 0, uint64(mbSize+FAKE_RING_CMDR_SIZE), 1<<40)
+		}},
+		{"iov_cnt past the entry", func(ent []byte) {
+			byteOrder.PutUint32(ent[offReqIovCnt:], 1000)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var armed int32
+			r := newTestRing(t, "t", memHandler(1<<20), 1<<20, DeviceOptions{}, FakeRingConfig{
+				Mangle: func(ent []byte) {
+					if atomic.LoadInt32(&armed) != 0 {
+						tt.mangle(ent)
+					}
+				},
+			})
+			defer r.Close()
+
+			// The bad entry fails on its own, without costing the device the rest of the ring.
+			atomic.StoreInt32(&armed, 1)
+			fc, err := r.Do(rw10(scsi.Read10, 0, 1), nil, 512)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fc.Status != scsi.SamStatCheckCondition || fc.Sense[2]&0xf != scsi.SenseIllegalRequest {
+				t.Fatalf("status 0x%02x, sense %x, want ILLEGAL REQUEST", fc.Status, fc.Sense[:14])
+			}
+			atomic.StoreInt32(&armed, 0)
+			if fc, err := r.Do(rw10(scsi.Read10, 0, 1), nil, 512); err != nil || fc.Status != scsi.SamStatGood {
+				t.Fatalf("after the bad entry: %v, status 0x%02x", err, fc.Status)
+			}
+			if err := r.Err(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestCheckEnt(t *testing.T) {
+	const cmdrSize = 1024
+	tests := []struct {
+		name    string
+		ringOff uint32
+		lenOp   uint32
+		head    uint32
+		ok      bool
+	}{
+		{"command", 0, 128 | tcmuOpCmd, 128, true},
+		{"command before a later head", 0, 128 | tcmuOpCmd, 512, true},
+		{"pad to the end of the ring", 1024 - 64, 64 | uint32(tcmuOpPad), 0, true},
+		{"tmr", 0, offTmrCmdIds | uint32(tcmuOpTmr), offTmrCmdIds, true},
+		{"zero length", 0, 0 | tcmuOpCmd, 128, false},
+		{"command shorter than an entry", 0, 64 | tcmuOpCmd, 64, false},
+		{"tmr shorter than its header", 0, 16 | uint32(tcmuOpTmr), 16, false},
+		{"past the head", 0, 128 | tcmuOpCmd, 64, false},
+		{"past the end of the ring", 1024 - 64, 128 | tcmuOpCmd, 1024 - 72, false},
+		{"the whole ring", 0, 1024 | tcmuOpCmd, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vbd := newTestMailbox(cmdrSize, 4096)
+			off := mbSize + int(tt.ringOff)
+			byteOrder.PutUint32(vbd.mmap[off+offLenOp:], tt.lenOp)
+			err := vbd.checkEnt(off, tt.ringOff, tt.head)
+			if (err == nil) != tt.ok {
+				t.Fatalf("checkEnt = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestEntCdb(t *testing.T) {
+	vbd := newTestMailbox(1024, 4096)
+	cdb := rw10(scsi.Read10, 1, 1)
+	off, size := putTestCmd(vbd, 0, cdb)
+	got, err := vbd.entCdb(off)
+	if err != nil || !bytes.Equal(got, cdb) {
+		t.Fatalf("entCdb = %x, %v, want %x", got, err, cdb)
+	}
+
+	end := uint64(off) + uint64(size)
+	for _, cdbOff := range []uint64{0, uint64(off), uint64(off + offReqCdbOff), end, 1 << 63} {
+		byteOrder.PutUint64(vbd.mmap[off+offReqCdbOff:], cdbOff)
+		if got, err := vbd.entCdb(off); err == nil {
+			t.Errorf("cdb_off %d: entCdb = %x, want an error", cdbOff, got)
+		}
+	}
+
+	// A 16 byte CDB starting 8 bytes before the end of its entry.
+	vbd.mmap[end-8] = scsi.Read16
+	byteOrder.PutUint64(vbd.mmap[off+offReqCdbOff:], end-8)
+	if got, err := vbd.entCdb(off); err == nil {
+		t.Errorf("overrunning CDB: entCdb = %x, want an error", got)
+	}
+}
+
+func TestEntIovecs(t *testing.T) {
+	vbd := newTestMailbox(1024, 4096)
+	dataOff := vbd.dataOff()
+	mapLen := uint64(len(vbd.mmap))
+	off, _ := putTestCmd(vbd, 0, rw10(scsi.Read10, 0, 2), [2]uint64{dataOff, 512}, [2]uint64{dataOff + 2048, 512})
+	vecs, err := vbd.entIovecs(off)
+	if err != nil || len(vecs) != 2 || len(vecs[0]) != 512 || &vecs[1][0] != &vbd.mmap[dataOff+2048] {
+		t.Fatalf("entIovecs = %d iovecs, %v", len(vecs), err)
+	}
+
+	tests := []struct {
+		name string
+		iov  [2]uint64
+	}{
+		{"in the mailbox", [2]uint64{0, 64}},
+		{"in the command ring", [2]uint64{dataOff - 512, 512}},
+		{"past the map", [2]uint64{mapLen + 512, 512}},
+		{"running past the map", [2]uint64{dataOff, mapLen}},
+		{"wrapping length", [2]uint64{dataOff + 512, 1<<64 - 256}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			putIovec(vbd.mmap[off:], 1, tt.iov[0], tt.iov[1])
+			if vecs, err := vbd.entIovecs(off); err == nil {
+				t.Fatalf("entIovecs = %d iovecs, want an error", len(vecs))
+			}
+		})
+	}
+
+	byteOrder.PutUint32(vbd.mmap[off+offReqIovCnt:], 1<<31)
+	if vecs, err := vbd.entIovecs(off); err == nil {
+		t.Fatalf("iov_cnt past the entry: entIovecs = %d iovecs, want an error", len(vecs))
+	}
+}
+
+func TestGetNextCommandBadHead(t *testing.T) {
+	for _, head := range []uint32{12, 1024, 1 << 31} {
+		vbd := newTestMailbox(1024, 4096)
+		putTestCmd(vbd, 0, testUnitReady)
+		byteOrder.PutUint32(vbd.mmap[mbOffCmdHead:], head)
+		if cmd, err := vbd.getNextCommand(); err == nil || cmd != nil {
+			t.Fatalf("cmd_head %d: getNextCommand = %v, %v, want an error", head, cmd, err)
+		}
+
+		// Once the ring is broken, it stays broken.
+		_, size := putTestCmd(vbd, 0, testUnitReady)
+		byteOrder.PutUint32(vbd.mmap[mbOffCmdHead:], size)
+		if cmd, err := vbd.getNextCommand(); err == nil || cmd != nil {
+			t.Fatalf("after cmd_head %d: getNextCommand = %v, %v, want an error", head, cmd, err)
+		}
+	}
+
+	// A head that cuts an entry short.
+	vbd := newTestMailbox(1024, 4096)
+	_, size := putTestCmd(vbd, 0, testUnitReady)
+	byteOrder.PutUint32(vbd.mmap[mbOffCmdHead:], size-8)
+	if cmd, err := vbd.getNextCommand(); err == nil || cmd != nil {
+		t.Fatalf("getNextCommand = %v, %v, want an error", cmd, err)
+	}
+}
+
+func TestCommandOutlivesEntry(t *testing.T) {
+	vbd := newTestMailbox(1024, 4096)
+	dataOff := vbd.dataOff()
+	cdb := rw10(scsi.Write10, 7, 2)
+	_, size := putTestCmd(vbd, 0, cdb, [2]uint64{dataOff + 512, 1024})
+	byteOrder.PutUint32(vbd.mmap[mbOffCmdHead:], size)
+	cmd, err := vbd.getNextCommand()
+	if err != nil || cmd == nil || cmd.badEntry != nil {
+		t.Fatalf("getNextCommand = %v, %v", cmd, err)
+	}
+
+	// The kernel reuses the ring space once the tail is past the entry, which with out-of-order completion
+	// can happen while the command is still being handled.
+	cmdr := vbd.mmap[mbSize : mbSize+1024]
+	for i := range cmdr {
+		cmdr[i] = 0xff
+	}
+	if !bytes.Equal(cmd.cdb, cdb) {
+		t.Fatalf("CDB changed with its entry: %x, want %x", cmd.cdb, cdb)
+	}
+	if len(cmd.vecs) != 1 || len(cmd.vecs[0]) != 1024 || &cmd.vecs[0][0] != &vbd.mmap[dataOff+512] {
+		t.Fatalf("iovecs changed with their entry")
+	}
+}
+
+func FuzzCheckEnt(f *testing.F) {
+	f.Add(uint32(1024), uint32(0), uint32(128|tcmuOpCmd), uint32(128))
+	f.Add(uint32(1024), uint32(960), uint32(64), uint32(0))
+	f.Add(uint32(1024), uint32(960), uint32(128|tcmuOpCmd), uint32(952))
+	f.Add(uint32(1024), uint32(0), uint32(0xfffffff8|tcmuOpTmr), uint32(8))
+	f.Fuzz(func(t *testing.T, cmdrSize, ringOff, lenOp, head uint32) {
+		// checkEnt is only called with the ring checked against the map and the tail and head aligned and
+		// inside it.
+		cmdrSize = (cmdrSize%4096)&^(entAlignSize-1) + cmdEntrySize
+		ringOff = (ringOff % cmdrSize) &^ (entAlignSize - 1)
+		head = (head % cmdrSize) &^ (entAlignSize - 1)
+		vbd := newTestMailbox(int(cmdrSize), 0)
+		if err := vbd.checkMailbox(); err != nil {
+			t.Fatal(err)
+		}
+		off := mbSize + int(ringOff)
+		byteOrder.PutUint32(vbd.mmap[off+offLenOp:], lenOp)
+		if vbd.checkEnt(off, ringOff, head) != nil {
+			return
+		}
+		entLen := uint32(vbd.entHdrGetLen(off))
+		if entLen == 0 || ringOff+entLen > cmdrSize || entLen > (head+cmdrSize-ringOff)%cmdrSize {
+			t.Fatalf("accepted a %d byte entry at %d with the head at %d in a %d byte ring", entLen, ringOff, head, cmdrSize)
+		}
+		if vbd.entHdrOp(off) == tcmuOpCmd && entLen < cmdEntrySize {
+			t.Fatalf("accepted a %d byte command entry", entLen)
+		}
+	})
+}
+
+func FuzzGetNextCommand(f *testing.F) {
+	seed := newTestMailbox(1024, 4096)
+	off, size := putTestCmd(seed, 0, rw10(scsi.Read10, 0, 1), [2]uint64{seed.dataOff(), 512})
+	f.Add(seed.mmap[off:off+int(size)], size, uint32(1024))
+	f.Add([]byte{0, 1, 0, 0, 0, 0, 0, 0}, uint32(128), uint32(256))
+	f.Fuzz(func(t *testing.T, ring []byte, head uint32, cmdrSize uint32) {
+		sh := &ScsiHandler{VolumeName: "t", DataSizes: DataSizes{1 << 20, 512}, WWN: GenerateTestWWN("t"),
+			Handler: memHandler(1 << 20)}
+		dev := allocVirtBlockDevice("", sh, Roots{})
+		dev.mmap = newTestMailbox(2048, 4096).mmap
+		byteOrder.PutUint32(dev.mmap[mbOffCmdrSize:], cmdrSize%2048)
+		byteOrder.PutUint32(dev.mmap[mbOffCmdHead:], head%2048)
+		copy(dev.mmap[mbSize:mbSize+2048], ring)
+		if dev.checkMailbox() != nil {
+			return
+		}
+		dataOff := uintptr(unsafe.Pointer(&dev.mmap[dev.dataOff()]))
+		end := uintptr(unsafe.Pointer(&dev.mmap[0])) + uintptr(len(dev.mmap))
+		for i := 0; i < 64; i++ {
+			cmd, err := dev.getNextCommand()
+			if err != nil || cmd == nil {
+				return
+			}
+			if cmd.badEntry == nil {
+				if n, err := scsi.CDBLen(cmd.cdb); err != nil || n != len(cmd.cdb) {
+					t.Fatalf("accepted CDB %x", cmd.cdb)
+				}
+				for _, v := range cmd.vecs {
+					if len(v) == 0 {
+						continue
+					}
+					if p := uintptr(unsafe.Pointer(&v[0])); p < dataOff || p+uintptr(len(v)) > end {
+						t.Fatalf("accepted an iovec outside the data area")
+					}
+				}
+			}
+			dev.handleCommand(cmd)
+		}
+	})
+}
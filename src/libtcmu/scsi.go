@@ -2,10 +2,8 @@ package tcmu
 
 import (
 	"crypto/md5"
-	"encoding/binary"
 	"encoding/hex"
 	"errors"
-	"fmt"
 	"io"
 	"sync"
 
@@ -24,7 +22,10 @@ type ScsiCmd struct {
 	vecs      [][]byte
 	offset    int
 	vecoffset int
+	written   int
 	vbd       *VirBlkDev
+	// badEntry is why the ring entry this command came from couldn't be decoded, if it couldn't.
+	badEntry error
 
 	//Buffer, if provided, may be used as a scratch buffer for copying data to and from the kernel.
 	Buffer    []byte
@@ -35,6 +36,23 @@ type ScsiResponse struct {
 	id          uint16
 	status      byte
 	senseBuffer []byte
+	// unknownOp sets TCMU_UFLAG_UNKNOWN_OP on the completion.
+	unknownOp bool
+	// readLen, if readLenSet, is how much data-in was actually transferred.
+	readLen    uint32
+	readLenSet bool
+}
+
+// WithReadLen returns the response reporting that only n bytes of data-in were transferred. If the kernel
+// supports TCMU_UFLAG_READ_LEN the rest of the buffer is reported to the initiator as residual; otherwise
+// n is ignored and the whole buffer is transferred.
+func (r ScsiResponse) WithReadLen(n int) ScsiResponse {
+	if n < 0 {
+		n = 0
+	}
+	r.readLen = uint32(n)
+	r.readLenSet = true
+	return r
 }
 
 // ScsiCmd Ring buffer
@@ -45,6 +63,11 @@ type ScsiResponseRing struct {
 	data     []*ScsiResponse
 }
 
+// ID returns the cmd_id the kernel gave this command, which is how a Tmr refers to it.
+func (cmd *ScsiCmd) ID() uint16 {
+	return cmd.id
+}
+
 // Command returns the SCSI command byte for the command. Useful when used as a comparision to the constants in the scsi package:
 // c.Command() == scsi.Read6
 func (cmd *ScsiCmd) Command() byte {
@@ -53,61 +76,32 @@ func (cmd *ScsiCmd) Command() byte {
 
 // CdbLen returns the length of the command, in bytes.
 func (cmd *ScsiCmd) CdbLen() int {
-	opcode := cmd.cdb[0]
-	// See spc-4 4.2.5.1 operation code
-	//
-	if opcode <= 0x1f {
-		return 6
-	} else if opcode <= 0x5f {
-		return 10
-	} else if opcode == 0x7f {
-		return int(cmd.cdb[7]) + 8
-	} else if opcode >= 0x80 && opcode <= 0x9f {
-		return 16
-	} else if opcode >= 0xa0 && opcode <= 0xbf {
-		return 12
-	}
-	panic(fmt.Sprintf("what opcode is %x", opcode))
+	return len(cmd.cdb)
+}
+
+// CDB decodes the command's CDB into its fields.
+func (cmd *ScsiCmd) CDB() (scsi.CDB, error) {
+	return scsi.ParseCDB(cmd.cdb)
 }
 
 // LBA returns the block address that this command wishes to access.
 func (cmd *ScsiCmd) LBA() uint64 {
-	order := binary.BigEndian
-
-	switch cmd.CdbLen() {
-	case 6:
-		val6 := uint8(order.Uint16(cmd.cdb[2:4]))
-		if val6 == 0 {
-			return 256
-		}
-		return uint64(val6)
-	case 10:
-		return uint64(order.Uint32(cmd.cdb[2:6]))
-	case 12:
-		return uint64(order.Uint32(cmd.cdb[2:6]))
-	case 16:
-		return uint64(order.Uint64(cmd.cdb[2:10]))
-	default:
-		panic("unusal scsi command length")
+	c, err := cmd.CDB()
+	if err != nil {
+		log.Debugf("What LBA has this CDB: %s", err)
+		return 0
 	}
+	return c.LBA
 }
 
 // XferLen returns the length of the data buffer this command provides for transfering data to/from the kernel.
 func (c *ScsiCmd) XferLen() uint32 {
-	order := binary.BigEndian
-	switch c.CdbLen() {
-	case 6:
-		return uint32(c.cdb[4])
-	case 10:
-		return uint32(order.Uint16(c.cdb[7:9]))
-	case 12:
-		return uint32(order.Uint32(c.cdb[6:10]))
-	case 16:
-		return uint32(order.Uint32(c.cdb[10:14]))
-	default:
-		log.Debugf("What XferLen has this length: %d", c.CdbLen())
-		panic("unusal scsi command length")
+	cdb, err := c.CDB()
+	if err != nil {
+		log.Debugf("What XferLen has this CDB: %s", err)
+		return 0
 	}
+	return cdb.TransferLength
 }
 
 // Write, for a ScsiCmd is a io.Writer to the data buffer attached to this ScsiCmd command.
@@ -126,6 +120,7 @@ func (cmd *ScsiCmd) Write(b []byte) (int, error) {
 		boff += wrote
 		toWrite -= wrote
 		cmd.offset += wrote
+		cmd.written += wrote
 		if cmd.offset == len(cmd.vecs[cmd.vecoffset]) {
 			cmd.vecoffset++
 			cmd.offset = 0
@@ -168,8 +163,37 @@ func (cmd *ScsiCmd) Ok() ScsiResponse {
 	}
 }
 
+// OkLen creates a successful response that transferred only n bytes of data-in. See ScsiResponse.WithReadLen.
+func (cmd *ScsiCmd) OkLen(n int) ScsiResponse {
+	return cmd.Ok().WithReadLen(n)
+}
+
+// WriteData writes as much of data as fits in the data buffer and creates a successful response reporting
+// how much was transferred, so that a reply shorter or longer than the initiator's allocation length is
+// reported honestly rather than failing the command.
+func (cmd *ScsiCmd) WriteData(data []byte) ScsiResponse {
+	if left := cmd.BufferLen() - cmd.written; len(data) > left {
+		data = data[:left]
+	}
+	cmd.Write(data)
+	return cmd.OkLen(cmd.written)
+}
+
+// BufferLen returns the size of the data buffer the kernel attached to this command.
+func (cmd *ScsiCmd) BufferLen() int {
+	n := 0
+	for _, v := range cmd.vecs {
+		n += len(v)
+	}
+	return n
+}
+
 // GetCDB returns the byte at `index` inside the command.
+// Bytes past the end of the CDB read as zero.
 func (cmd *ScsiCmd) GetCDB(index int) byte {
+	if index < 0 || index >= len(cmd.cdb) {
+		return 0
+	}
 	return cmd.cdb[index]
 }
 
@@ -193,28 +217,28 @@ func (cmd *ScsiCmd) ResponseSenseData(status byte, sense []byte) ScsiResponse {
 
 // NotHandled creates a response and sense data that tells the kernel this device does not emulate this command.
 func (cmd *ScsiCmd) NotHandled() ScsiResponse {
-	buf := make([]byte, SENSE_BUFFER_SIZE)
-	buf[0] = 0x70 // fixed, current
-	buf[2] = 0x5  // illegal request
-	buf[7] = 0xa
-	buf[12] = 0x20 // ASC: invalid command operation code
-	buf[13] = 0x0  // ASCQ: (none)
+	return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidCommandOperationCode)
+}
 
-	return ScsiResponse{
-		id:          cmd.id,
-		status:      scsi.SamStatCheckCondition,
-		senseBuffer: buf,
-	}
+// PassToKernel creates a response that hands the command back to target_core with TCMU_UFLAG_UNKNOWN_OP
+// set, so the kernel can deal with a command this device doesn't emulate. The sense is that of NotHandled,
+// for a kernel that reports the command as unsupported instead.
+func (cmd *ScsiCmd) PassToKernel() ScsiResponse {
+	resp := cmd.NotHandled()
+	resp.unknownOp = true
+	return resp
 }
 
 // CheckCondition returns a response providing extra sense data. Takes a Sense Key and an Additional Sense Code.
 func (cmd *ScsiCmd) CheckCondition(key byte, asc uint16) ScsiResponse {
+	return cmd.SenseData(scsi.Sense{Key: key, Asc: asc})
+}
+
+// SenseData returns a CHECK CONDITION response with the given sense data, in descriptor format if the D_SENSE
+// bit of the Control mode page is set and in fixed format if not.
+func (cmd *ScsiCmd) SenseData(sense scsi.Sense) ScsiResponse {
 	buf := make([]byte, SENSE_BUFFER_SIZE)
-	buf[0] = 0x70 // fixed, current
-	buf[2] = key
-	buf[7] = 0xa
-	buf[12] = byte(uint8((asc >> 8) & 0xff)) // high 8 bits
-	buf[13] = byte(uint8(asc & 0xff))        // low 8 bits
+	copy(buf, sense.Bytes(cmd.vbd != nil && cmd.vbd.DescriptorSense()))
 
 	return ScsiResponse{
 		id:          cmd.id,
@@ -223,6 +247,29 @@ func (cmd *ScsiCmd) CheckCondition(key byte, asc uint16) ScsiResponse {
 	}
 }
 
+// InvalidFieldInCDB is ILLEGAL REQUEST, INVALID FIELD IN CDB, with a field pointer at byte field, bit bit of
+// the CDB, or at the whole byte if bit is -1.
+func (cmd *ScsiCmd) InvalidFieldInCDB(field int, bit int) ScsiResponse {
+	return cmd.SenseData(scsi.InvalidFieldInCDB(field, bit))
+}
+
+// InvalidFieldInParameterList is ILLEGAL REQUEST, INVALID FIELD IN PARAMETER LIST, with a field pointer at byte
+// field, bit bit of the parameter list, or at the whole byte if bit is -1.
+func (cmd *ScsiCmd) InvalidFieldInParameterList(field int, bit int) ScsiResponse {
+	return cmd.SenseData(scsi.InvalidFieldInParameterList(field, bit))
+}
+
+// Miscompare is the response for a COMPARE AND WRITE or VERIFY whose data didn't match, offset being the
+// number of bytes into the data-out buffer of the first that differed. It goes in the INFORMATION field.
+func (cmd *ScsiCmd) Miscompare(offset int) ScsiResponse {
+	return cmd.SenseData(scsi.Sense{
+		Key:              scsi.SenseMiscompare,
+		Asc:              scsi.AscMiscompareDuringVerifyOperation,
+		Information:      uint64(offset),
+		InformationValid: true,
+	})
+}
+
 // MediumError is a preset response for a read error condition from the device
 func (cmd *ScsiCmd) MediumError() ScsiResponse {
 	return cmd.CheckCondition(scsi.SenseMediumError, scsi.AscReadError)
@@ -243,6 +290,146 @@ type DataSizes struct {
 	SectorSize int64
 }
 
+// DeviceOptions are the optional, per-device settings for an emulated SCSI device. The zero value handles
+// commands serially.
+type DeviceOptions struct {
+	// Workers is the number of goroutines commands are dispatched to. Zero or one handles each command on
+	// the poll goroutine, one at a time. With more, a slow command no longer holds up the rest, but
+	// completions are still written to the ring in the order the commands arrived.
+	Workers int
+	// QueueDepth bounds how many commands the pool may have in flight before the poll goroutine stops
+	// taking more from the ring. Defaults to CMD_RING_SIZE, and is cut to the number of commands the
+	// kernel's command ring can hold.
+	QueueDepth int
+	// BlockLimits are reported in the Block Limits VPD page and enforced by the emulated commands.
+	BlockLimits BlockLimits
+	// RotationRate is reported in the Block Device Characteristics VPD page: ROTATION_RATE_NON_ROTATING for
+	// an SSD-like device, or the speed in rpm. Zero reports nothing.
+	RotationRate uint16
+	// StateDir is a directory the device keeps state in from one run to the next, such as saved mode pages
+	// and the states of its target port groups. Without one, nothing is kept, and saving mode pages isn't
+	// supported.
+	StateDir string
+	// Provisioning is reported in the Logical Block Provisioning VPD page. The zero value reports thin
+	// provisioning if the handler supports UNMAP and full provisioning if not.
+	Provisioning ProvisioningType
+	// EmulateReservations has PERSISTENT RESERVE IN and OUT, RESERVE and RELEASE handled here instead of by
+	// target_core. The device's emulate_pr attribute is cleared before it's enabled, so that the kernel passes
+	// them on, and creating the device fails on a kernel without that attribute. Every command comes from the
+	// device's one loopback nexus (see ScsiCmd.Nexus), which therefore always has access: RESERVATION CONFLICT
+	// is only returned for a reservation held by another nexus, as loaded from a PRStore shared with another
+	// device.
+	EmulateReservations bool
+	// PRStore keeps persistent reservations from one run to the next, with EmulateReservations. Defaults to
+	// a file in StateDir, if there is one; without either, they last only as long as the device.
+	PRStore PRStore
+	// ALUA sets up target port groups, reported through REPORT TARGET PORT GROUPS. The zero value leaves
+	// ALUA out.
+	ALUA ALUAOptions
+}
+
+// ROTATION_RATE_NON_ROTATING is the RotationRate of a device with no spinning medium.
+const ROTATION_RATE_NON_ROTATING = 1
+
+// ProvisioningType is how a device's blocks are provisioned, as reported to initiators.
+type ProvisioningType uint8
+
+const (
+	// ProvisioningDefault is thin if the handler supports UNMAP, otherwise full.
+	ProvisioningDefault ProvisioningType = iota
+	ProvisioningFull
+	// ProvisioningResource is resource provisioned: blocks are allocated up front, but UNMAP may release them.
+	ProvisioningResource
+	ProvisioningThin
+)
+
+// BlockLimits are limits on single commands that a device reports to initiators. Zero fields take defaults.
+type BlockLimits struct {
+	// MaxTransferLength is the most blocks a READ or WRITE may transfer. Defaults to what the kernel allows
+	// by default, DEFAULT_MAX_SECTORS 512 byte sectors.
+	MaxTransferLength uint32
+	// OptimalTransferLength is the transfer size in blocks above which performance may suffer. Defaults to
+	// MaxTransferLength.
+	OptimalTransferLength uint32
+	// OptimalTransferLengthGranularity is the multiple of blocks transfers should be sized in to avoid a
+	// penalty, eg. a stripe or backend block size. Zero reports nothing.
+	OptimalTransferLengthGranularity uint16
+	// MaxUnmapLBACount is the most blocks an UNMAP may deallocate. Defaults to DEFAULT_MAX_UNMAP_LBA_COUNT.
+	MaxUnmapLBACount uint32
+	// MaxUnmapDescriptors is the most block descriptors an UNMAP may carry. Defaults to
+	// DEFAULT_MAX_UNMAP_DESCRIPTORS.
+	MaxUnmapDescriptors uint32
+	// OptimalUnmapGranularity is the number of blocks UNMAP deallocates in, eg. the backend's allocation
+	// unit. Zero reports nothing.
+	OptimalUnmapGranularity uint32
+	// UnmapGranularityAlignment is the first LBA at which an OptimalUnmapGranularity sized unit starts.
+	// It's only reported along with an OptimalUnmapGranularity.
+	UnmapGranularityAlignment uint32
+	// MaxWriteSameLength is the most blocks a WRITE SAME may write. Defaults to DEFAULT_MAX_WRITE_SAME_LENGTH.
+	MaxWriteSameLength uint64
+	// MaxCompareAndWriteLength is the most blocks a COMPARE AND WRITE may compare and write. Defaults to
+	// DEFAULT_MAX_COMPARE_AND_WRITE_LENGTH.
+	MaxCompareAndWriteLength uint8
+}
+
+const (
+	// The kernel's default hw_max_sectors for a target_core_user device.
+	DEFAULT_MAX_SECTORS           = 128
+	DEFAULT_MAX_UNMAP_LBA_COUNT   = 4 * 1024 * 1024
+	DEFAULT_MAX_UNMAP_DESCRIPTORS = 256
+	DEFAULT_MAX_WRITE_SAME_LENGTH = 4 * 1024 * 1024
+	// One block is what VMFS uses for its locks.
+	DEFAULT_MAX_COMPARE_AND_WRITE_LENGTH = 1
+)
+
+func (o DeviceOptions) blockLimits(sectorSize int64) BlockLimits {
+	l := o.BlockLimits
+	if l.MaxTransferLength == 0 && sectorSize > 0 {
+		l.MaxTransferLength = uint32(DEFAULT_MAX_SECTORS * 512 / sectorSize)
+	}
+	if l.MaxTransferLength == 0 {
+		l.MaxTransferLength = 1
+	}
+	if l.OptimalTransferLength == 0 || l.OptimalTransferLength > l.MaxTransferLength {
+		l.OptimalTransferLength = l.MaxTransferLength
+	}
+	if l.MaxUnmapLBACount == 0 {
+		l.MaxUnmapLBACount = DEFAULT_MAX_UNMAP_LBA_COUNT
+	}
+	if l.MaxUnmapDescriptors == 0 {
+		l.MaxUnmapDescriptors = DEFAULT_MAX_UNMAP_DESCRIPTORS
+	}
+	if l.MaxWriteSameLength == 0 {
+		l.MaxWriteSameLength = DEFAULT_MAX_WRITE_SAME_LENGTH
+	}
+	if l.MaxCompareAndWriteLength == 0 {
+		l.MaxCompareAndWriteLength = DEFAULT_MAX_COMPARE_AND_WRITE_LENGTH
+	}
+	return l
+}
+
+func (o DeviceOptions) provisioning(unmaps bool) ProvisioningType {
+	if o.Provisioning != ProvisioningDefault {
+		return o.Provisioning
+	}
+	if unmaps {
+		return ProvisioningThin
+	}
+	return ProvisioningFull
+}
+
+// queueDepth is QueueDepth, for a command ring with room for ringSlots commands.
+func (o DeviceOptions) queueDepth(ringSlots int) int {
+	depth := CMD_RING_SIZE
+	if o.QueueDepth > 0 {
+		depth = o.QueueDepth
+	}
+	if depth > ringSlots {
+		depth = ringSlots
+	}
+	return depth
+}
+
 type DevReadyFunc func(chan *ScsiCmd, chan ScsiResponse) error
 
 // ScsiHandler is the high-level data for the emulated SCSI device.
@@ -263,6 +450,8 @@ type ScsiHandler struct {
 	//DevReady   DevReadyFunc
 
 	Handler    ScsiCmdHandler
+	// Optional settings for the device.
+	Options    DeviceOptions
 }
 
 // NaaWWN represents the World Wide Name of the SCSI device we are emulating, using the
@@ -0,0 +1,135 @@
+package scsi
+
+import "testing"
+
+func FuzzCDBLen(f *testing.F) {
+	f.Add([]byte{Read6, 0, 0, 0, 1, 0})
+	f.Add([]byte{Read10, 0, 0, 0, 0, 0, 0, 0, 1, 0})
+	f.Add([]byte{Read16})
+	f.Add([]byte{0x60})
+	f.Add([]byte{0xc0})
+	f.Add([]byte{VariableLengthCmd, 0, 0, 0, 0, 0, 0, 0x18})
+	f.Add([]byte{VariableLengthCmd, 0, 0, 0, 0, 0, 0})
+	f.Fuzz(func(t *testing.T, cdb []byte) {
+		n, err := CDBLen(cdb)
+		if err != nil {
+			if len(cdb) != 0 && (cdb[0] != VariableLengthCmd || len(cdb) > 7) {
+				t.Fatalf("CDBLen(%x): %v", cdb, err)
+			}
+			return
+		}
+		if cdb[0] == VariableLengthCmd {
+			if n != int(cdb[7])+8 {
+				t.Fatalf("CDBLen(%x) = %d, want the additional CDB length plus 8", cdb, n)
+			}
+			return
+		}
+		switch n {
+		case 6, 10, 12, 16:
+		default:
+			t.Fatalf("CDBLen(%x) = %d", cdb, n)
+		}
+	})
+}
+
+func TestParseCDB(t *testing.T) {
+	tests := []struct {
+		name string
+		cdb  []byte
+		want CDB
+	}{
+		{"READ(6), 21 bit LBA", []byte{Read6, 0xff, 0xff, 0xfe, 8, 0x80},
+			CDB{Opcode: Read6, Len: 6, LBA: 0x1ffffe, TransferLength: 8, Control: 0x80}},
+		{"WRITE(6), 0 blocks means 256", []byte{Write6, 0, 0, 1, 0, 0},
+			CDB{Opcode: Write6, Len: 6, LBA: 1, TransferLength: 256}},
+		{"INQUIRY, 0 is 0", []byte{Inquiry, 0, 0, 0, 0, 0},
+			CDB{Opcode: Inquiry, Len: 6}},
+		{"WRITE(10) DPO FUA", []byte{Write10, 0x18, 0, 0, 1, 0, 0x05, 0, 8, 0},
+			CDB{Opcode: Write10, Len: 10, LBA: 256, TransferLength: 8, Group: 5, DPO: true, FUA: true}},
+		{"READ(10) RDPROTECT", []byte{Read10, 0x60, 0xff, 0xff, 0xff, 0xff, 0, 0xff, 0xff, 0},
+			CDB{Opcode: Read10, Len: 10, LBA: 0xffffffff, TransferLength: 0xffff, Protect: 3}},
+		{"VERIFY(10) BYTCHK", []byte{Verify, 0x04, 0, 0, 0, 1, 0, 0, 2, 0},
+			CDB{Opcode: Verify, Len: 10, LBA: 1, TransferLength: 2, BytChk: 2}},
+		{"WRITE SAME(10) ANCHOR UNMAP", []byte{WriteSame, 0x18, 0, 0, 0, 1, 0, 0, 2, 0},
+			CDB{Opcode: WriteSame, Len: 10, LBA: 1, TransferLength: 2, Anchor: true, Unmap: true}},
+		{"SYNCHRONIZE CACHE(10) IMMED", []byte{SynchronizeCache, 0x02, 0, 0, 0, 0, 0, 0, 0, 0},
+			CDB{Opcode: SynchronizeCache, Len: 10, Immed: true}},
+		{"PERSISTENT RESERVE IN", []byte{PersistentReserveIn, 0x01, 0, 0, 0, 0, 0, 0, 0x20, 0},
+			CDB{Opcode: PersistentReserveIn, Len: 10, ServiceAction: 1, TransferLength: 0x20}},
+		{"READ(12)", []byte{Read12, 0x08, 0, 0, 0x10, 0, 0, 1, 0, 0, 0x03, 0},
+			CDB{Opcode: Read12, Len: 12, LBA: 0x1000, TransferLength: 0x10000, Group: 3, FUA: true}},
+		{"MAINTENANCE IN", []byte{MaintenanceIn, 0x0a, 0, 0, 0, 0, 0, 0, 0x10, 0, 0, 0},
+			CDB{Opcode: MaintenanceIn, Len: 12, ServiceAction: 0x0a, TransferLength: 0x1000}},
+		{"READ(16)", []byte{Read16, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 1, 0, 0x1f, 0},
+			CDB{Opcode: Read16, Len: 16, LBA: 1 << 32, TransferLength: 256, Group: 0x1f}},
+		{"SERVICE ACTION IN(16)", []byte{ServiceActionIn16, 0x10, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 32, 0, 0},
+			CDB{Opcode: ServiceActionIn16, Len: 16, ServiceAction: 0x10, TransferLength: 32}},
+		{"COMPARE AND WRITE", []byte{CompareAndWrite, 0, 0, 0, 0, 0, 0, 0, 0, 9, 0, 0, 0, 1, 0, 0},
+			CDB{Opcode: CompareAndWrite, Len: 16, LBA: 9, TransferLength: 1}},
+		{"WRITE SAME(16) UNMAP NDOB", []byte{WriteSame16, 0x09, 0, 0, 0, 0, 0, 0, 0, 9, 0, 0, 0, 1, 0, 0},
+			CDB{Opcode: WriteSame16, Len: 16, LBA: 9, TransferLength: 1, Unmap: true, NDOB: true}},
+		{"READ(32) FUA", append([]byte{VariableLengthCmd, 0x04, 0, 0, 0, 0, 0x02, 0x18, 0, byte(Read32), 0x08, 0,
+			0, 0, 0, 0, 0, 0, 0, 7}, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 16),
+			CDB{Opcode: VariableLengthCmd, Len: 32, ServiceAction: Read32, LBA: 7, TransferLength: 16, Group: 2, Control: 0x04, FUA: true}},
+		{"WRITE SAME(32) UNMAP", append([]byte{VariableLengthCmd, 0, 0, 0, 0, 0, 0, 0x18, 0, byte(WriteSame32), 0x08, 0,
+			0, 0, 0, 0, 0, 0, 0, 7}, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1),
+			CDB{Opcode: VariableLengthCmd, Len: 32, ServiceAction: WriteSame32, LBA: 7, TransferLength: 1, Unmap: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseCDB(tt.cdb)
+			if err != nil || got != tt.want {
+				t.Fatalf("ParseCDB(%x) = %+v, %v, want %+v", tt.cdb, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCDBErrors(t *testing.T) {
+	for _, cdb := range [][]byte{
+		nil,
+		{Read10, 0},
+		{Read16, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+		{VariableLengthCmd, 0, 0, 0, 0, 0, 0},
+		{VariableLengthCmd, 0, 0, 0, 0, 0, 0, 0x18, 0, byte(Read32)},
+		// The additional CDB length says 16 bytes, but a READ(32) needs 32.
+		append([]byte{VariableLengthCmd, 0, 0, 0, 0, 0, 0, 0x08, 0, byte(Read32)}, make([]byte, 22)...),
+	} {
+		if c, err := ParseCDB(cdb); err == nil {
+			t.Errorf("ParseCDB(%x) = %+v, want an error", cdb, c)
+		}
+	}
+}
+
+func FuzzParseCDB(f *testing.F) {
+	f.Add([]byte{Read6, 0xff, 0xff, 0xff, 0, 0})
+	f.Add([]byte{Write10, 0x18, 0, 0, 1, 0, 0x05, 0, 8, 0})
+	f.Add([]byte{MaintenanceIn, 0x0a, 0, 0, 0, 0, 0, 0, 0x10, 0, 0, 0})
+	f.Add([]byte{WriteSame16, 0x09, 0, 0, 0, 0, 0, 0, 0, 9, 0, 0, 0, 1, 0, 0})
+	f.Add(append([]byte{VariableLengthCmd, 0, 0, 0, 0, 0, 0, 0x18, 0, byte(Read32)}, make([]byte, 22)...))
+	f.Fuzz(func(t *testing.T, cdb []byte) {
+		c, err := ParseCDB(cdb)
+		if err != nil {
+			return
+		}
+		n, err := CDBLen(cdb)
+		if err != nil || c.Len != n || n > len(cdb) || c.Opcode != cdb[0] {
+			t.Fatalf("ParseCDB(%x) = %+v, but CDBLen = %d, %v", cdb, c, n, err)
+		}
+		if c.Opcode == VariableLengthCmd {
+			if c.ServiceAction != uint16(cdb[8])<<8|uint16(cdb[9]) || c.Control != cdb[1] {
+				t.Fatalf("ParseCDB(%x) = %+v, not decoded as a variable length CDB", cdb, c)
+			}
+		} else if n == 6 {
+			if c.LBA >= 1<<21 {
+				t.Fatalf("ParseCDB(%x): LBA %d is wider than 21 bits", cdb, c.LBA)
+			}
+			if (c.Opcode == Read6 || c.Opcode == Write6) && (c.TransferLength == 0 || c.TransferLength > 256) {
+				t.Fatalf("ParseCDB(%x): transfer length %d", cdb, c.TransferLength)
+			}
+		}
+		if c.CheckRange(1<<20) == nil && c.LBA+uint64(c.TransferLength) > 1<<20 {
+			t.Fatalf("ParseCDB(%x): %d blocks at %d passed CheckRange", cdb, c.TransferLength, c.LBA)
+		}
+	})
+}
@@ -149,6 +149,7 @@ const (
 	Read32        = 0x09
 	Verify32      = 0x0a
 	Write32       = 0x0b
+	WriteVerify32 = 0x0c
 	WriteSame32   = 0x0d
 	/*
 	 * Service action opcodes
@@ -175,15 +176,130 @@ const (
 )
 
 /*
- * Sense codes
+ * Sense codes: the additional sense code in the high byte and the
+ * qualifier in the low byte, as www.t10.org/lists/asc-num.txt has them.
+ * These are the ones that apply to a direct access block device.
  */
 const (
-	AscReadError                       = 0x1100
-	AscParameterListLengthError        = 0x1a00
-	AscInternalTargetFailure           = 0x4400
-	AscMiscompareDuringVerifyOperation = 0x1d00
-	AscInvalidFieldInCdb               = 0x2400
-	AscInvalidFieldInParameterList     = 0x2600
+	AscNoAdditionalSenseInformation               = 0x0000
+	AscFilemarkDetected                           = 0x0001
+	AscEndOfPartitionMediumDetected               = 0x0002
+	AscBeginningOfPartitionMediumDetected         = 0x0004
+	AscEndOfDataDetected                          = 0x0005
+	AscOperationInProgress                        = 0x0016
+	AscCleaningRequested                          = 0x0017
+	AscAtaPassThroughInformationAvailable         = 0x001d
+	AscNoIndexSectorSignal                        = 0x0100
+	AscNoSeekComplete                             = 0x0200
+	AscPeripheralDeviceWriteFault                 = 0x0300
+	AscLunNotReadyCauseNotReportable              = 0x0400
+	AscLunBecomingReady                           = 0x0401
+	AscLunNotReadyInitCmdRequired                 = 0x0402
+	AscLunNotReadyManualInterventionRequired      = 0x0403
+	AscLunNotReadyFormatInProgress                = 0x0404
+	AscLunNotReadyOperationInProgress             = 0x0407
+	AscLunNotReadyLongWriteInProgress             = 0x0408
+	AscLunNotReadySelfTestInProgress              = 0x0409
+	AscLunNotAccessibleAsymmetricAccessTransition = 0x040a
+	AscLunNotAccessibleTargetPortInStandby        = 0x040b
+	AscLunNotAccessibleTargetPortUnavailable      = 0x040c
+	AscLunNotReadyNotifyRequired                  = 0x0411
+	AscLunNotReadyOffline                         = 0x0412
+	AscLunNotReadySpaceAllocationInProgress       = 0x0414
+	AscLunNotReadyStartStopUnitInProgress         = 0x041a
+	AscLunDoesNotRespondToSelection               = 0x0500
+	AscLunCommunicationFailure                    = 0x0800
+	AscLunCommunicationTimeout                    = 0x0801
+	AscWriteError                                 = 0x0c00
+	AscWriteErrorAutoReallocationFailed           = 0x0c02
+	AscWriteErrorRecommendReassignment            = 0x0c03
+	AscIdCrcOrEccError                            = 0x1000
+	AscLogicalBlockGuardCheckFailed               = 0x1001
+	AscLogicalBlockApplicationTagCheckFailed      = 0x1002
+	AscLogicalBlockReferenceTagCheckFailed        = 0x1003
+	AscReadError                                  = 0x1100
+	AscReadRetriesExhausted                       = 0x1101
+	AscErrorTooLongToCorrect                      = 0x1102
+	AscReadErrorAutoReallocateFailed              = 0x1104
+	AscReadErrorLbaMarkedBadByClient              = 0x1114
+	AscRecordedEntityNotFound                     = 0x1400
+	AscRecordNotFound                             = 0x1401
+	AscRandomPositioningError                     = 0x1500
+	AscRecoveredDataWithNoErrorCorrection         = 0x1700
+	AscRecoveredDataWithErrorCorrection           = 0x1800
+	AscParameterListLengthError                   = 0x1a00
+	AscSynchronousDataTransferError               = 0x1b00
+	AscMiscompareDuringVerifyOperation            = 0x1d00
+	AscMiscompareVerifyOfUnmappedLba              = 0x1d01
+	AscInvalidCommandOperationCode                = 0x2000
+	AscAccessDeniedInitiatorPendingEnrolled       = 0x2001
+	AscLbaOutOfRange                              = 0x2100
+	AscInvalidElementAddress                      = 0x2101
+	AscInvalidFieldInCdb                          = 0x2400
+	AscCdbDecryptionError                         = 0x2401
+	AscLunNotSupported                            = 0x2500
+	AscInvalidFieldInParameterList                = 0x2600
+	AscParameterNotSupported                      = 0x2601
+	AscParameterValueInvalid                      = 0x2602
+	AscThresholdParametersNotSupported            = 0x2603
+	AscInvalidReleaseOfPersistentReservation      = 0x2604
+	AscWriteProtected                             = 0x2700
+	AscHardwareWriteProtected                     = 0x2701
+	AscLunSoftwareWriteProtected                  = 0x2702
+	AscSpaceAllocFailedWriteProtect               = 0x2707
+	AscNotReadyToReadyChange                      = 0x2800
+	AscPowerOnResetOrBusDeviceResetOccurred       = 0x2900
+	AscPowerOnOccurred                            = 0x2901
+	AscScsiBusResetOccurred                       = 0x2902
+	AscBusDeviceResetFunctionOccurred             = 0x2903
+	AscDeviceInternalReset                        = 0x2904
+	AscItNexusLossOccurred                        = 0x2907
+	AscParametersChanged                          = 0x2a00
+	AscModeParametersChanged                      = 0x2a01
+	AscLogParametersChanged                       = 0x2a02
+	AscReservationsPreempted                      = 0x2a03
+	AscReservationsReleased                       = 0x2a04
+	AscRegistrationsPreempted                     = 0x2a05
+	AscAsymmetricAccessStateChanged               = 0x2a06
+	AscImplicitAsymmetricAccessTransitionFailed   = 0x2a07
+	AscCapacityDataHasChanged                     = 0x2a09
+	AscTimestampChanged                           = 0x2a10
+	AscCommandSequenceError                       = 0x2c00
+	AscPreviousReservationConflictStatus          = 0x2c09
+	AscCommandsClearedByAnotherInitiator          = 0x2f00
+	AscCommandsClearedByPowerLossNotification     = 0x2f01
+	AscCommandsClearedByDeviceServer              = 0x2f02
+	AscMediumFormatCorrupted                      = 0x3100
+	AscFormatCommandFailed                        = 0x3101
+	AscThinProvisioningSoftThresholdReached       = 0x3807
+	AscSavingParametersNotSupported               = 0x3900
+	AscMediumNotPresent                           = 0x3a00
+	AscLunHasNotSelfConfiguredYet                 = 0x3e00
+	AscLunFailure                                 = 0x3e01
+	AscTimeoutOnLun                               = 0x3e02
+	AscLunFailedSelfTest                          = 0x3e03
+	AscTargetOperatingConditionsHaveChanged       = 0x3f00
+	AscMicrocodeHasBeenChanged                    = 0x3f01
+	AscInquiryDataHasChanged                      = 0x3f03
+	AscReportedLunsDataHasChanged                 = 0x3f0e
+	AscInternalTargetFailure                      = 0x4400
+	AscScsiParityError                            = 0x4700
+	AscInitiatorDetectedErrorMessageReceived      = 0x4800
+	AscInvalidMessageError                        = 0x4900
+	AscDataPhaseError                             = 0x4b00
+	AscLunFailedSelfConfiguration                 = 0x4c00
+	AscOverlappedCommandsAttempted                = 0x4e00
+	AscMediaLoadOrEjectFailed                     = 0x5300
+	AscMediumRemovalPrevented                     = 0x5302
+	AscSystemResourceFailure                      = 0x5500
+	AscInsufficientResources                      = 0x5503
+	AscInsufficientRegistrationResources          = 0x5504
+	AscFailurePredictionThresholdExceeded         = 0x5d00
+	AscFailurePredictionThresholdExceededFalse    = 0x5dff
+	AscLowPowerConditionOn                        = 0x5e00
+	AscIdleConditionActivatedByTimer              = 0x5e01
+	AscStandbyConditionActivatedByTimer           = 0x5e02
+	AscSetTargetPortGroupsCommandFailed           = 0x670a
 )
 
 /*
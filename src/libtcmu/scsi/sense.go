@@ -0,0 +1,185 @@
+package scsi
+
+import (
+	"encoding/binary"
+)
+
+// Sense response codes, from the first byte of the sense data.
+const (
+	SenseFixedCurrent       = 0x70
+	SenseFixedDeferred      = 0x71
+	SenseDescriptorCurrent  = 0x72
+	SenseDescriptorDeferred = 0x73
+)
+
+// Sense data descriptor types. See spc-4 4.5.2 descriptor format sense data.
+const (
+	SenseDescInformation      = 0x00
+	SenseDescCommandSpecific  = 0x01
+	SenseDescSenseKeySpecific = 0x02
+	SenseDescStreamCommands   = 0x04
+	SenseDescBlockCommands    = 0x05
+)
+
+// Sense is the sense data of a CHECK CONDITION, which Fixed and Descriptor encode in either format. Only Key
+// and Asc are needed; the rest are left out when zero.
+type Sense struct {
+	Key byte
+	// Asc is the additional sense code in the high byte and its qualifier in the low byte.
+	Asc uint16
+	// Deferred reports an error from a command that has already completed, eg. a write cached with GOOD
+	// status that failed later, rather than from the command the sense is returned for.
+	Deferred bool
+
+	// Information, if InformationValid, is the INFORMATION field, eg. the LBA of a block that couldn't be
+	// read, or the offset of the first byte that didn't match for MISCOMPARE.
+	Information      uint64
+	InformationValid bool
+	// CommandSpecific is the COMMAND-SPECIFIC INFORMATION field.
+	CommandSpecific uint64
+	// SenseKeySpecific is the three bytes of sense-key specific data, SKSV included, from FieldPointer or
+	// Progress.
+	SenseKeySpecific [3]byte
+
+	Filemark bool
+	EOM      bool
+	ILI      bool
+}
+
+// FieldPointer is the sense-key specific data of an ILLEGAL REQUEST, pointing at the field in error: byte
+// field of the CDB if cdb is set, or of the parameter list if not. bit is the most significant bit of the
+// field within that byte, or -1 to point at the whole byte.
+func FieldPointer(cdb bool, field int, bit int) [3]byte {
+	var sks [3]byte
+	sks[0] = 0x80 // SKSV
+	if cdb {
+		sks[0] |= 0x40 // C/D
+	}
+	if bit >= 0 {
+		sks[0] |= 0x08 | byte(bit&0x07) // BPV, BIT POINTER
+	}
+	binary.BigEndian.PutUint16(sks[1:3], uint16(field))
+	return sks
+}
+
+// Progress is the sense-key specific data of a NOT READY or NO SENSE for an operation under way, done being
+// the fraction completed out of 65536.
+func Progress(done uint16) [3]byte {
+	var sks [3]byte
+	sks[0] = 0x80 // SKSV
+	binary.BigEndian.PutUint16(sks[1:3], done)
+	return sks
+}
+
+// InvalidFieldInCDB is the sense for ILLEGAL REQUEST, INVALID FIELD IN CDB, pointing at the field at byte
+// field, bit bit of the CDB. See FieldPointer.
+func InvalidFieldInCDB(field int, bit int) Sense {
+	return Sense{Key: SenseIllegalRequest, Asc: AscInvalidFieldInCdb, SenseKeySpecific: FieldPointer(true, field, bit)}
+}
+
+// InvalidFieldInParameterList is the sense for ILLEGAL REQUEST, INVALID FIELD IN PARAMETER LIST, pointing at
+// the field at byte field, bit bit of the parameter list. See FieldPointer.
+func InvalidFieldInParameterList(field int, bit int) Sense {
+	return Sense{Key: SenseIllegalRequest, Asc: AscInvalidFieldInParameterList, SenseKeySpecific: FieldPointer(false, field, bit)}
+}
+
+// Fixed encodes the sense data in fixed format, 18 bytes long. An Information too big for the four bytes
+// fixed format has for it is left out, with VALID clear, and so is a CommandSpecific too big for its four
+// bytes, which has no VALID bit: the field is zero rather than truncated. Use Descriptor for either.
+func (s Sense) Fixed() []byte {
+	buf := make([]byte, 18)
+	buf[0] = SenseFixedCurrent
+	if s.Deferred {
+		buf[0] = SenseFixedDeferred
+	}
+	if s.InformationValid && s.Information <= 0xffffffff {
+		buf[0] |= 0x80 // VALID
+		binary.BigEndian.PutUint32(buf[3:7], uint32(s.Information))
+	}
+	buf[2] = s.Key & 0x0f
+	if s.Filemark {
+		buf[2] |= 0x80
+	}
+	if s.EOM {
+		buf[2] |= 0x40
+	}
+	if s.ILI {
+		buf[2] |= 0x20
+	}
+	buf[7] = 0x0a // additional sense length
+	if s.CommandSpecific <= 0xffffffff {
+		binary.BigEndian.PutUint32(buf[8:12], uint32(s.CommandSpecific))
+	}
+	buf[12] = byte(s.Asc >> 8)
+	buf[13] = byte(s.Asc)
+	copy(buf[15:18], s.SenseKeySpecific[:])
+	return buf
+}
+
+// Descriptor encodes the sense data in descriptor format, with a descriptor for each of the optional fields
+// that's set.
+func (s Sense) Descriptor() []byte {
+	buf := make([]byte, 8, 64)
+	buf[0] = SenseDescriptorCurrent
+	if s.Deferred {
+		buf[0] = SenseDescriptorDeferred
+	}
+	buf[1] = s.Key & 0x0f
+	buf[2] = byte(s.Asc >> 8)
+	buf[3] = byte(s.Asc)
+
+	if s.InformationValid {
+		d := make([]byte, 12)
+		d[0] = SenseDescInformation
+		d[1] = 0x0a
+		d[2] = 0x80 // VALID
+		binary.BigEndian.PutUint64(d[4:12], s.Information)
+		buf = append(buf, d...)
+	}
+	if s.CommandSpecific != 0 {
+		d := make([]byte, 12)
+		d[0] = SenseDescCommandSpecific
+		d[1] = 0x0a
+		binary.BigEndian.PutUint64(d[4:12], s.CommandSpecific)
+		buf = append(buf, d...)
+	}
+	if s.SenseKeySpecific[0]&0x80 != 0 {
+		d := make([]byte, 8)
+		d[0] = SenseDescSenseKeySpecific
+		d[1] = 0x06
+		copy(d[4:7], s.SenseKeySpecific[:])
+		buf = append(buf, d...)
+	}
+	if s.Filemark || s.EOM {
+		d := make([]byte, 4)
+		d[0] = SenseDescStreamCommands
+		d[1] = 0x02
+		if s.Filemark {
+			d[3] |= 0x80
+		}
+		if s.EOM {
+			d[3] |= 0x40
+		}
+		if s.ILI {
+			d[3] |= 0x20
+		}
+		buf = append(buf, d...)
+	} else if s.ILI {
+		d := make([]byte, 4)
+		d[0] = SenseDescBlockCommands
+		d[1] = 0x02
+		d[3] = 0x20 // ILI
+		buf = append(buf, d...)
+	}
+	buf[7] = byte(len(buf) - 8) // additional sense length
+	return buf
+}
+
+// Bytes encodes the sense data in descriptor format if descriptor is set, as it is when the D_SENSE bit of
+// the Control mode page is, and in fixed format otherwise.
+func (s Sense) Bytes(descriptor bool) []byte {
+	if descriptor {
+		return s.Descriptor()
+	}
+	return s.Fixed()
+}
@@ -0,0 +1,156 @@
+package scsi
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSenseFixed(t *testing.T) {
+	tests := []struct {
+		name  string
+		sense Sense
+		want  []byte
+	}{
+		{
+			"key and asc only",
+			Sense{Key: SenseNotReady, Asc: 0x0401},
+			[]byte{0x70, 0, 0x02, 0, 0, 0, 0, 0x0a, 0, 0, 0, 0, 0x04, 0x01, 0, 0, 0, 0},
+		},
+		{
+			"information",
+			Sense{Key: SenseMediumError, Asc: 0x1100, Information: 0x12345678, InformationValid: true},
+			[]byte{0xf0, 0, 0x03, 0x12, 0x34, 0x56, 0x78, 0x0a, 0, 0, 0, 0, 0x11, 0x00, 0, 0, 0, 0},
+		},
+		{
+			"information overflow",
+			Sense{Key: SenseMediumError, Asc: 0x1100, Information: 0x1_0000_0000, InformationValid: true},
+			[]byte{0x70, 0, 0x03, 0, 0, 0, 0, 0x0a, 0, 0, 0, 0, 0x11, 0x00, 0, 0, 0, 0},
+		},
+		{
+			"information not valid",
+			Sense{Key: SenseMediumError, Asc: 0x1100, Information: 7},
+			[]byte{0x70, 0, 0x03, 0, 0, 0, 0, 0x0a, 0, 0, 0, 0, 0x11, 0x00, 0, 0, 0, 0},
+		},
+		{
+			"command specific",
+			Sense{Key: SenseAbortedCommand, Asc: 0x1d00, CommandSpecific: 0xdeadbeef},
+			[]byte{0x70, 0, 0x0b, 0, 0, 0, 0, 0x0a, 0xde, 0xad, 0xbe, 0xef, 0x1d, 0x00, 0, 0, 0, 0},
+		},
+		{
+			"command specific overflow",
+			Sense{Key: SenseAbortedCommand, Asc: 0x1d00, CommandSpecific: 0x1_dead_beef},
+			[]byte{0x70, 0, 0x0b, 0, 0, 0, 0, 0x0a, 0, 0, 0, 0, 0x1d, 0x00, 0, 0, 0, 0},
+		},
+		{
+			"deferred",
+			Sense{Key: SenseMediumError, Asc: 0x0c00, Deferred: true, Information: 9, InformationValid: true},
+			[]byte{0xf1, 0, 0x03, 0, 0, 0, 0x09, 0x0a, 0, 0, 0, 0, 0x0c, 0x00, 0, 0, 0, 0},
+		},
+		{
+			"field pointer in cdb with bit",
+			InvalidFieldInCDB(10, 7),
+			[]byte{0x70, 0, 0x05, 0, 0, 0, 0, 0x0a, 0, 0, 0, 0, 0x24, 0x00, 0, 0xcf, 0, 0x0a},
+		},
+		{
+			"field pointer in parameter list, whole byte",
+			InvalidFieldInParameterList(0x123, -1),
+			[]byte{0x70, 0, 0x05, 0, 0, 0, 0, 0x0a, 0, 0, 0, 0, 0x26, 0x00, 0, 0x80, 0x01, 0x23},
+		},
+		{
+			"progress",
+			Sense{Key: SenseNotReady, Asc: 0x0404, SenseKeySpecific: Progress(0x8000)},
+			[]byte{0x70, 0, 0x02, 0, 0, 0, 0, 0x0a, 0, 0, 0, 0, 0x04, 0x04, 0, 0x80, 0x80, 0x00},
+		},
+		{
+			"filemark, eom and ili",
+			Sense{Key: SenseNoSense, Filemark: true, EOM: true, ILI: true},
+			[]byte{0x70, 0, 0xe0, 0, 0, 0, 0, 0x0a, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.sense.Fixed(); !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: got % x, want % x", tt.name, got, tt.want)
+		}
+		if got := tt.sense.Bytes(false); !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: Bytes(false) = % x, want % x", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSenseDescriptor(t *testing.T) {
+	tests := []struct {
+		name  string
+		sense Sense
+		want  []byte
+	}{
+		{
+			"key and asc only",
+			Sense{Key: SenseNotReady, Asc: 0x0401},
+			[]byte{0x72, 0x02, 0x04, 0x01, 0, 0, 0, 0},
+		},
+		{
+			"deferred",
+			Sense{Key: SenseMediumError, Asc: 0x0c00, Deferred: true},
+			[]byte{0x73, 0x03, 0x0c, 0x00, 0, 0, 0, 0},
+		},
+		{
+			"information beyond 32 bits",
+			Sense{Key: SenseMediumError, Asc: 0x1100, Information: 0x1_0000_0000, InformationValid: true},
+			[]byte{0x72, 0x03, 0x11, 0x00, 0, 0, 0, 0x0c,
+				0x00, 0x0a, 0x80, 0, 0, 0, 0, 0x01, 0, 0, 0, 0},
+		},
+		{
+			"command specific",
+			Sense{Key: SenseAbortedCommand, Asc: 0x1d00, CommandSpecific: 0x1_dead_beef},
+			[]byte{0x72, 0x0b, 0x1d, 0x00, 0, 0, 0, 0x0c,
+				0x01, 0x0a, 0, 0, 0, 0, 0, 0x01, 0xde, 0xad, 0xbe, 0xef},
+		},
+		{
+			"field pointer",
+			InvalidFieldInCDB(10, 7),
+			[]byte{0x72, 0x05, 0x24, 0x00, 0, 0, 0, 0x08,
+				0x02, 0x06, 0, 0, 0xcf, 0, 0x0a, 0},
+		},
+		{
+			"block ili",
+			Sense{Key: SenseIllegalRequest, Asc: 0x2400, ILI: true},
+			[]byte{0x72, 0x05, 0x24, 0x00, 0, 0, 0, 0x04,
+				0x05, 0x02, 0, 0x20},
+		},
+		{
+			"stream ili",
+			Sense{Key: SenseNoSense, EOM: true, ILI: true},
+			[]byte{0x72, 0x00, 0x00, 0x00, 0, 0, 0, 0x04,
+				0x04, 0x02, 0, 0x60},
+		},
+		{
+			"filemark",
+			Sense{Key: SenseNoSense, Filemark: true},
+			[]byte{0x72, 0x00, 0x00, 0x00, 0, 0, 0, 0x04,
+				0x04, 0x02, 0, 0x80},
+		},
+		{
+			"every descriptor",
+			Sense{Key: SenseMediumError, Asc: 0x1100, Information: 5, InformationValid: true, CommandSpecific: 6,
+				SenseKeySpecific: Progress(1), ILI: true},
+			[]byte{0x72, 0x03, 0x11, 0x00, 0, 0, 0, 0x24,
+				0x00, 0x0a, 0x80, 0, 0, 0, 0, 0, 0, 0, 0, 0x05,
+				0x01, 0x0a, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x06,
+				0x02, 0x06, 0, 0, 0x80, 0x00, 0x01, 0,
+				0x05, 0x02, 0, 0x20},
+		},
+	}
+	for _, tt := range tests {
+		got := tt.sense.Descriptor()
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: got % x, want % x", tt.name, got, tt.want)
+			continue
+		}
+		if int(got[7]) != len(got)-8 {
+			t.Errorf("%s: additional sense length %d, want %d", tt.name, got[7], len(got)-8)
+		}
+		if b := tt.sense.Bytes(true); !bytes.Equal(b, got) {
+			t.Errorf("%s: Bytes(true) = % x, want % x", tt.name, b, got)
+		}
+	}
+}
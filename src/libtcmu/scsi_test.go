@@ -0,0 +1,80 @@
+package tcmu
+
+import (
+	"testing"
+
+	"libtcmu/scsi"
+)
+
+func FuzzScsiCmdCDB(f *testing.F) {
+	f.Add([]byte{scsi.Read6, 0x1f, 0xff, 0xff, 0, 0})
+	f.Add([]byte{scsi.Read10, 0, 0, 0, 0, 0, 0, 0, 1, 0})
+	f.Add([]byte{scsi.WriteSame16, 0x08, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0})
+	f.Add([]byte{scsi.VariableLengthCmd, 0, 0, 0, 0, 0, 0, 0x18, 0, 0x09})
+	f.Add([]byte{0x60, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	f.Add([]byte{0xc0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	f.Fuzz(func(t *testing.T, cdb []byte) {
+		n, err := scsi.CDBLen(cdb)
+		if err != nil || n > len(cdb) {
+			// getNextCommand turns these away before they get this far.
+			return
+		}
+		m := &memRW{b: make([]byte, 1<<20)}
+		sh := &ScsiHandler{VolumeName: "t", DataSizes: DataSizes{1 << 20, 512}, WWN: GenerateTestWWN("t"), Handler: ReadWriteAtCmdHandler{RW: m}}
+		cmd := &ScsiCmd{cdb: cdb[:n], vecs: [][]byte{make([]byte, 4096)}, vbd: allocVirtBlockDevice("", sh, Roots{})}
+		cmd.Command()
+		cmd.CdbLen()
+		cmd.GetCDB(-1)
+		cmd.GetCDB(n)
+		lba, xferLen := cmd.LBA(), cmd.XferLen()
+		if c, err := cmd.CDB(); err == nil {
+			if c.LBA != lba || c.TransferLength != xferLen {
+				t.Fatalf("%x: LBA %d and XferLen %d don't match the parsed CDB %+v", cdb, lba, xferLen, c)
+			}
+			c.CheckRange(1 << 11)
+		}
+		cmd.vbd.handleCommand(cmd)
+	})
+}
+
+func TestReadLen(t *testing.T) {
+	for _, readLen := range []bool{false, true} {
+		// The backend is half the size of the device, so reads past 4KiB come up short.
+		r := newTestRing(t, "t", memHandler(4096), 8192, DeviceOptions{}, FakeRingConfig{ReadLen: readLen})
+
+		fc, err := r.Do(rw10(scsi.Read10, 6, 4), nil, 2048)
+		switch {
+		case err != nil:
+			t.Fatal(err)
+		case !readLen && (fc.Status != scsi.SamStatCheckCondition || fc.Sense[2] != scsi.SenseMediumError):
+			t.Errorf("short READ without READ_LEN: status 0x%02x, want MEDIUM ERROR", fc.Status)
+		case readLen && (fc.Status != scsi.SamStatGood || fc.Residual != 1024 || len(fc.Data) != 1024):
+			t.Errorf("short READ: status 0x%02x, residual %d, %d bytes, want 1024 of each", fc.Status, fc.Residual, len(fc.Data))
+		}
+
+		for _, tt := range []struct {
+			name  string
+			cdb   []byte
+			alloc int
+			// length returns the length of the reply, from its header.
+			length func(data []byte) int
+		}{
+			{"INQUIRY", []byte{scsi.Inquiry, 0, 0, 0, 200, 0}, 200, func(d []byte) int { return int(d[4]) + 5 }},
+			{"INQUIRY cut short", []byte{scsi.Inquiry, 0, 0, 0, 10, 0}, 10, func(d []byte) int { return 10 }},
+			{"MODE SENSE", []byte{scsi.ModeSense, 0, 0x3f, 0, 255, 0}, 255, func(d []byte) int { return int(d[0]) + 1 }},
+		} {
+			fc, err := r.Do(tt.cdb, nil, tt.alloc)
+			if err != nil || fc.Status != scsi.SamStatGood {
+				t.Fatalf("%s: %v, status 0x%02x", tt.name, err, fc.Status)
+			}
+			want := 0
+			if readLen {
+				want = tt.alloc - tt.length(fc.Data)
+			}
+			if fc.Residual != want || len(fc.Data) != tt.alloc-want {
+				t.Errorf("READ_LEN %v: %s: residual %d, %d bytes, want residual %d", readLen, tt.name, fc.Residual, len(fc.Data), want)
+			}
+		}
+		r.Close()
+	}
+}
@@ -0,0 +1,208 @@
+package tcmu
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+
+	"libtcmu/scsi"
+)
+
+// ErrorSense is how a backend error is reported to the initiator: a SCSI status and, for CHECK CONDITION,
+// the sense key and additional sense code.
+type ErrorSense struct {
+	Status byte
+	Key    byte
+	Asc    uint16
+}
+
+// CheckConditionSense is the ErrorSense for a CHECK CONDITION with the given sense key and additional sense code.
+func CheckConditionSense(key byte, asc uint16) ErrorSense {
+	return ErrorSense{Status: scsi.SamStatCheckCondition, Key: key, Asc: asc}
+}
+
+// SenseError is an error that carries its own ErrorSense, for backends that want to choose exactly what the
+// initiator sees.
+type SenseError struct {
+	ErrorSense
+	Err error
+}
+
+func (e *SenseError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("scsi status 0x%02x, sense key 0x%x, asc 0x%04x", e.Status, e.Key, e.Asc)
+	}
+	return e.Err.Error()
+}
+
+func (e *SenseError) Unwrap() error {
+	return e.Err
+}
+
+// Sentinel errors a backend can return (or wrap) to get the matching sense without knowing SCSI.
+var (
+	// ErrWriteProtected reports DATA PROTECT, WRITE PROTECTED.
+	ErrWriteProtected = errors.New("tcmu: backend is write protected")
+	// ErrSpaceExhausted reports DATA PROTECT, SPACE ALLOCATION FAILED WRITE PROTECT, as a thin pool does when it fills up.
+	ErrSpaceExhausted = errors.New("tcmu: backend has no space left")
+	// ErrBusy reports BUSY, which the initiator retries.
+	ErrBusy = errors.New("tcmu: backend busy")
+	// ErrTaskSetFull reports TASK SET FULL, which the initiator retries with a smaller queue.
+	ErrTaskSetFull = errors.New("tcmu: backend task set full")
+	// ErrHardware reports HARDWARE ERROR, INTERNAL TARGET FAILURE.
+	ErrHardware = errors.New("tcmu: backend hardware failure")
+)
+
+// ErrorClassifier maps a backend error to an ErrorSense. ok is false if it doesn't recognise err.
+type ErrorClassifier func(err error) (sense ErrorSense, ok bool)
+
+// SenseClassifier is an optional interface for backends that know best how their own errors should look to
+// the initiator. It's consulted before any registered or built-in mapping.
+type SenseClassifier interface {
+	ClassifyError(err error) (sense ErrorSense, ok bool)
+}
+
+var (
+	classifierLock sync.RWMutex
+	classifiers    []ErrorClassifier
+)
+
+var (
+	senseWriteProtected = CheckConditionSense(scsi.SenseDataProtect, scsi.AscWriteProtected)
+	senseSpaceExhausted = CheckConditionSense(scsi.SenseDataProtect, scsi.AscSpaceAllocFailedWriteProtect)
+	senseBusy           = ErrorSense{Status: scsi.SamStatBusy}
+	senseTaskSetFull    = ErrorSense{Status: scsi.SamStatTaskSetFull}
+	senseHardware       = CheckConditionSense(scsi.SenseHardwareError, scsi.AscInternalTargetFailure)
+)
+
+// builtinSenses are checked in order with errors.Is, after any registered classifiers. Those for writes only
+// are skipped for any other command: a read that's refused permission isn't write protected.
+var builtinSenses = []struct {
+	err    error
+	sense  ErrorSense
+	writes bool
+}{
+	{ErrWriteProtected, senseWriteProtected, false},
+	{syscall.EROFS, senseWriteProtected, false},
+	{syscall.EPERM, senseWriteProtected, true},
+	{syscall.EACCES, senseWriteProtected, true},
+
+	{ErrSpaceExhausted, senseSpaceExhausted, false},
+	{syscall.ENOSPC, senseSpaceExhausted, false},
+	{syscall.EDQUOT, senseSpaceExhausted, false},
+
+	{ErrBusy, senseBusy, false},
+	{syscall.EAGAIN, senseBusy, false},
+	{syscall.EBUSY, senseBusy, false},
+	{syscall.EINTR, senseBusy, false},
+	{syscall.ETIMEDOUT, senseBusy, false},
+	{syscall.ECONNRESET, senseBusy, false},
+	{syscall.ECONNREFUSED, senseBusy, false},
+	{syscall.EHOSTUNREACH, senseBusy, false},
+	{syscall.ENETUNREACH, senseBusy, false},
+
+	{ErrTaskSetFull, senseTaskSetFull, false},
+	{syscall.ENOMEM, senseTaskSetFull, false},
+	{syscall.ENOBUFS, senseTaskSetFull, false},
+
+	{ErrHardware, senseHardware, false},
+	{syscall.EIO, senseHardware, false},
+	{syscall.ENODEV, senseHardware, false},
+	{syscall.ENXIO, senseHardware, false},
+	{syscall.EPERM, senseHardware, false},
+	{syscall.EACCES, senseHardware, false},
+}
+
+// RegisterErrorClassifier adds a process-wide mapping from backend errors to sense. Classifiers are tried
+// most recently registered first, and all of them before the built-in mappings.
+func RegisterErrorClassifier(c ErrorClassifier) {
+	classifierLock.Lock()
+	defer classifierLock.Unlock()
+	classifiers = append([]ErrorClassifier{c}, classifiers...)
+}
+
+// RegisterErrorSense is RegisterErrorClassifier for a single sentinel error, matched with errors.Is.
+func RegisterErrorSense(target error, sense ErrorSense) {
+	RegisterErrorClassifier(func(err error) (ErrorSense, bool) {
+		return sense, errors.Is(err, target)
+	})
+}
+
+// ClassifyError returns the ErrorSense for err from a SenseError in its chain, the registered classifiers or
+// the built-in errno mappings, in that order. ok is false if none of them recognise it. Without a command to
+// go by, EPERM and EACCES are a HARDWARE ERROR, as they are for anything but a write.
+func ClassifyError(err error) (sense ErrorSense, ok bool) {
+	return classifyError(err, false)
+}
+
+func classifyError(err error, write bool) (sense ErrorSense, ok bool) {
+	var se *SenseError
+	if errors.As(err, &se) {
+		return se.ErrorSense, true
+	}
+
+	classifierLock.RLock()
+	cs := classifiers
+	classifierLock.RUnlock()
+	for _, c := range cs {
+		if sense, ok := c(err); ok {
+			return sense, true
+		}
+	}
+
+	for _, b := range builtinSenses {
+		if (write || !b.writes) && errors.Is(err, b.err) {
+			return b.sense, true
+		}
+	}
+	return ErrorSense{}, false
+}
+
+// ErrorResponse creates the response for a backend error while handling this command. Errors nothing
+// recognises are reported as a MEDIUM ERROR.
+func (cmd *ScsiCmd) ErrorResponse(err error) ScsiResponse {
+	sense, ok := classifyError(err, isWriteCommand(cmd))
+	if !ok {
+		if isWriteCommand(cmd) {
+			return cmd.CheckCondition(scsi.SenseMediumError, scsi.AscWriteError)
+		}
+		return cmd.MediumError()
+	}
+	return cmd.SenseResponse(sense)
+}
+
+// SenseResponse creates a response from an ErrorSense.
+func (cmd *ScsiCmd) SenseResponse(sense ErrorSense) ScsiResponse {
+	if sense.Status == scsi.SamStatCheckCondition {
+		return cmd.CheckCondition(sense.Key, sense.Asc)
+	}
+	return cmd.ResponseStatus(sense.Status)
+}
+
+// backendErrorResponse is ErrorResponse, giving backend the first say if it's a SenseClassifier.
+func backendErrorResponse(cmd *ScsiCmd, backend interface{}, err error) ScsiResponse {
+	if c, ok := backend.(SenseClassifier); ok {
+		if sense, ok := c.ClassifyError(err); ok {
+			return cmd.SenseResponse(sense)
+		}
+	}
+	return cmd.ErrorResponse(err)
+}
+
+func isWriteCommand(cmd *ScsiCmd) bool {
+	if cmd.Command() == scsi.VariableLengthCmd {
+		c, _ := cmd.CDB()
+		switch c.ServiceAction {
+		case scsi.Write32, scsi.WriteVerify32, scsi.WriteSame32:
+			return true
+		}
+		return false
+	}
+	switch cmd.Command() {
+	case scsi.Write6, scsi.Write10, scsi.Write12, scsi.Write16, scsi.Unmap, scsi.WriteSame, scsi.WriteSame16,
+		scsi.CompareAndWrite, scsi.WriteVerify, scsi.WriteVerify12, scsi.WriteVerify16:
+		return true
+	}
+	return false
+}
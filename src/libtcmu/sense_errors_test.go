@@ -0,0 +1,137 @@
+package tcmu
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+
+	"libtcmu/scsi"
+)
+
+// errRW fails every read and write with err.
+type errRW struct{ err error }
+
+func (e errRW) ReadAt(p []byte, off int64) (int, error)  { return 0, e.err }
+func (e errRW) WriteAt(p []byte, off int64) (int, error) { return 0, e.err }
+
+// classifyingRW is an errRW that reports its own errors as ABORTED COMMAND.
+type classifyingRW struct{ errRW }
+
+var senseAborted = CheckConditionSense(scsi.SenseAbortedCommand, scsi.AscInternalTargetFailure)
+
+func (classifyingRW) ClassifyError(err error) (ErrorSense, bool) {
+	return senseAborted, errors.Is(err, syscall.EIO)
+}
+
+// saveClassifiers restores the registered classifiers when the test ends.
+func saveClassifiers(t *testing.T) {
+	classifierLock.Lock()
+	saved := classifiers
+	classifierLock.Unlock()
+	t.Cleanup(func() {
+		classifierLock.Lock()
+		classifiers = saved
+		classifierLock.Unlock()
+	})
+}
+
+func TestClassifyError(t *testing.T) {
+	for _, tt := range []struct {
+		err   error
+		sense ErrorSense
+		ok    bool
+	}{
+		{syscall.EROFS, senseWriteProtected, true},
+		{&os.PathError{Op: "write", Path: "x", Err: syscall.ENOSPC}, senseSpaceExhausted, true},
+		{fmt.Errorf("w: %w", syscall.EAGAIN), senseBusy, true},
+		{ErrTaskSetFull, senseTaskSetFull, true},
+		{syscall.EIO, senseHardware, true},
+		{syscall.EPERM, senseHardware, true},
+		{syscall.EACCES, senseHardware, true},
+		{fmt.Errorf("w: %w", &SenseError{ErrorSense: senseAborted, Err: syscall.EROFS}), senseAborted, true},
+		{errors.New("other"), ErrorSense{}, false},
+	} {
+		if sense, ok := ClassifyError(tt.err); sense != tt.sense || ok != tt.ok {
+			t.Errorf("%v: got %+v, %v, want %+v, %v", tt.err, sense, ok, tt.sense, tt.ok)
+		}
+	}
+}
+
+func TestRegisterErrorSense(t *testing.T) {
+	saveClassifiers(t)
+	errThin := errors.New("thin pool full")
+	RegisterErrorSense(errThin, senseBusy)
+	RegisterErrorSense(errThin, senseSpaceExhausted)
+	RegisterErrorSense(syscall.EIO, senseTaskSetFull)
+
+	for _, tt := range []struct {
+		name  string
+		err   error
+		sense ErrorSense
+	}{
+		{"most recently registered first", fmt.Errorf("w: %w", errThin), senseSpaceExhausted},
+		{"registered before built-in", syscall.EIO, senseTaskSetFull},
+		{"SenseError before registered", &SenseError{ErrorSense: senseHardware, Err: syscall.EIO}, senseHardware},
+		{"built-in otherwise", syscall.EROFS, senseWriteProtected},
+	} {
+		if sense, ok := ClassifyError(tt.err); !ok || sense != tt.sense {
+			t.Errorf("%s: got %+v, %v, want %+v", tt.name, sense, ok, tt.sense)
+		}
+	}
+}
+
+func TestSenseErrorMessage(t *testing.T) {
+	if s := (&SenseError{ErrorSense: senseHardware}).Error(); s != "scsi status 0x02, sense key 0x4, asc 0x4400" {
+		t.Errorf("got %q", s)
+	}
+	e := &SenseError{ErrorSense: senseHardware, Err: syscall.EIO}
+	if e.Error() != syscall.EIO.Error() || !errors.Is(e, syscall.EIO) {
+		t.Errorf("%q doesn't wrap EIO", e.Error())
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		rw     ReadWriteAt
+		write  bool
+		status byte
+		key    byte
+		asc    uint16
+	}{
+		{"EPERM write", errRW{syscall.EPERM}, true, scsi.SamStatCheckCondition, scsi.SenseDataProtect, scsi.AscWriteProtected},
+		{"EPERM read", errRW{syscall.EPERM}, false, scsi.SamStatCheckCondition, scsi.SenseHardwareError, scsi.AscInternalTargetFailure},
+		{"EACCES read", errRW{&os.PathError{Op: "read", Path: "x", Err: syscall.EACCES}}, false,
+			scsi.SamStatCheckCondition, scsi.SenseHardwareError, scsi.AscInternalTargetFailure},
+		{"ENOSPC write", errRW{syscall.ENOSPC}, true, scsi.SamStatCheckCondition, scsi.SenseDataProtect, scsi.AscSpaceAllocFailedWriteProtect},
+		{"EAGAIN read", errRW{syscall.EAGAIN}, false, scsi.SamStatBusy, 0, 0},
+		{"unknown write", errRW{errors.New("other")}, true, scsi.SamStatCheckCondition, scsi.SenseMediumError, scsi.AscWriteError},
+		{"unknown read", errRW{errors.New("other")}, false, scsi.SamStatCheckCondition, scsi.SenseMediumError, scsi.AscReadError},
+		{"SenseClassifier first", classifyingRW{errRW{syscall.EIO}}, false,
+			scsi.SamStatCheckCondition, scsi.SenseAbortedCommand, scsi.AscInternalTargetFailure},
+		{"SenseClassifier declines", classifyingRW{errRW{syscall.EROFS}}, true,
+			scsi.SamStatCheckCondition, scsi.SenseDataProtect, scsi.AscWriteProtected},
+	} {
+		r := newTestRing(t, "t", ReadWriteAtCmdHandler{RW: tt.rw}, 1<<20, DeviceOptions{}, FakeRingConfig{})
+		var fc FakeCompletion
+		var err error
+		if tt.write {
+			fc, err = r.Do(rw10(scsi.Write10, 0, 1), make([]byte, 512), 0)
+		} else {
+			fc, err = r.Do(rw10(scsi.Read10, 0, 1), nil, 512)
+		}
+		r.Close()
+		if err != nil || fc.Status != tt.status {
+			t.Errorf("%s: %v, status 0x%02x, want 0x%02x", tt.name, err, fc.Status, tt.status)
+			continue
+		}
+		if tt.status != scsi.SamStatCheckCondition {
+			continue
+		}
+		if key, asc := fc.Sense[2]&0x0f, uint16(fc.Sense[12])<<8|uint16(fc.Sense[13]); key != tt.key || asc != tt.asc {
+			t.Errorf("%s: sense %x/%04x, want %x/%04x", tt.name, key, asc, tt.key, tt.asc)
+		}
+	}
+}
@@ -3,44 +3,123 @@ package tcmu
 import (
 	"encoding/binary"
 	"fmt"
-	"syscall"
+	"sync/atomic"
 	"unsafe"
+
+	"libtcmu/scsi"
 )
 
 var byteOrder binary.ByteOrder = binary.LittleEndian
 
+/*
+struct tcmu_mailbox {
+	__u16 version;
+	__u16 flags;
+	__u32 cmdr_off;
+	__u32 cmdr_size;
+
+	__u32 cmd_head;
+
+	// Updated by user. On its own cacheline
+	__u32 cmd_tail __attribute__((__aligned__(ALIGN_SIZE)));
+
+} __packed;
+*/
+const (
+	mbOffVersion  = 0
+	mbOffFlags    = 2
+	mbOffCmdrOff  = 4
+	mbOffCmdrSize = 8
+	mbOffCmdHead  = 12
+	mbOffCmdTail  = 64
+
+	// sizeof(struct tcmu_mailbox), which is where the kernel starts the command ring.
+	mbSize = 128
+)
+
+const (
+	// sizeof(struct tcmu_cmd_entry): the header, plus the larger of req and rsp.
+	cmdEntrySize = offRespSense + SENSE_BUFFER_SIZE
+	// TCMU_OP_ALIGN_SIZE
+	entAlignSize = 8
+)
+
+// checkMailbox makes sure the command ring the mailbox describes lies inside the map, so that offsets into
+// it only need checking against the ring itself. It's done once, when the device is opened.
+func (vbd *VirBlkDev) checkMailbox() error {
+	if len(vbd.mmap) < mbSize {
+		return fmt.Errorf("uio map of %d bytes has no room for the mailbox", len(vbd.mmap))
+	}
+	off, size := uint64(vbd.mbCmdrOffset()), uint64(vbd.mbCmdrSize())
+	if off < mbSize || off%entAlignSize != 0 || size < cmdEntrySize || size%entAlignSize != 0 || off+size > uint64(len(vbd.mmap)) {
+		return fmt.Errorf("mailbox command ring at %d, %d bytes, doesn't fit in the %d byte uio map", off, size, len(vbd.mmap))
+	}
+	return nil
+}
+
+// dataOff is the offset of the data area, which follows the command ring.
+func (vbd *VirBlkDev) dataOff() uint64 {
+	return uint64(vbd.mbCmdrOffset()) + uint64(vbd.mbCmdrSize())
+}
+
+/*
+#define TCMU_MAILBOX_FLAG_CAP_OOOC (1 << 0) // Out-of-order completions
+#define TCMU_MAILBOX_FLAG_CAP_READ_LEN (1 << 1) // Read data length
+#define TCMU_MAILBOX_FLAG_CAP_TMR (1 << 2) // TMR notifications
+*/
+const (
+	mbFlagCapOOOC    = 1 << 0
+	mbFlagCapReadLen = 1 << 1
+	mbFlagCapTmr     = 1 << 2
+)
+
 func (vbd *VirBlkDev) mbVersion() uint16 {
-	return *(*uint16)(unsafe.Pointer(&vbd.mmap[0]))
+	return *(*uint16)(unsafe.Pointer(&vbd.mmap[mbOffVersion]))
 }
 
 func (vbd *VirBlkDev) mbFlags() uint16 {
-	return *(*uint16)(unsafe.Pointer(&vbd.mmap[2]))
+	return *(*uint16)(unsafe.Pointer(&vbd.mmap[mbOffFlags]))
+}
+
+// mbCapOOOC reports whether the kernel lets commands be completed in any order, identified by cmd_id,
+// rather than in the order they were submitted.
+func (vbd *VirBlkDev) mbCapOOOC() bool {
+	return vbd.mbFlags()&mbFlagCapOOOC != 0
+}
+
+// mbCapReadLen reports whether the kernel honours read_len in a completion flagged TCMU_UFLAG_READ_LEN.
+func (vbd *VirBlkDev) mbCapReadLen() bool {
+	return vbd.mbFlags()&mbFlagCapReadLen != 0
 }
 
 func (vbd *VirBlkDev) mbCmdrOffset() uint32 {
-	return *(*uint32)(unsafe.Pointer(&vbd.mmap[4]))
+	return *(*uint32)(unsafe.Pointer(&vbd.mmap[mbOffCmdrOff]))
 }
 
 func (vbd *VirBlkDev) mbCmdrSize() uint32 {
-	return *(*uint32)(unsafe.Pointer(&vbd.mmap[8]))
+	return *(*uint32)(unsafe.Pointer(&vbd.mmap[mbOffCmdrSize]))
 }
 
+// The head and tail are shared with whoever is on the other side of the
+// mailbox (the kernel, or a FakeRing in the tests), so they're accessed atomically: the
+// entries behind them are only valid once the index has been published.
 func (vbd *VirBlkDev) mbCmdHead() uint32 {
-	return *(*uint32)(unsafe.Pointer(&vbd.mmap[12]))
+	return atomic.LoadUint32((*uint32)(unsafe.Pointer(&vbd.mmap[mbOffCmdHead])))
 }
 
 func (vbd *VirBlkDev) mbCmdTail() uint32 {
-	return *(*uint32)(unsafe.Pointer(&vbd.mmap[64]))
+	return atomic.LoadUint32((*uint32)(unsafe.Pointer(&vbd.mmap[mbOffCmdTail])))
 }
 
 func (vbd *VirBlkDev) mbSetTail(u uint32) {
-	byteOrder.PutUint32(vbd.mmap[64:], u)
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&vbd.mmap[mbOffCmdTail])), u)
 }
 
 /*
 enum tcmu_opcode {
   TCMU_OP_PAD = 0,
   TCMU_OP_CMD,
+  TCMU_OP_TMR,
 };
 */
 type tcmuOpcode int
@@ -48,6 +127,7 @@ type tcmuOpcode int
 const (
 	tcmuOpPad tcmuOpcode = 0
 	tcmuOpCmd            = 1
+	tcmuOpTmr tcmuOpcode = 2
 )
 
 /*
@@ -87,8 +167,17 @@ func (vbd *VirBlkDev) entUflags(off int) uint8 {
 	return *(*uint8)(unsafe.Pointer(&vbd.mmap[off+offUFlags]))
 }
 
+/*
+#define TCMU_UFLAG_UNKNOWN_OP 0x1
+#define TCMU_UFLAG_READ_LEN 0x2
+*/
+const (
+	uflagUnknownOp = 0x1
+	uflagReadLen   = 0x2
+)
+
 func (vbd *VirBlkDev) setEntUflagUnknownOp(off int) {
-	vbd.mmap[off+offUFlags] = 0x01
+	vbd.mmap[off+offUFlags] |= uflagUnknownOp
 }
 
 /*
@@ -136,6 +225,11 @@ func (vbd *VirBlkDev) entReqCdbOff(off int) uint64 {
 	return *(*uint64)(unsafe.Pointer(&vbd.mmap[off+offReqCdbOff]))
 }
 
+func (vbd *VirBlkDev) setEntRespReadLen(off int, readLen uint32) {
+	vbd.mmap[off+offUFlags] |= uflagReadLen
+	*(*uint32)(unsafe.Pointer(&vbd.mmap[off+offRespReadLen])) = readLen
+}
+
 func (vbd *VirBlkDev) setEntRespSCSIStatus(off int, status byte) {
 	vbd.mmap[off+offRespSCSIStatus] = status
 }
@@ -150,35 +244,110 @@ func (vbd *VirBlkDev) copyEntRespSenseData(off int, data []byte) {
 	}
 }
 
-func (vbd *VirBlkDev) entIovecN(off int, idx int) []byte {
-	out := syscall.Iovec{}
-	p := unsafe.Pointer(&vbd.mmap[off+offReqIov0Base])
-	out = *(*syscall.Iovec)(unsafe.Pointer(uintptr(p) + uintptr(idx)*unsafe.Sizeof(out)))
-	moff := *(*int)(unsafe.Pointer(&out.Base))
-	return vbd.mmap[moff : moff+int(out.Len)]
-}
-
-func (vbd *VirBlkDev) entCdb(off int) []byte {
-	cdbStart := int(vbd.entReqCdbOff(off))
-	len := vbd.cdbLen(cdbStart)
-	return vbd.mmap[cdbStart : cdbStart+len]
-}
-
-func (vbd *VirBlkDev) cdbLen(cdbStart int) int {
-	opcode := vbd.mmap[cdbStart]
-	// See spc-4 4.2.5.1 operation code
-	//
-	if opcode <= 0x1f {
-		return 6
-	} else if opcode <= 0x5f {
-		return 10
-	} else if opcode == 0x7f {
-		return int(vbd.mmap[cdbStart+7]) + 8
-	} else if opcode >= 0x80 && opcode <= 0x9f {
-		return 16
-	} else if opcode >= 0xa0 && opcode <= 0xbf {
-		return 12
-	} else {
-		panic(fmt.Sprintf("what opcode is %x", opcode))
+/*
+struct tcmu_tmr_entry {
+	struct tcmu_cmd_entry_hdr hdr;
+
+	__u8 tmr_type;
+	__u8 __pad1;
+	__u16 __pad2;
+	__u32 cmd_cnt;
+	__u64 __pad3;
+	__u64 __pad4;
+	__u16 cmd_ids[0];
+} __packed;
+*/
+const (
+	offTmrType   = 8
+	offTmrCmdCnt = 12
+	offTmrCmdIds = 32
+)
+
+func (vbd *VirBlkDev) entTmrType(off int) TmrType {
+	return TmrType(vbd.mmap[off+offTmrType])
+}
+
+func (vbd *VirBlkDev) entTmrCmdIds(off int) []uint16 {
+	cnt := int(*(*uint32)(unsafe.Pointer(&vbd.mmap[off+offTmrCmdCnt])))
+	// Don't trust cmd_cnt beyond the entry it's in.
+	if max := (vbd.entHdrGetLen(off) - offTmrCmdIds) / 2; cnt > max {
+		cnt = max
+	}
+	if cnt < 0 {
+		cnt = 0
+	}
+	ids := make([]uint16, cnt)
+	for i := range ids {
+		ids[i] = *(*uint16)(unsafe.Pointer(&vbd.mmap[off+offTmrCmdIds+2*i]))
+	}
+	return ids
+}
+
+// checkEnt makes sure the entry at off, ringOff into the command ring, lies between there and the head
+// without wrapping, and is big enough for its opcode. An entry that isn't means the ring can't be trusted
+// any further.
+func (vbd *VirBlkDev) checkEnt(off int, ringOff uint32, head uint32) error {
+	entLen := vbd.entHdrGetLen(off)
+	min := entAlignSize
+	switch vbd.entHdrOp(off) {
+	case tcmuOpCmd:
+		min = cmdEntrySize
+	case tcmuOpTmr:
+		min = offTmrCmdIds
+	}
+	avail := (head + vbd.mbCmdrSize() - ringOff) % vbd.mbCmdrSize()
+	if entLen < min || uint64(ringOff)+uint64(entLen) > uint64(vbd.mbCmdrSize()) || uint32(entLen) > avail {
+		return fmt.Errorf("ring entry at %d, opcode %d, has bad length %d", ringOff, vbd.entHdrOp(off), entLen)
+	}
+	return nil
+}
+
+// entIovecs returns the data buffers of the command entry at off, checking each against the data area. The
+// buffers are in the data area, which stays the command's until it's completed, but the iovecs locating them
+// are read now: once the tail passes the entry, or a response is written over it, they're gone.
+func (vbd *VirBlkDev) entIovecs(off int) ([][]byte, error) {
+	cnt := uint64(vbd.entReqIovCnt(off))
+	if uint64(offReqIov0Base)+cnt*iovSize > uint64(vbd.entHdrGetLen(off)) {
+		return nil, fmt.Errorf("iov_cnt %d overruns the entry", cnt)
+	}
+	vecs := make([][]byte, cnt)
+	for i := range vecs {
+		v, err := vbd.entIovecN(off, i)
+		if err != nil {
+			return nil, err
+		}
+		vecs[i] = v
+	}
+	return vecs, nil
+}
+
+func (vbd *VirBlkDev) entIovecN(off int, idx int) ([]byte, error) {
+	// iov_base is an offset into the map, rather than an address. Both fields are the size of a pointer.
+	p := off + offReqIov0Base + idx*iovSize
+	base := uint64(*(*uint)(unsafe.Pointer(&vbd.mmap[p])))
+	length := uint64(*(*uint)(unsafe.Pointer(&vbd.mmap[p+iovSize/2])))
+	if base < vbd.dataOff() || base > uint64(len(vbd.mmap)) || length > uint64(len(vbd.mmap))-base {
+		return nil, fmt.Errorf("iovec %d (%d, %d bytes) is outside the data area", idx, base, length)
+	}
+	return vbd.mmap[base : base+length], nil
+}
+
+// entCdb returns a copy of the CDB of the command entry at off, which the kernel puts inside the entry. It's
+// copied because with out-of-order completion the tail can move past the entry, and the kernel reuse it,
+// while the command is still being handled.
+func (vbd *VirBlkDev) entCdb(off int) ([]byte, error) {
+	start := vbd.entReqCdbOff(off)
+	end := uint64(off + vbd.entHdrGetLen(off))
+	if start < uint64(off+offReqIov0Base) || start >= end {
+		return nil, fmt.Errorf("cdb_off %d is outside its entry", start)
+	}
+	cdb := vbd.mmap[start:end]
+	n, err := scsi.CDBLen(cdb)
+	if err != nil {
+		return nil, err
+	}
+	if n > len(cdb) {
+		return nil, fmt.Errorf("%d byte CDB for opcode 0x%02x overruns its entry", n, cdb[0])
 	}
+	return append([]byte(nil), cdb[:n]...), nil
 }
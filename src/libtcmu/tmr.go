@@ -0,0 +1,53 @@
+package tcmu
+
+import "fmt"
+
+// TmrType is the task management function a Tmr reports; the kernel's TCMU_TMR_* values.
+type TmrType uint8
+
+const (
+	TmrUnknown         TmrType = 0
+	TmrAbortTask       TmrType = 1
+	TmrAbortTaskSet    TmrType = 2
+	TmrClearAca        TmrType = 3
+	TmrClearTaskSet    TmrType = 4
+	TmrLunReset        TmrType = 5
+	TmrTargetWarmReset TmrType = 6
+	TmrTargetColdReset TmrType = 7
+	// A pseudo reset, after a PERSISTENT RESERVE OUT.
+	TmrLunResetPro TmrType = 128
+)
+
+var tmrTypeNames = map[TmrType]string{
+	TmrUnknown:         "UNKNOWN",
+	TmrAbortTask:       "ABORT TASK",
+	TmrAbortTaskSet:    "ABORT TASK SET",
+	TmrClearAca:        "CLEAR ACA",
+	TmrClearTaskSet:    "CLEAR TASK SET",
+	TmrLunReset:        "LUN RESET",
+	TmrTargetWarmReset: "TARGET WARM RESET",
+	TmrTargetColdReset: "TARGET COLD RESET",
+	TmrLunResetPro:     "LUN RESET (PR OUT)",
+}
+
+func (t TmrType) String() string {
+	if s, ok := tmrTypeNames[t]; ok {
+		return s
+	}
+	return fmt.Sprintf("TMR(%d)", uint8(t))
+}
+
+// Tmr is a task management notification from the kernel (a TCMU_OP_TMR entry on the ring). target_core has
+// already carried out the function; CmdIds lists the commands it aborted that were already handed to us, by
+// ScsiCmd.ID. Their completions are still expected, but the kernel will discard them.
+type Tmr struct {
+	Type   TmrType
+	CmdIds []uint16
+}
+
+// TmrHandler is an optional interface for a ScsiCmdHandler that wants to hear about task management functions,
+// eg. to cancel in-flight work for aborted commands. If the handler implements it, the device asks the kernel
+// to send them. HandleTmr is called on the goroutine polling the ring, so it shouldn't block.
+type TmrHandler interface {
+	HandleTmr(tmr Tmr)
+}
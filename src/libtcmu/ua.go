@@ -0,0 +1,119 @@
+package tcmu
+
+import (
+	"sync"
+
+	"libtcmu/scsi"
+)
+
+// maxUnitAttentions bounds the unit attention conditions queued at once. Any more are dropped.
+const maxUnitAttentions = 16
+
+// unitAttentions holds the unit attention conditions established and not yet reported, oldest first.
+//
+// SPC keeps a queue for each I_T nexus, and some conditions are for every nexus but the one whose command
+// caused them. A tcm_loop device has exactly one nexus, and target_core_user doesn't say which a command came
+// in on anyway, so there's one queue for the device. Of the conditions that would only go to the other
+// nexuses, MODE PARAMETERS CHANGED is still established, as everything sharing the one nexus may have the
+// old parameters cached; the rest aren't.
+type unitAttentions struct {
+	sync.Mutex
+	pending []uint16
+}
+
+// establish queues the additional sense code asc as a unit attention. A condition already pending isn't
+// queued twice. A power on or reset (ASC 29h) supersedes everything pending before it, as the initiator will
+// have to start afresh anyway.
+func (u *unitAttentions) establish(asc uint16) {
+	u.Lock()
+	defer u.Unlock()
+	if asc>>8 == scsi.AscPowerOnResetOrBusDeviceResetOccurred>>8 {
+		u.pending = u.pending[:0]
+	}
+	if containsAsc(u.pending, asc) {
+		return
+	}
+	if len(u.pending) >= maxUnitAttentions {
+		log.Warnf("[unitAttentions] dropping unit attention 0x%04x: too many pending", asc)
+		return
+	}
+	u.pending = append(u.pending, asc)
+}
+
+// next takes the oldest unit attention pending.
+func (u *unitAttentions) next() (uint16, bool) {
+	u.Lock()
+	defer u.Unlock()
+	if len(u.pending) == 0 {
+		return 0, false
+	}
+	asc := u.pending[0]
+	u.pending = u.pending[1:]
+	return asc, true
+}
+
+// clear removes asc from what's pending, if it's there.
+func (u *unitAttentions) clear(asc uint16) {
+	u.Lock()
+	defer u.Unlock()
+	for i, a := range u.pending {
+		if a == asc {
+			u.pending = append(u.pending[:i:i], u.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+func containsAsc(q []uint16, asc uint16) bool {
+	for _, a := range q {
+		if a == asc {
+			return true
+		}
+	}
+	return false
+}
+
+// EstablishUnitAttention queues a unit attention condition, with additional sense code asc. The initiator is
+// told on its next command other than INQUIRY, REPORT LUNS and REQUEST SENSE, which fails with CHECK CONDITION,
+// UNIT ATTENTION; or by REQUEST SENSE, which reports and clears one condition at a time. It's for anything that
+// changes the device under the initiator's feet, eg. its capacity.
+func (vbd *VirBlkDev) EstablishUnitAttention(asc uint16) {
+	vbd.unitAttentions.establish(asc)
+}
+
+// powerOn establishes the unit attention a newly created device starts with: as far as the initiator is
+// concerned, it has just been powered on.
+func (vbd *VirBlkDev) powerOn() {
+	vbd.EstablishUnitAttention(scsi.AscPowerOnResetOrBusDeviceResetOccurred)
+}
+
+// Nexus identifies the I_T nexus the command came in on. target_core_user doesn't pass that on, so every
+// command is taken to be from the loopback nexus the device was created with.
+func (cmd *ScsiCmd) Nexus() string {
+	return cmd.vbd.nexusID()
+}
+
+func (vbd *VirBlkDev) nexusID() string {
+	if vbd.scsi.WWN == nil {
+		return ""
+	}
+	return vbd.scsi.WWN.NexusID()
+}
+
+// reportUnitAttention returns the response reporting the next unit attention pending, if there is one and cmd
+// is one that reports it. INQUIRY, REPORT LUNS and REQUEST SENSE don't, though REPORT LUNS does clear REPORTED
+// LUNS DATA HAS CHANGED, and REQUEST SENSE reports it in its data instead.
+func (vbd *VirBlkDev) reportUnitAttention(cmd *ScsiCmd) (ScsiResponse, bool) {
+	switch cmd.Command() {
+	case scsi.ReportLuns:
+		vbd.unitAttentions.clear(scsi.AscReportedLunsDataHasChanged)
+		return ScsiResponse{}, false
+	case scsi.Inquiry, scsi.RequestSense:
+		return ScsiResponse{}, false
+	}
+	asc, ok := vbd.unitAttentions.next()
+	if !ok {
+		return ScsiResponse{}, false
+	}
+	return cmd.CheckCondition(scsi.SenseUnitAttention, asc), true
+}
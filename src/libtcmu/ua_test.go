@@ -0,0 +1,76 @@
+package tcmu
+
+import (
+	"testing"
+
+	"libtcmu/scsi"
+)
+
+func TestUnitAttentions(t *testing.T) {
+	sh := &ScsiHandler{VolumeName: "t", DataSizes: DataSizes{1 << 20, 512}, WWN: GenerateTestWWN("t"),
+		Handler: memHandler(1 << 20)}
+	r, err := NewFakeRing(sh, FakeRingConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	requestSense := []byte{scsi.RequestSense, 0, 0, 0, 18, 0}
+	expect := func(what string, cdb []byte, status byte, asc uint16) {
+		t.Helper()
+		fc, err := r.Do(cdb, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := uint16(0)
+		if fc.Status == scsi.SamStatCheckCondition {
+			got = uint16(fc.Sense[12])<<8 | uint16(fc.Sense[13])
+		}
+		if fc.Status != status || got != asc {
+			t.Fatalf("%s: status 0x%02x, ASC 0x%04x, want 0x%02x, 0x%04x", what, fc.Status, got, status, asc)
+		}
+	}
+	senseData := func(what string, asc uint16) {
+		t.Helper()
+		fc, err := r.Do(requestSense, nil, 18)
+		if err != nil || fc.Status != scsi.SamStatGood {
+			t.Fatalf("%s: REQUEST SENSE: %v, status 0x%02x", what, err, fc.Status)
+		}
+		if got := uint16(fc.Data[12])<<8 | uint16(fc.Data[13]); got != asc {
+			t.Fatalf("%s: REQUEST SENSE reported 0x%04x, want 0x%04x", what, got, asc)
+		}
+	}
+
+	// INQUIRY doesn't report the power-on unit attention; the next TEST UNIT READY does, once.
+	expect("INQUIRY", []byte{scsi.Inquiry, 0, 0, 0, 36, 0}, scsi.SamStatGood, 0)
+	expect("power on", testUnitReady, scsi.SamStatCheckCondition, scsi.AscPowerOnResetOrBusDeviceResetOccurred)
+	expect("after power on", testUnitReady, scsi.SamStatGood, 0)
+
+	// REQUEST SENSE reports them one at a time, oldest first, and each only once.
+	vbd := r.Device()
+	vbd.EstablishUnitAttention(scsi.AscCapacityDataHasChanged)
+	vbd.EstablishUnitAttention(scsi.AscModeParametersChanged)
+	vbd.EstablishUnitAttention(scsi.AscCapacityDataHasChanged)
+	senseData("first", scsi.AscCapacityDataHasChanged)
+	senseData("second", scsi.AscModeParametersChanged)
+	senseData("none left", 0)
+
+	// REPORT LUNS clears REPORTED LUNS DATA HAS CHANGED.
+	vbd.EstablishUnitAttention(scsi.AscReportedLunsDataHasChanged)
+	expect("REPORT LUNS", []byte{scsi.ReportLuns, 0, 0, 0, 0, 0, 0, 0, 0, 16, 0, 0}, scsi.SamStatGood, 0)
+	expect("after REPORT LUNS", testUnitReady, scsi.SamStatGood, 0)
+
+	// A reset supersedes whatever was pending.
+	vbd.EstablishUnitAttention(scsi.AscModeParametersChanged)
+	vbd.EstablishUnitAttention(scsi.AscPowerOnResetOrBusDeviceResetOccurred)
+	expect("reset", testUnitReady, scsi.SamStatCheckCondition, scsi.AscPowerOnResetOrBusDeviceResetOccurred)
+	expect("after reset", testUnitReady, scsi.SamStatGood, 0)
+
+	// Past maxUnitAttentions, more are dropped rather than queued.
+	for i := 0; i < maxUnitAttentions+4; i++ {
+		vbd.EstablishUnitAttention(0x3f00 | uint16(i))
+	}
+	for i := 0; i < maxUnitAttentions; i++ {
+		expect("queued", testUnitReady, scsi.SamStatCheckCondition, 0x3f00|uint16(i))
+	}
+	expect("dropped", testUnitReady, scsi.SamStatGood, 0)
+}